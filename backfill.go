@@ -0,0 +1,286 @@
+package prom2click
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gotomicro/cetus/l"
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// BackfillConfig 从Prometheus TSDB目录回填历史数据的配置
+type BackfillConfig struct {
+	Dir              string        // Prometheus数据目录或快照目录
+	MinTime          int64         // 回填起始时间，毫秒时间戳，0表示不限制
+	MaxTime          int64         // 回填结束时间，毫秒时间戳，0表示不限制
+	StateFile        string        // 进度文件，不为空时中断后可以从上次写入的位置继续
+	ProgressInterval time.Duration // 进度日志的输出间隔，默认10s
+}
+
+// backfillState is the resume point persisted in BackfillConfig.StateFile,
+// series are visited in label order so an index into the current block is stable between runs
+type backfillState struct {
+	Done    []string `json:"done"`
+	Block   string   `json:"block"`
+	Series  int      `json:"series"`
+	Samples int      `json:"samples"`
+}
+
+func (s *backfillState) isDone(block string) bool {
+	for _, b := range s.Done {
+		if b == block {
+			return true
+		}
+	}
+	return false
+}
+
+func loadBackfillState(path string) (*backfillState, error) {
+	state := &backfillState{}
+	if path == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid backfill state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// save writes the state to a temporary file first so a crash never leaves a truncated state behind
+func (s *backfillState) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Backfill 将Prometheus TSDB目录中的block以只读方式回填到clickhouse，与实时写入一样先执行WriteRelabelConfigs
+func (c *Container) Backfill(ctx context.Context, bc BackfillConfig) error {
+	w, err := NewWriter(c.config)
+	if err != nil {
+		return err
+	}
+	defer w.db.Close()
+	// the results of a serving prom2click may cover the backfilled range already, the disk tier is dropped.
+	// Its memory tier is out of reach, see ReadCacheSize
+	if dir := c.config.ReadCacheDir; dir != "" {
+		defer purgeReadCacheDir(dir)
+	}
+	return w.backfill(ctx, bc)
+}
+
+// backfill writes the samples of bc in batches like the writer goroutine does, label index included.
+// The index goes first so that a batch failing half way is written again on resume without duplicate samples
+func (w *promWriter) backfill(ctx context.Context, bc BackfillConfig) error {
+	sql := fmt.Sprintf(insertSQL, w.config.ClickhouseDB, w.config.ClickhouseTable)
+	return backfill(ctx, bc, w.config.batchSize(), w.config.writeRelabelConfigs(), func(reqs []*promRequest) error {
+		w.metrics.batchSize.Observe(float64(len(reqs)))
+		if err := w.insertIndex(reqs); err != nil {
+			return err
+		}
+		err := w.insert(sql, reqs)
+		w.invalidateCache(reqs)
+		return err
+	})
+}
+
+// backfillProgress is reported in the progress logs
+type backfillProgress struct {
+	blocks  int
+	total   int
+	series  int
+	samples int
+	start   time.Time
+}
+
+func (p *backfillProgress) log(step string) {
+	elapsed := time.Since(p.start)
+	elog.Info("backfill", l.S("step", step),
+		l.I("blocks", p.blocks), l.I("total", p.total), l.I("series", p.series), l.I("samples", p.samples),
+		l.S("elapsed", elapsed.Truncate(time.Second).String()),
+		l.S("rate", fmt.Sprintf("%.0f samples/s", float64(p.samples)/math.Max(elapsed.Seconds(), 1))))
+}
+
+// backfill reads every block of bc.Dir overlapping the time range, relabels the series with rules
+// and passes the samples to flush in batches of at least batch samples,
+// the state file is updated after each successful flush
+func backfill(ctx context.Context, bc BackfillConfig, batch int, rules []*relabel.Config, flush func([]*promRequest) error) error {
+	if bc.Dir == "" {
+		return fmt.Errorf("backfill dir is empty")
+	}
+	if bc.MaxTime == 0 {
+		bc.MaxTime = math.MaxInt64
+	}
+	if bc.MinTime > bc.MaxTime {
+		return fmt.Errorf("backfill min time %d is after max time %d", bc.MinTime, bc.MaxTime)
+	}
+	if bc.ProgressInterval <= 0 {
+		bc.ProgressInterval = 10 * time.Second
+	}
+	if batch < 1 {
+		batch = 1
+	}
+	state, err := loadBackfillState(bc.StateFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := tsdb.OpenDBReadOnly(filepath.Clean(bc.Dir), log.NewNopLogger())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	blocks, err := db.Blocks()
+	if err != nil {
+		return err
+	}
+
+	progress := &backfillProgress{total: len(blocks), start: time.Now()}
+	lastLog := time.Now()
+	for _, block := range blocks {
+		meta := block.Meta()
+		id := meta.ULID.String()
+		// block MaxTime is exclusive
+		if state.isDone(id) || meta.MaxTime <= bc.MinTime || meta.MinTime > bc.MaxTime {
+			progress.blocks++
+			continue
+		}
+		if state.Block != id {
+			state.Block, state.Series, state.Samples = id, 0, 0
+		}
+		elog.Info("backfill", l.S("step", "block"), l.S("block", id),
+			l.S("from", time.UnixMilli(meta.MinTime).UTC().Format(time.RFC3339)),
+			l.S("to", time.UnixMilli(meta.MaxTime).UTC().Format(time.RFC3339)),
+			l.I("series", state.Series))
+
+		if err = backfillBlock(ctx, block, bc, batch, rules, state, progress, func(reqs []*promRequest) error {
+			if err := flush(reqs); err != nil {
+				return err
+			}
+			if err := state.save(bc.StateFile); err != nil {
+				return err
+			}
+			if time.Since(lastLog) >= bc.ProgressInterval {
+				progress.log("progress")
+				lastLog = time.Now()
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("block %s: %w", id, err)
+		}
+
+		state.Done = append(state.Done, id)
+		state.Block, state.Series, state.Samples = "", 0, 0
+		if err = state.save(bc.StateFile); err != nil {
+			return err
+		}
+		progress.blocks++
+	}
+	progress.log("done")
+	return nil
+}
+
+// backfillBlock sends the samples of one block, skipping what state records as already written
+func backfillBlock(ctx context.Context, block tsdb.BlockReader, bc BackfillConfig, batch int, rules []*relabel.Config,
+	state *backfillState, progress *backfillProgress, flush func([]*promRequest) error) error {
+	q, err := tsdb.NewBlockQuerier(block, bc.MinTime, bc.MaxTime)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	// resume position, it only moves forward once the samples before it are flushed
+	var (
+		reqs    []*promRequest
+		series  = state.Series
+		samples = state.Samples
+	)
+	send := func(nextSeries, nextSamples int) error {
+		if len(reqs) == 0 {
+			return nil
+		}
+		state.Series, state.Samples = nextSeries, nextSamples
+		if err := flush(reqs); err != nil {
+			return err
+		}
+		progress.samples += len(reqs)
+		reqs = nil
+		return nil
+	}
+
+	set := q.Select(true, nil, labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+"))
+	for idx := 0; set.Next(); idx++ {
+		if idx < state.Series {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		s := set.At()
+		pbLabels := make([]prompb.Label, 0, len(s.Labels()))
+		for _, lb := range s.Labels() {
+			pbLabels = append(pbLabels, prompb.Label{Name: lb.Name, Value: lb.Value})
+		}
+		if len(rules) > 0 {
+			var keep bool
+			if pbLabels, keep = relabelSeries(pbLabels, rules); !keep {
+				series, samples = idx+1, 0
+				continue
+			}
+		}
+		name, tags := seriesTags(pbLabels)
+
+		skip := 0
+		if idx == state.Series {
+			skip = state.Samples
+		}
+		it := s.Iterator()
+		for n := 0; it.Next(); n++ {
+			if n < skip {
+				continue
+			}
+			t, v := it.At()
+			reqs = append(reqs, &promRequest{name: name, tags: tags, val: v, ts: time.Unix(t/1000, 0)})
+			if len(reqs) >= batch {
+				if err = send(idx, n+1); err != nil {
+					return err
+				}
+			}
+		}
+		if err = it.Err(); err != nil {
+			return err
+		}
+		series, samples = idx+1, 0
+		progress.series++
+	}
+	if err = set.Err(); err != nil {
+		return err
+	}
+	return send(series, samples)
+}
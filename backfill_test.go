@@ -0,0 +1,176 @@
+package prom2click
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/tsdbutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSample struct {
+	t int64
+	v float64
+}
+
+func (s testSample) T() int64   { return s.t }
+func (s testSample) V() float64 { return s.v }
+
+// createTestBlock writes two series with n samples each, one sample every second starting at 0
+func createTestBlock(t *testing.T, n int) string {
+	dir := t.TempDir()
+	var series []storage.Series
+	for _, job := range []string{"a", "b"} {
+		samples := make([]tsdbutil.Sample, 0, n)
+		for i := 0; i < n; i++ {
+			samples = append(samples, testSample{t: int64(i) * 1000, v: float64(i)})
+		}
+		series = append(series, storage.NewListSeries(labels.FromStrings("__name__", "up", "job", job), samples))
+	}
+	_, err := tsdb.CreateBlock(series, dir, 0, log.NewNopLogger())
+	assert.NoError(t, err)
+	return dir
+}
+
+func TestBackfill(t *testing.T) {
+	dir := createTestBlock(t, 10)
+	var got []*promRequest
+	err := backfill(context.Background(), BackfillConfig{Dir: dir, MinTime: 2000, MaxTime: 5000}, 3, nil, func(reqs []*promRequest) error {
+		got = append(got, reqs...)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, got, 8)
+	assert.Equal(t, "up", got[0].name)
+	assert.Equal(t, []string{"__name__=up", "job=a"}, got[0].tags)
+	assert.Equal(t, int64(2), got[0].ts.Unix())
+	assert.Equal(t, 5.0, got[3].val)
+	assert.Equal(t, []string{"__name__=up", "job=b"}, got[4].tags)
+}
+
+func TestBackfillRelabel(t *testing.T) {
+	dir := createTestBlock(t, 10)
+	env := "prod"
+	rules, err := compileRelabelConfigs([]*relabelConfig{
+		{SourceLabels: []string{"job"}, Regex: "b", Action: "drop"},
+		{TargetLabel: "env", Replacement: &env},
+	})
+	assert.NoError(t, err)
+	var got []*promRequest
+	err = backfill(context.Background(), BackfillConfig{Dir: dir}, 4, rules, func(reqs []*promRequest) error {
+		got = append(got, reqs...)
+		return nil
+	})
+	assert.NoError(t, err)
+	// job=b is dropped like it is on live writes
+	assert.Len(t, got, 10)
+	assert.Equal(t, []string{"__name__=up", "env=prod", "job=a"}, got[9].tags)
+}
+
+func TestBackfillResume(t *testing.T) {
+	dir := createTestBlock(t, 10)
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	bc := BackfillConfig{Dir: dir, StateFile: stateFile}
+
+	// fail on the third batch, the first two are recorded in the state file
+	var first []*promRequest
+	calls := 0
+	err := backfill(context.Background(), bc, 4, nil, func(reqs []*promRequest) error {
+		calls++
+		if calls == 3 {
+			return errors.New("clickhouse is down")
+		}
+		first = append(first, reqs...)
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Len(t, first, 8)
+
+	state, err := loadBackfillState(stateFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, state.Series)
+	assert.Equal(t, 8, state.Samples)
+
+	var second []*promRequest
+	err = backfill(context.Background(), bc, 4, nil, func(reqs []*promRequest) error {
+		second = append(second, reqs...)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, second, 12)
+	assert.Equal(t, 8.0, second[0].val)
+	assert.Equal(t, []string{"__name__=up", "job=a"}, second[0].tags)
+
+	state, err = loadBackfillState(stateFile)
+	assert.NoError(t, err)
+	assert.Len(t, state.Done, 1)
+	assert.Equal(t, "", state.Block)
+
+	// every block is done, nothing is sent again
+	err = backfill(context.Background(), bc, 4, nil, func(reqs []*promRequest) error {
+		t.Fatal("unexpected flush")
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestBackfillInvalidRange(t *testing.T) {
+	err := backfill(context.Background(), BackfillConfig{Dir: t.TempDir(), MinTime: 2, MaxTime: 1}, 1, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestBackfillLabelIndex(t *testing.T) {
+	dir := createTestBlock(t, 10)
+	cfg := DefaultConfig()
+	cfg.ClickhouseLabelIndexTable = "samples_labels"
+	cfg.ClickhouseBatch = 4
+	w, err := NewWriter(cfg)
+	assert.NoError(t, err)
+	var queries []string
+	w.db = openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		queries = append(queries, query)
+		return nil, nil
+	})
+	assert.NoError(t, w.backfill(context.Background(), BackfillConfig{Dir: dir}))
+
+	index, samples := 0, 0
+	for _, query := range queries {
+		switch {
+		case strings.Contains(query, "INSERT INTO metrics.samples_labels"):
+			index++
+		case strings.Contains(query, "INSERT INTO metrics.samples"):
+			samples++
+		}
+	}
+	// two labels for each of the two series, written once
+	assert.Equal(t, 4, index)
+	assert.Equal(t, 20, samples)
+}
+
+func TestBackfillLabelIndexSortedTags(t *testing.T) {
+	dir := t.TempDir()
+	series := storage.NewListSeries(labels.FromStrings("__name__", "up", "foo", "x", "foo1", "y"),
+		[]tsdbutil.Sample{testSample{t: 1000, v: 1}})
+	_, err := tsdb.CreateBlock([]storage.Series{series}, dir, 0, log.NewNopLogger())
+	assert.NoError(t, err)
+
+	cfg := DefaultConfig()
+	cfg.ClickhouseLabelIndexTable = "samples_labels"
+	w, err := NewWriter(cfg)
+	assert.NoError(t, err)
+	w.db = openFakeDB(t, func(query string) ([][]driver.Value, error) { return nil, nil })
+	assert.NoError(t, w.backfill(context.Background(), BackfillConfig{Dir: dir}))
+
+	// label name order is foo, foo1 but the stored tags column is sorted as strings
+	sorted := []string{"__name__=up", "foo1=y", "foo=x"}
+	assert.True(t, w.indexed.has(labelIndexKey{day: 0, fingerprint: seriesFingerprint(sorted)}))
+	assert.False(t, w.indexed.has(labelIndexKey{day: 0, fingerprint: seriesFingerprint([]string{"__name__=up", "foo=x", "foo1=y"})}))
+}
@@ -0,0 +1,87 @@
+package prom2click
+
+import (
+	"context"
+	"io"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+const (
+	// samplesPerChunk is the number of samples prometheus cuts its own XOR chunks at
+	samplesPerChunk = 120
+	// maxChunkedFrameBytes is the size a ChunkedReadResponse frame is written at, same as prometheus
+	maxChunkedFrameBytes = 1024 * 1024
+)
+
+// ReadStreamed answers req with XOR chunks, series are encoded as they are read from clickhouse
+// and written to w as ChunkedReadResponse frames of about maxChunkedFrameBytes.
+// w is usually a remote.ChunkedWriter which adds the frame header.
+func (r *promReader) ReadStreamed(ctx context.Context, req *prompb.ReadRequest, w io.Writer) error {
+	for i, q := range req.Queries {
+		var (
+			frame []*prompb.ChunkedSeries
+			size  int
+		)
+		flush := func() error {
+			if len(frame) == 0 {
+				return nil
+			}
+			b, err := (&prompb.ChunkedReadResponse{ChunkedSeries: frame, QueryIndex: int64(i)}).Marshal()
+			if err != nil {
+				return err
+			}
+			frame, size = frame[:0], 0
+			_, err = w.Write(b)
+			return err
+		}
+		err := r.querySeries(ctx, q, func(tags []string, samples []prompb.Sample) error {
+			chunks, err := encodeChunks(samples)
+			if err != nil {
+				return err
+			}
+			series := &prompb.ChunkedSeries{Labels: makeLabels(tags), Chunks: chunks}
+			frame = append(frame, series)
+			size += series.Size()
+			if size >= maxChunkedFrameBytes {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err = flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeChunks encodes time ordered samples into XOR chunks of up to samplesPerChunk samples
+func encodeChunks(samples []prompb.Sample) ([]prompb.Chunk, error) {
+	chunks := make([]prompb.Chunk, 0, (len(samples)+samplesPerChunk-1)/samplesPerChunk)
+	for len(samples) > 0 {
+		n := len(samples)
+		if n > samplesPerChunk {
+			n = samplesPerChunk
+		}
+		chk := chunkenc.NewXORChunk()
+		app, err := chk.Appender()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range samples[:n] {
+			app.Append(s.Timestamp, s.Value)
+		}
+		chunks = append(chunks, prompb.Chunk{
+			MinTimeMs: samples[0].Timestamp,
+			MaxTimeMs: samples[n-1].Timestamp,
+			Type:      prompb.Chunk_XOR,
+			Data:      chk.Bytes(),
+		})
+		samples = samples[n:]
+	}
+	return chunks, nil
+}
@@ -0,0 +1,98 @@
+package prom2click
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeChunks(t *testing.T) {
+	samples := make([]prompb.Sample, 0, 250)
+	for i := 0; i < 250; i++ {
+		samples = append(samples, prompb.Sample{Timestamp: int64(i) * 15000, Value: float64(i) / 2})
+	}
+	chunks, err := encodeChunks(samples)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 3)
+	assert.Equal(t, int64(0), chunks[0].MinTimeMs)
+	assert.Equal(t, int64(119*15000), chunks[0].MaxTimeMs)
+	assert.Equal(t, int64(249*15000), chunks[2].MaxTimeMs)
+
+	var decoded []prompb.Sample
+	for _, c := range chunks {
+		assert.Equal(t, prompb.Chunk_XOR, c.Type)
+		chk, err := chunkenc.FromData(chunkenc.EncXOR, c.Data)
+		assert.NoError(t, err)
+		it := chk.Iterator(nil)
+		for it.Next() {
+			ts, v := it.At()
+			decoded = append(decoded, prompb.Sample{Timestamp: ts, Value: v})
+		}
+		assert.NoError(t, it.Err())
+	}
+	assert.Equal(t, samples, decoded)
+
+	chunks, err = encodeChunks(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+}
+
+func TestReadStreamed(t *testing.T) {
+	conf := DefaultConfig()
+	db := openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		var rows [][]driver.Value
+		for i := 0; i < 130; i++ {
+			rows = append(rows, []driver.Value{int64(1), int64(i) * 1000, "up", []string{"__name__=up", "job=a"}, float64(i)})
+		}
+		rows = append(rows, []driver.Value{int64(1), int64(0), "up", []string{"__name__=up", "job=b"}, 1.0})
+		return rows, nil
+	})
+	cmp := &Component{
+		Engine: gin.New(),
+		config: conf,
+		reader: &promReader{conf: conf, db: db, metrics: newReaderMetrics(conf)},
+	}
+	cmp.route()
+
+	reqBytes, err := proto.Marshal(&prompb.ReadRequest{
+		Queries:               []*prompb.Query{{EndTimestampMs: 200000}, {EndTimestampMs: 200000}},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS},
+	})
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/read", bytes.NewReader(snappy.Encode(nil, reqBytes)))
+	w := httptest.NewRecorder()
+	cmp.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse", w.Header().Get("Content-Type"))
+	stream := remote.NewChunkedReader(w.Body, remote.DefaultChunkedReadLimit, nil)
+	var frames []*prompb.ChunkedReadResponse
+	for {
+		res := &prompb.ChunkedReadResponse{}
+		err := stream.NextProto(res)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		frames = append(frames, res)
+	}
+	assert.Len(t, frames, 2)
+	for i, f := range frames {
+		assert.Equal(t, int64(i), f.QueryIndex)
+		assert.Len(t, f.ChunkedSeries, 2)
+		assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}}, f.ChunkedSeries[0].Labels)
+		assert.Len(t, f.ChunkedSeries[0].Chunks, 2)
+		assert.Len(t, f.ChunkedSeries[1].Chunks, 1)
+	}
+}
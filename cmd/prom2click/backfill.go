@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gotomicro/ego/core/constant"
+
+	"github.com/clickvisual/prom2click"
+)
+
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	configPath := fs.String("config", constant.DefaultConfig, "config file")
+	key := fs.String("key", "prom2click", "config key of the clickhouse settings")
+	dir := fs.String("dir", "", "Prometheus data or snapshot directory")
+	minTime := fs.String("min-time", "", "start of the range, unix seconds or RFC3339")
+	maxTime := fs.String("max-time", "", "end of the range, unix seconds or RFC3339")
+	state := fs.String("state", "", "state file used to resume an interrupted backfill")
+	progress := fs.Duration("progress", 10*time.Second, "progress log interval")
+	_ = fs.Parse(args)
+
+	bc := prom2click.BackfillConfig{Dir: *dir, StateFile: *state, ProgressInterval: *progress}
+	var err error
+	if bc.MinTime, err = parseMillis(*minTime); err != nil {
+		return err
+	}
+	if bc.MaxTime, err = parseMillis(*maxTime); err != nil {
+		return err
+	}
+	if err = loadConfig(*configPath); err != nil {
+		return err
+	}
+
+	// stop at the next series on interrupt, the state file keeps the position
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	return prom2click.Load(*key).Backfill(ctx, bc)
+}
+
+// parseMillis parses unix seconds or a RFC3339 time to milliseconds, empty returns 0
+func parseMillis(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return sec * 1000, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+	}
+	return t.UnixMilli(), nil
+}
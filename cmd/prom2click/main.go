@@ -0,0 +1,118 @@
+// prom2click 命令行工具
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gotomicro/ego"
+	"github.com/gotomicro/ego/core/constant"
+	"github.com/gotomicro/ego/core/eapp"
+	"github.com/gotomicro/ego/core/econf"
+	_ "github.com/gotomicro/ego/core/econf/file"
+	"github.com/gotomicro/ego/core/econf/manager"
+	"github.com/gotomicro/ego/core/eflag"
+	"github.com/gotomicro/ego/server"
+
+	"github.com/clickvisual/prom2click"
+)
+
+const usage = `usage: prom2click [command] [flags]
+
+commands:
+  serve         run the remote storage server (default)
+  check-config  load the config file and report errors
+  version       print version information
+  backfill      import Prometheus TSDB blocks into clickhouse
+
+run "prom2click <command> --help" for the flags of a command
+`
+
+func main() {
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	var err error
+	switch command {
+	case "serve":
+		err = runServe(args)
+	case "check-config":
+		err = runCheckConfig(args)
+	case "version":
+		eapp.PrintVersion()
+	case "backfill":
+		err = runBackfill(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "prom2click:", err)
+		os.Exit(1)
+	}
+}
+
+// runServe 通过ego启动服务，ego负责加载配置、监听信号以及优雅退出
+func runServe(args []string) error {
+	eflag.Register(
+		&eflag.StringFlag{Name: "key", Usage: "--key, config key of the server", Default: "prom2click"},
+		&eflag.BoolFlag{Name: "batch", Usage: "--batch, the config key holds a list of servers", Default: false},
+	)
+	app := ego.New(ego.WithArguments(args))
+	var servers []server.Server
+	for _, c := range containers(eflag.String("key"), eflag.Bool("batch")) {
+		comp, err := c.BuildE()
+		if err != nil {
+			return err
+		}
+		servers = append(servers, comp)
+	}
+	return app.Serve(servers...).Run()
+}
+
+func runCheckConfig(args []string) error {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configPath := fs.String("config", constant.DefaultConfig, "config file")
+	key := fs.String("key", "prom2click", "config key of the server")
+	batch := fs.Bool("batch", false, "the config key holds a list of servers")
+	_ = fs.Parse(args)
+
+	if err := loadConfig(*configPath); err != nil {
+		return err
+	}
+	list := containers(*key, *batch)
+	var errs []error
+	for i, c := range list {
+		if err := c.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %w", *key, i, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d server(s) configured under %q\n", *configPath, len(list), *key)
+	return nil
+}
+
+// containers 根据key加载一个或多个容器
+func containers(key string, batch bool) []*prom2click.Container {
+	if batch {
+		return prom2click.LoadBatch(key)
+	}
+	return []*prom2click.Container{prom2click.Load(key)}
+}
+
+// loadConfig 加载toml/yaml/json配置文件
+func loadConfig(path string) error {
+	ds, unmarshaller, _, err := manager.NewDataSource(path, false)
+	if err != nil {
+		return fmt.Errorf("load config %s: %w", path, err)
+	}
+	return econf.LoadFromDataSource(ds, unmarshaller)
+}
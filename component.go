@@ -1,8 +1,11 @@
 package prom2click
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -14,6 +17,7 @@ import (
 	"github.com/gotomicro/ego/core/elog"
 	"github.com/gotomicro/ego/server"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage/remote"
 )
 
@@ -29,11 +33,30 @@ type Component struct {
 	logger   *elog.Component
 	Server   *http.Server
 	listener net.Listener
-	writer   *promWriter
-	reader   *promReader
+	// initErr 为Init打开监听的错误，Start时返回
+	initErr error
+	writer  *promWriter
+	reader  *promReader
+	// engine 执行PromQL查询，未配置PromQL路径时为nil
+	engine    *promql.Engine
+	queryable *queryable
+	otlp      *otlpConverter
+	graphite  *graphiteServer
+	statsd    *statsdServer
+	thanos    *thanosStoreServer
 }
 
 func newComponent(name string, config *config, logger *elog.Component) *Component {
+	comp, err := newComponentE(name, config, logger)
+	if err != nil {
+		elog.Panic("p2c component fail", elog.FieldErr(err))
+		return nil
+	}
+	return comp
+}
+
+// newComponentE 创建组件，失败时返回错误
+func newComponentE(name string, config *config, logger *elog.Component) (*Component, error) {
 	var err error
 	gin.SetMode(config.Mode)
 	comp := &Component{
@@ -42,54 +65,165 @@ func newComponent(name string, config *config, logger *elog.Component) *Componen
 		logger:   logger,
 		Engine:   gin.New(),
 		listener: nil,
+		otlp:     newOTLPConverter(config.OTLPDeltaTTL),
 	}
 	comp.writer, err = NewWriter(config)
 	if err != nil {
-		elog.Panic("p2c writer fail", elog.FieldErr(err))
-		return nil
+		return nil, fmt.Errorf("p2c writer fail: %w", err)
 	}
 	comp.reader, err = NewReader(config)
 	if err != nil {
-		elog.Panic("p2c reader fail", elog.FieldErr(err))
-		return nil
+		return nil, fmt.Errorf("p2c reader fail: %w", err)
+	}
+	comp.writer.cache = comp.reader.cache
+	if config.PromQLQueryPath != "" || config.PromQLQueryRangePath != "" {
+		comp.engine = newPromQLEngine(config)
+		comp.queryable = &queryable{reader: comp.reader}
+	}
+	if config.GraphiteAddress != "" || config.GraphitePickleAddress != "" {
+		comp.graphite, err = newGraphiteServer(config, comp.writer, logger)
+		if err != nil {
+			return nil, fmt.Errorf("p2c graphite fail: %w", err)
+		}
+	}
+	if config.StatsdAddress != "" {
+		comp.statsd = newStatsdServer(config, comp.writer, logger)
+	}
+	if config.ThanosStoreAddress != "" {
+		comp.thanos = newThanosStoreServer(config, comp.reader, logger)
 	}
 	// 设置信任的header头
 	comp.Engine.TrustedPlatform = config.TrustedPlatform
 
 	comp.route()
-	return comp
+	return comp, nil
 }
 
 func (c *Component) route() {
-	c.Engine.Any(c.config.ClickhouseHTTPWritePath, func(ctx *gin.Context) {
-		prompbReq, err := remote.DecodeWriteRequest(ctx.Request.Body)
-		if err != nil {
-			ctx.String(http.StatusInternalServerError, err.Error())
-			return
-		}
-		c.writer.process(prompbReq)
-	})
+	// 路径为空时不注册对应路由
+	if c.config.ClickhouseHTTPWritePath != "" {
+		c.Engine.Any(c.config.ClickhouseHTTPWritePath, c.handleWrite)
+	}
+	if c.config.ClickhouseHTTPReadPath != "" {
+		c.Engine.POST(c.config.ClickhouseHTTPReadPath, c.handleRead)
+	}
+	if c.config.InfluxHTTPWritePath != "" {
+		c.Engine.POST(c.config.InfluxHTTPWritePath, c.handleInfluxWrite)
+	}
+	if c.config.InfluxV2HTTPWritePath != "" {
+		c.Engine.POST(c.config.InfluxV2HTTPWritePath, c.handleInfluxWrite)
+	}
+	if c.config.OTLPHTTPWritePath != "" {
+		c.Engine.POST(c.config.OTLPHTTPWritePath, c.handleOTLPWrite)
+	}
+	if c.config.PromQLQueryPath != "" {
+		c.Engine.GET(c.config.PromQLQueryPath, c.handleQuery)
+		c.Engine.POST(c.config.PromQLQueryPath, c.handleQuery)
+	}
+	if c.config.PromQLQueryRangePath != "" {
+		c.Engine.GET(c.config.PromQLQueryRangePath, c.handleQueryRange)
+		c.Engine.POST(c.config.PromQLQueryRangePath, c.handleQueryRange)
+	}
+	if c.config.LabelsPath != "" {
+		c.Engine.GET(c.config.LabelsPath, c.handleLabels)
+		c.Engine.POST(c.config.LabelsPath, c.handleLabels)
+	}
+	if c.config.LabelValuesPath != "" {
+		c.Engine.GET(c.config.LabelValuesPath, c.handleLabelValues)
+	}
+	if c.config.SeriesPath != "" {
+		c.Engine.GET(c.config.SeriesPath, c.handleSeries)
+		c.Engine.POST(c.config.SeriesPath, c.handleSeries)
+	}
+	if c.config.DebugQueryPath != "" {
+		c.Engine.GET(c.config.DebugQueryPath, c.handleDebugQuery)
+		c.Engine.POST(c.config.DebugQueryPath, c.handleDebugQuery)
+	}
+	if c.config.ImportHTTPPath != "" {
+		c.Engine.POST(c.config.ImportHTTPPath, c.handleImport)
+	}
+	if c.config.ExportHTTPPath != "" {
+		c.Engine.GET(c.config.ExportHTTPPath, c.handleExport)
+		c.Engine.POST(c.config.ExportHTTPPath, c.handleExport)
+	}
+}
 
-	c.Engine.POST(c.config.ClickhouseHTTPReadPath, func(ctx *gin.Context) {
-		prompbReq, err := remote.DecodeReadRequest(ctx.Request)
-		if err != nil {
-			ctx.String(http.StatusInternalServerError, err.Error())
-			return
-		}
-		var resp *prompb.ReadResponse
-		resp, err = c.reader.Read(prompbReq)
-		if err != nil {
-			ctx.String(http.StatusInternalServerError, err.Error())
+// handleWrite 处理prometheus remote write请求
+func (c *Component) handleWrite(ctx *gin.Context) {
+	tstart := time.Now()
+	prompbReq, err := remote.DecodeWriteRequest(ctx.Request.Body)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.writer.metrics.stage(stageDecode, time.Since(tstart).Seconds())
+	c.writer.process(prompbReq)
+}
+
+// handleRead 处理prometheus remote read请求，url参数aggregate可以指定本次请求的降采样聚合函数
+func (c *Component) handleRead(ctx *gin.Context) {
+	prompbReq, err := remote.DecodeReadRequest(ctx.Request)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	reader := c.reader
+	if aggregate := ctx.Query("aggregate"); aggregate != "" {
+		if !validAggregate(aggregate) {
+			ctx.String(http.StatusBadRequest, fmt.Sprintf("unknown aggregate %q", aggregate))
 			return
 		}
-		ctx.Header("Content-Type", "application/x-protobuf")
-		ctx.Header("Content-Encoding", "snappy")
-		err = remote.EncodeReadResponse(resp, ctx.Writer)
+		reader = reader.withAggregate(aggregate)
+	}
+	respType, err := remote.NegotiateResponseType(prompbReq.AcceptedResponseTypes)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if respType == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+		ctx.Header("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+		err = reader.ReadStreamed(ctx.Request.Context(), prompbReq, remote.NewChunkedWriter(ctx.Writer, ctx.Writer))
 		if err != nil {
-			ctx.String(http.StatusInternalServerError, err.Error())
-			return
+			if !ctx.Writer.Written() {
+				ctx.String(readErrorStatus(err), err.Error())
+				return
+			}
+			// 帧已写出后无法再修改状态码，追加错误信息使客户端解析失败，避免把不完整的结果当作成功
+			c.logger.Error("remote read stream err", elog.FieldErr(err))
+			_, _ = ctx.Writer.WriteString(err.Error())
 		}
-	})
+		return
+	}
+
+	var resp *prompb.ReadResponse
+	resp, err = reader.Read(ctx.Request.Context(), prompbReq)
+	if err != nil {
+		ctx.String(readErrorStatus(err), err.Error())
+		return
+	}
+	ctx.Header("Content-Type", "application/x-protobuf")
+	ctx.Header("Content-Encoding", "snappy")
+	err = remote.EncodeReadResponse(resp, ctx.Writer)
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// readErrorStatus 超出查询限制时返回422，其余错误返回500
+func readErrorStatus(err error) int {
+	if errors.Is(err, errQueryLimit) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// requestBody 返回请求body，Content-Encoding为gzip时自动解压
+func requestBody(ctx *gin.Context) (io.ReadCloser, error) {
+	if ctx.GetHeader("Content-Encoding") != "gzip" {
+		return ctx.Request.Body, nil
+	}
+	return gzip.NewReader(ctx.Request.Body)
 }
 
 // Name 配置名称
@@ -102,19 +236,68 @@ func (c *Component) PackageName() string {
 	return PackageName
 }
 
-// Init 初始化
+// Init 初始化，打开HTTP及graphite、statsd、thanos监听。
+// 监听失败时关闭已打开的监听并返回错误，ego忽略Init的返回值，所以Start会再返回该错误，serve命令以非0退出
 func (c *Component) Init() error {
+	if c.initErr = c.listen(); c.initErr != nil {
+		c.logger.Error("new prom2click server err", elog.FieldErrKind("listen err"), elog.FieldErr(c.initErr))
+		c.closeListeners()
+	}
+	return c.initErr
+}
+
+// listen 打开全部监听，端口为0时记录实际绑定的端口
+func (c *Component) listen() error {
 	var err error
-	c.listener, err = net.Listen(c.config.Network, c.config.Address())
-	if err != nil {
-		c.logger.Panic("new prom2click server err", elog.FieldErrKind("listen err"), elog.FieldErr(err))
+	if c.listener, err = net.Listen(c.config.Network, c.config.Address()); err != nil {
+		return fmt.Errorf("listen %s: %w", c.config.Address(), err)
+	}
+	if addr, ok := c.listener.Addr().(*net.TCPAddr); ok && addr.Port != c.config.Port {
+		former := c.config.Port
+		c.config.Port = addr.Port
+		// the writer and reader metrics were labeled with the configured port
+		rebindMetrics(c.config, former, c.writer, c.reader)
+	}
+	if c.graphite != nil {
+		if err = c.graphite.listen(); err != nil {
+			return fmt.Errorf("graphite listen: %w", err)
+		}
+	}
+	if c.statsd != nil {
+		if err = c.statsd.listen(); err != nil {
+			return fmt.Errorf("statsd listen: %w", err)
+		}
+	}
+	if c.thanos != nil {
+		if err = c.thanos.listen(); err != nil {
+			return fmt.Errorf("thanos store listen: %w", err)
+		}
 	}
-	c.config.Port = c.listener.Addr().(*net.TCPAddr).Port
 	return nil
 }
 
+// closeListeners 关闭listen打开的监听，用于启动前失败的情况
+func (c *Component) closeListeners() {
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if c.graphite != nil {
+		// nothing is served yet, stop only closes the listeners
+		c.graphite.stop()
+	}
+	if c.statsd != nil && c.statsd.conn != nil {
+		c.statsd.conn.Close()
+	}
+	if c.thanos != nil && c.thanos.listener != nil {
+		c.thanos.listener.Close()
+	}
+}
+
 // Start implements server.Component interface.
 func (c *Component) Start() error {
+	if c.initErr != nil {
+		return c.initErr
+	}
 	for _, route := range c.Engine.Routes() {
 		c.logger.Info("add route", elog.FieldMethod(route.Method), elog.String("path", route.Path))
 	}
@@ -131,6 +314,15 @@ func (c *Component) Start() error {
 	c.mu.Unlock()
 
 	c.writer.Start()
+	if c.graphite != nil {
+		c.graphite.start()
+	}
+	if c.statsd != nil {
+		c.statsd.start()
+	}
+	if c.thanos != nil {
+		c.thanos.start()
+	}
 
 	var err error
 	err = c.Server.Serve(c.listener)
@@ -143,35 +335,37 @@ func (c *Component) Start() error {
 // Stop implements server.Component interface
 // it will terminate gin server immediately
 func (c *Component) Stop() error {
-	close(c.writer.requests)
-	c.writer.Wait()
-
-	wchan := make(chan struct{})
-	go func() {
-		c.writer.Wait()
-		close(wchan)
-	}()
-
-	select {
-	case <-wchan:
-		c.logger.Info("Prom2Click shutdown cleanly..")
-	// All done!
-	case <-time.After(10 * time.Second):
-		c.logger.Info("Prom2Click shutdown timed out, samples will be lost..")
-	}
-
+	unwatch(c.config)
+	var err error
 	c.mu.Lock()
-	err := c.Server.Close()
+	if c.Server != nil {
+		err = c.Server.Close()
+	}
 	c.mu.Unlock()
+	c.stopListeners()
+	c.stopWriter()
 	return err
 }
 
 // GracefulStop implements server.Component interface
 // it will stop gin server gracefully
 func (c *Component) GracefulStop(ctx context.Context) error {
-	close(c.writer.requests)
-	c.writer.Wait()
+	unwatch(c.config)
+	// 先等待正在执行的请求结束，再关闭writer队列，否则写入请求会向已关闭的队列发送数据
+	var err error
+	c.mu.Lock()
+	if c.Server != nil {
+		err = c.Server.Shutdown(ctx)
+	}
+	c.mu.Unlock()
+	c.stopListeners()
+	c.stopWriter()
+	return err
+}
 
+// stopWriter 关闭writer队列，等待队列中的样本写完
+func (c *Component) stopWriter() {
+	c.writer.close()
 	wchan := make(chan struct{})
 	go func() {
 		c.writer.Wait()
@@ -185,18 +379,31 @@ func (c *Component) GracefulStop(ctx context.Context) error {
 	case <-time.After(10 * time.Second):
 		c.logger.Info("Prom2Click shutdown timed out, samples will be lost..")
 	}
+}
 
-	c.mu.Lock()
-	err := c.Server.Shutdown(ctx)
-	c.mu.Unlock()
-	return err
+// stopListeners 关闭非HTTP的写入监听，保证关闭writer队列前不再有数据写入
+func (c *Component) stopListeners() {
+	if c.graphite != nil {
+		c.graphite.stop()
+	}
+	if c.statsd != nil {
+		c.statsd.stop()
+	}
+	if c.thanos != nil {
+		c.thanos.stop()
+	}
 }
 
 // Info returns server info, used by governor and consumer balancer
 func (c *Component) Info() *server.ServiceInfo {
+	// ego asks for the info even when Init failed to listen
+	addr := c.config.Address()
+	if c.listener != nil && c.initErr == nil {
+		addr = c.listener.Addr().String()
+	}
 	info := server.ApplyOptions(
 		server.WithScheme("http"),
-		server.WithAddress(c.listener.Addr().String()),
+		server.WithAddress(addr),
 		server.WithKind(constant.ServiceProvider),
 	)
 	return &info
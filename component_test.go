@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -19,6 +20,7 @@ import (
 	"github.com/golang/snappy"
 	"github.com/gotomicro/ego/core/constant"
 	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/assert"
 )
@@ -86,6 +88,118 @@ func TestNewComponent(t *testing.T) {
 	assert.NoError(t, cmp.Stop())
 }
 
+func TestInitListenError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer busy.Close()
+
+	cfg := DefaultConfig()
+	cfg.Host = "127.0.0.1"
+	cfg.Port = 0
+	// the main port is free, the statsd one is not
+	cfg.StatsdAddress = busy.Addr().String()
+	udp, err := net.ListenPacket("udp", cfg.StatsdAddress)
+	assert.NoError(t, err)
+	defer udp.Close()
+	cmp, err := newComponentE("test-busy", cfg, elog.DefaultLogger)
+	assert.NoError(t, err)
+
+	err = cmp.Init()
+	assert.ErrorContains(t, err, "statsd listen")
+	// the info is still available to ego and Start reports the error instead of serving
+	assert.NotNil(t, cmp.Info())
+	assert.Equal(t, err, cmp.Start())
+	assert.NoError(t, cmp.Stop())
+
+	// the listener opened before the error was closed again
+	ln, err := net.Listen("tcp", cfg.Address())
+	assert.NoError(t, err)
+	ln.Close()
+
+	cfg = DefaultConfig()
+	cfg.Host = "127.0.0.1"
+	cfg.Port = busy.Addr().(*net.TCPAddr).Port
+	cmp, err = newComponentE("test-busy", cfg, elog.DefaultLogger)
+	assert.NoError(t, err)
+	assert.Error(t, cmp.Init())
+	assert.Error(t, cmp.Start())
+}
+
+func TestInitMetricsPort(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Host = "127.0.0.42"
+	cfg.Port = 0
+	cmp, err := newComponentE("test-port", cfg, elog.DefaultLogger)
+	assert.NoError(t, err)
+	assert.NoError(t, cmp.Init())
+	defer cmp.closeListeners()
+
+	// queue_capacity_samples is set by every writer, it moves from port 0 to the bound one
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	var ports []string
+	for _, family := range families {
+		if family.GetName() != "queue_capacity_samples" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["host"] == cfg.Host {
+				ports = append(ports, labels["port"])
+			}
+		}
+	}
+	assert.Equal(t, []string{strconv.Itoa(cfg.Port)}, ports)
+	assert.NotEqual(t, 0, cfg.Port)
+}
+
+func TestGracefulStopWaitsForHandlers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Host = "127.0.0.1"
+	cfg.Port = 0
+	cmp := newComponent("test-stop", cfg, elog.DefaultLogger)
+	started, release := make(chan struct{}), make(chan struct{})
+	// a write handler still running when the stop begins
+	cmp.POST("/slow", func(ctx *gin.Context) {
+		close(started)
+		<-release
+		cmp.writer.process(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+		}}})
+	})
+	assert.NoError(t, cmp.Init())
+	go func() {
+		assert.NoError(t, cmp.Start())
+	}()
+	go func() {
+		resp, err := http.Post(fmt.Sprintf("http://%s/slow", cmp.config.Address()), "text/plain", nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- cmp.GracefulStop(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatal("stopped before the handler returned")
+	default:
+	}
+	close(release)
+	assert.NoError(t, <-stopped)
+
+	// samples arriving after the stop are dropped instead of sent on the closed queue
+	cmp.writer.process(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{Samples: []prompb.Sample{{Value: 1}}}}})
+}
+
 func TestReadResponseUsesPrometheusRemoteReadHeaders(t *testing.T) {
 	reqBytes, err := proto.Marshal(&prompb.ReadRequest{})
 	assert.NoError(t, err)
@@ -1,13 +1,19 @@
 package prom2click
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/gotomicro/ego/core/eflag"
 	"github.com/gotomicro/ego/core/util/xtime"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
 )
 
 // config HTTP config
@@ -19,6 +25,8 @@ type config struct {
 	ClickhouseDSN              string
 	ClickhouseDB               string
 	ClickhouseTable            string
+	ClickhouseLabelIndexTable  string // 标签倒排索引表，写入时维护，读取时先通过它找到匹配的series，为空时不启用，表结构见labelindex.go
+	ClickhouseLabelIndexCache  int    // 写入时记住已写入标签索引的series数，超出时淘汰最久未写入的，默认1000000
 	ClickhouseBatch            int
 	ClickhouseMaxSamples       int
 	ClickhouseMinPeriod        int
@@ -26,41 +34,113 @@ type config struct {
 	ClickhouseHTTPWritePath    string
 	ClickhouseHTTPReadPath     string
 	ClickhouseChanSize         int
-	ServerReadTimeout          time.Duration // 服务端，用于读取io报文过慢的timeout，通常用于互联网网络收包过慢，如果你的go在最外层，可以使用他，默认不启用。
-	ServerReadHeaderTimeout    time.Duration // 服务端，用于读取io报文过慢的timeout，通常用于互联网网络收包过慢，如果你的go在最外层，可以使用他，默认不启用。
-	ServerWriteTimeout         time.Duration // 服务端，用于读取io报文过慢的timeout，通常用于互联网网络收包过慢，如果你的go在最外层，可以使用他，默认不启用。
-	ContextTimeout             time.Duration // 只能用于IO操作，才能触发，默认不启用
-	EnableMetricInterceptor    *bool         // 是否开启监控，默认开启
-	SlowLogThreshold           time.Duration // 服务慢日志，默认500ms
-	EnableAccessInterceptor    *bool         // 是否开启，记录请求数据
-	EnableAccessInterceptorReq *bool         // 是否开启记录请求参数，默认不开启
-	EnableAccessInterceptorRes *bool         // 是否开启记录响应参数，默认不开启
-	EnableTrustedCustomHeader  *bool         // 是否开启自定义header头，记录数据往链路后传递，默认不开启
-	TrustedPlatform            string        // 需要用户换成自己的CDN名字，获取客户端IP地址
-	mu                         sync.RWMutex  // mutex for EnableAccessInterceptorReq、EnableAccessInterceptorRes、AccessInterceptorReqResFilter、aiReqResCelPrg
+	ClickhouseFlushInterval    time.Duration             // 写入队列不足一批时最长等待多久写入clickhouse，默认1s，0表示等待攒满一批，可以热更新
+	ClickhouseRawMaxRange      time.Duration             // 带有ReadHints且时间跨度不超过该值的查询返回原始数据，默认1h，小于0时关闭
+	EnableReadPushdown         *bool                     // 是否根据ReadHints将max_over_time、sum by等聚合下推到clickhouse，默认开启
+	ClickhouseReadConcurrency  int                       // 单个remote read请求中并发执行的query数，默认4
+	ReadDownsampleAggregate    string                    // 降采样的默认聚合函数，可选avg、min、max、last、sum、any、quantile，默认quantile
+	ReadCounterAggregate       string                    // 计数器(_total、_count、_sum、_bucket结尾的指标)降采样的聚合函数，默认last，保证rate()结果正确
+	ReadDownsampleRules        []*downsampleRule         // 按指标名选择降采样聚合函数的规则，按顺序取第一个匹配的规则
+	downsampleRules            []*compiledDownsampleRule // ReadDownsampleRules编译后的规则
+	ReadMaxSeries              int                       // 单个查询最多返回的series数，默认0不限制
+	ReadMaxSamples             int                       // 单个查询最多读取的样本行数，默认0不限制
+	ReadMaxRange               time.Duration             // 单个查询的最大时间跨度，默认0不限制
+	ReadTimeout                time.Duration             // 单个查询的最长执行时间，同时设置为clickhouse的max_execution_time，默认0不限制
+	ReadCacheSize              int                       // 查询结果内存缓存大小，单位MB，默认0不启用。本进程写入早于ReadCacheRecent的样本(import、迟到的remote write等)时清空缓存，另一进程的backfill只清空ReadCacheDir，之后需重启服务
+	ReadCacheSplitInterval     time.Duration             // 查询按该间隔对齐拆分后分段缓存，默认24h
+	ReadCacheRecent            time.Duration             // 结束时间在该时长以内的分段数据可能还在写入，不缓存，默认10m
+	ReadCacheDir               string                    // 查询结果磁盘缓存目录，为空时只使用内存缓存
+	ReadCacheDiskTTL           time.Duration             // 磁盘缓存文件的保留时长，默认168h
+	InfluxHTTPWritePath        string                    // influxdb v1 line protocol写入路径，为空时不启用
+	InfluxV2HTTPWritePath      string                    // influxdb v2 line protocol写入路径，为空时不启用
+	OTLPHTTPWritePath          string                    // OTLP/HTTP metrics写入路径，为空时不启用
+	OTLPDeltaTTL               time.Duration             // OTLP delta指标累加值的保留时长，超过该时长未更新的series被清除，默认1h，0不清除
+	PromQLQueryPath            string                    // PromQL即时查询路径，默认/api/v1/query，为空时不启用
+	PromQLQueryRangePath       string                    // PromQL范围查询路径，默认/api/v1/query_range，为空时不启用
+	PromQLMaxSamples           int                       // 单个PromQL查询在内存中最多加载的样本数，默认50000000
+	PromQLTimeout              time.Duration             // PromQL查询的最长执行时间，默认2m
+	PromQLLookbackDelta        time.Duration             // PromQL查询向前查找样本的时长，默认5m，sum等聚合下推时也按此时长，远程读的prometheus需与之一致
+	LabelsPath                 string                    // 标签名查询路径，默认/api/v1/labels，为空时不启用
+	LabelValuesPath            string                    // 标签值查询路径，默认/api/v1/label/:name/values，为空时不启用
+	SeriesPath                 string                    // 序列查询路径，默认/api/v1/series，为空时不启用
+	LabelMaxResults            int                       // 标签与序列查询最多返回的结果数，超出时截断并给出warning，默认10000，0不限制
+	LabelLookback              time.Duration             // 标签与序列查询未指定start时向前查询的时长，默认24h
+	DebugQueryPath             string                    // remote read查询调试路径，返回生成的SQL、精度及EXPLAIN结果，stats参数会完整执行查询，默认为空不启用，如/debug/query
+	ImportHTTPPath             string                    // JSON line数据导入路径，为空时不启用
+	ExportHTTPPath             string                    // JSON line数据导出路径，受ReadMax*与ReadTimeout限制，默认为空不启用，如/api/v1/export
+	ThanosStoreAddress         string                    // Thanos StoreAPI grpc监听地址，为空时不启用
+	ThanosExternalLabels       map[string]string         // Thanos StoreAPI的外部标签，添加到每个series上并在Info中发布
+	ThanosRetention            time.Duration             // Info中发布的数据保留时长，min time为当前时间减去该值，默认0表示不限制
+	GraphiteAddress            string                    // graphite plaintext协议tcp/udp监听地址，为空时不启用
+	GraphitePickleAddress      string                    // graphite pickle协议tcp监听地址，为空时不启用
+	GraphiteTemplates          []string                  // graphite路径模板，格式为"[filter] template [tag=value,...]"
+	StatsdAddress              string                    // statsd udp监听地址，为空时不启用
+	StatsdFlushInterval        time.Duration             // statsd聚合数据写入间隔，默认10s
+	StatsdDeleteIdle           int                       // 连续多少个写入间隔没有更新的statsd指标从内存中清除，清除前counter与gauge每次写入最后的值，默认60，0不清除
+	ServerReadTimeout          time.Duration             // 服务端，用于读取io报文过慢的timeout，通常用于互联网网络收包过慢，如果你的go在最外层，可以使用他，默认不启用。
+	ServerReadHeaderTimeout    time.Duration             // 服务端，用于读取io报文过慢的timeout，通常用于互联网网络收包过慢，如果你的go在最外层，可以使用他，默认不启用。
+	ServerWriteTimeout         time.Duration             // 服务端，用于读取io报文过慢的timeout，通常用于互联网网络收包过慢，如果你的go在最外层，可以使用他，默认不启用。
+	ContextTimeout             time.Duration             // 只能用于IO操作，才能触发，默认不启用
+	EnableMetricInterceptor    *bool                     // 是否开启监控，默认开启
+	SlowLogThreshold           time.Duration             // 服务慢日志，默认500ms
+	EnableAccessInterceptor    *bool                     // 是否开启，记录请求数据
+	EnableAccessInterceptorReq *bool                     // 是否开启记录请求参数，默认不开启
+	EnableAccessInterceptorRes *bool                     // 是否开启记录响应参数，默认不开启
+	EnableTrustedCustomHeader  *bool                     // 是否开启自定义header头，记录数据往链路后传递，默认不开启
+	TrustedPlatform            string                    // 需要用户换成自己的CDN名字，获取客户端IP地址
+	WriteRelabelConfigs        []*relabelConfig          // 写入前对series执行的relabel规则，与prometheus的write_relabel_configs一致
+	relabelConfigs             []*relabel.Config         // WriteRelabelConfigs编译后的规则
+	mu                         sync.RWMutex              // mutex for EnableAccessInterceptorReq、EnableAccessInterceptorRes、AccessInterceptorReqResFilter、aiReqResCelPrg，以及可以热更新的配置项
 }
 
 // DefaultConfig ...
 func DefaultConfig() *config {
 	return &config{
-		Host:                    eflag.String("host"),
-		Port:                    9201,
-		Mode:                    gin.ReleaseMode,
-		Network:                 "tcp",
-		ClickhouseDSN:           "",
-		ClickhouseDB:            "metrics",
-		ClickhouseTable:         "samples",
-		ClickhouseBatch:         8192,
-		ClickhouseMaxSamples:    8192,
-		ClickhouseMinPeriod:     10,
-		ClickhouseQuantile:      0.75,
-		ClickhouseHTTPWritePath: "/write",
-		ClickhouseHTTPReadPath:  "/read",
-		ClickhouseChanSize:      8192,
-		EnableMetricInterceptor: boolPtr(true),
-		SlowLogThreshold:        xtime.Duration("500ms"),
-		EnableAccessInterceptor: boolPtr(true),
-		mu:                      sync.RWMutex{},
+		Host:                      eflag.String("host"),
+		Port:                      9201,
+		Mode:                      gin.ReleaseMode,
+		Network:                   "tcp",
+		ClickhouseDSN:             "",
+		ClickhouseDB:              "metrics",
+		ClickhouseTable:           "samples",
+		ClickhouseLabelIndexCache: 1000000,
+		ClickhouseBatch:           8192,
+		ClickhouseMaxSamples:      8192,
+		ClickhouseMinPeriod:       10,
+		ClickhouseQuantile:        0.75,
+		ClickhouseHTTPWritePath:   "/write",
+		ClickhouseHTTPReadPath:    "/read",
+		ClickhouseChanSize:        8192,
+		ClickhouseFlushInterval:   xtime.Duration("1s"),
+		ClickhouseRawMaxRange:     xtime.Duration("1h"),
+		EnableReadPushdown:        boolPtr(true),
+		ClickhouseReadConcurrency: 4,
+		ReadDownsampleAggregate:   aggregateQuantile,
+		ReadCounterAggregate:      aggregateLast,
+		ReadCacheSplitInterval:    xtime.Duration("24h"),
+		ReadCacheRecent:           xtime.Duration("10m"),
+		ReadCacheDiskTTL:          xtime.Duration("168h"),
+		InfluxHTTPWritePath:       "/influx/write",
+		InfluxV2HTTPWritePath:     "/api/v2/write",
+		OTLPHTTPWritePath:         "/v1/metrics",
+		OTLPDeltaTTL:              xtime.Duration("1h"),
+		PromQLQueryPath:           "/api/v1/query",
+		PromQLQueryRangePath:      "/api/v1/query_range",
+		PromQLMaxSamples:          50000000,
+		PromQLTimeout:             xtime.Duration("2m"),
+		PromQLLookbackDelta:       xtime.Duration("5m"),
+		LabelsPath:                "/api/v1/labels",
+		LabelValuesPath:           "/api/v1/label/:name/values",
+		SeriesPath:                "/api/v1/series",
+		LabelMaxResults:           10000,
+		LabelLookback:             xtime.Duration("24h"),
+		ImportHTTPPath:            "/api/v1/import",
+		StatsdFlushInterval:       xtime.Duration("10s"),
+		StatsdDeleteIdle:          60,
+		EnableMetricInterceptor:   boolPtr(true),
+		SlowLogThreshold:          xtime.Duration("500ms"),
+		EnableAccessInterceptor:   boolPtr(true),
+		mu:                        sync.RWMutex{},
 	}
 }
 
@@ -72,3 +152,190 @@ func (config *config) Address() string {
 func boolPtr(b bool) *bool {
 	return &b
 }
+
+// Validate 校验全部配置项，返回所有不合法配置的汇总错误
+func (config *config) Validate() error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if config.Port < 0 || config.Port > 65535 {
+		add("Port %d is out of range", config.Port)
+	}
+	switch config.Mode {
+	case gin.DebugMode, gin.ReleaseMode, gin.TestMode:
+	default:
+		add("Mode %q must be one of %s, %s, %s", config.Mode, gin.DebugMode, gin.ReleaseMode, gin.TestMode)
+	}
+	// the server listens on Host:Port, unix sockets have no such address
+	switch config.Network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		add("Network %q is not supported", config.Network)
+	}
+
+	if config.ClickhouseDSN == "" {
+		add("ClickhouseDSN is empty")
+	} else if _, err := clickhouse.ParseDSN(config.ClickhouseDSN); err != nil {
+		add("ClickhouseDSN is invalid: %w", err)
+	}
+	// database and table are put into the SQL as is
+	if !validIdentifier(config.ClickhouseDB) {
+		add("ClickhouseDB %q is not a valid identifier", config.ClickhouseDB)
+	}
+	if !validIdentifier(config.ClickhouseTable) {
+		add("ClickhouseTable %q is not a valid identifier", config.ClickhouseTable)
+	}
+	if config.ClickhouseLabelIndexTable != "" && !validIdentifier(config.ClickhouseLabelIndexTable) {
+		add("ClickhouseLabelIndexTable %q is not a valid identifier", config.ClickhouseLabelIndexTable)
+	}
+	if config.ClickhouseLabelIndexCache < 1 {
+		add("ClickhouseLabelIndexCache must be positive, got %d", config.ClickhouseLabelIndexCache)
+	}
+	if config.ClickhouseBatch < 1 {
+		add("ClickhouseBatch must be positive, got %d", config.ClickhouseBatch)
+	}
+	if config.ClickhouseMaxSamples < 1 {
+		add("ClickhouseMaxSamples must be positive, got %d", config.ClickhouseMaxSamples)
+	}
+	if config.ClickhouseReadConcurrency < 1 {
+		add("ClickhouseReadConcurrency must be positive, got %d", config.ClickhouseReadConcurrency)
+	}
+	if !validAggregate(config.ReadDownsampleAggregate) {
+		add("ReadDownsampleAggregate %q is not supported", config.ReadDownsampleAggregate)
+	}
+	if !validAggregate(config.ReadCounterAggregate) {
+		add("ReadCounterAggregate %q is not supported", config.ReadCounterAggregate)
+	}
+	if _, err := compileDownsampleRules(config.ReadDownsampleRules); err != nil {
+		add("ReadDownsampleRules is invalid: %w", err)
+	}
+	if config.PromQLMaxSamples < 0 {
+		add("PromQLMaxSamples must not be negative, got %d", config.PromQLMaxSamples)
+	}
+	if config.LabelMaxResults < 0 {
+		add("LabelMaxResults must not be negative, got %d", config.LabelMaxResults)
+	}
+	if config.ReadMaxSeries < 0 {
+		add("ReadMaxSeries must not be negative, got %d", config.ReadMaxSeries)
+	}
+	if config.ReadMaxSamples < 0 {
+		add("ReadMaxSamples must not be negative, got %d", config.ReadMaxSamples)
+	}
+	if config.ReadCacheSize < 0 {
+		add("ReadCacheSize must not be negative, got %d", config.ReadCacheSize)
+	}
+	if config.ReadCacheSize > 0 && config.ReadCacheSplitInterval < time.Second {
+		add("ReadCacheSplitInterval must be at least 1s, got %s", config.ReadCacheSplitInterval)
+	}
+	if config.ClickhouseMinPeriod < 1 {
+		add("ClickhouseMinPeriod must be positive, got %d", config.ClickhouseMinPeriod)
+	}
+	if config.ClickhouseQuantile < 0 || config.ClickhouseQuantile > 1 {
+		add("ClickhouseQuantile must be in [0, 1], got %v", config.ClickhouseQuantile)
+	}
+	if config.ClickhouseChanSize < 0 {
+		add("ClickhouseChanSize must not be negative, got %d", config.ClickhouseChanSize)
+	}
+
+	paths := make(map[string]string)
+	for _, p := range []struct{ name, path string }{
+		{"ClickhouseHTTPWritePath", config.ClickhouseHTTPWritePath},
+		{"ClickhouseHTTPReadPath", config.ClickhouseHTTPReadPath},
+		{"InfluxHTTPWritePath", config.InfluxHTTPWritePath},
+		{"InfluxV2HTTPWritePath", config.InfluxV2HTTPWritePath},
+		{"OTLPHTTPWritePath", config.OTLPHTTPWritePath},
+		{"PromQLQueryPath", config.PromQLQueryPath},
+		{"PromQLQueryRangePath", config.PromQLQueryRangePath},
+		{"LabelsPath", config.LabelsPath},
+		{"LabelValuesPath", config.LabelValuesPath},
+		{"SeriesPath", config.SeriesPath},
+		{"DebugQueryPath", config.DebugQueryPath},
+		{"ImportHTTPPath", config.ImportHTTPPath},
+		{"ExportHTTPPath", config.ExportHTTPPath},
+	} {
+		if p.path == "" {
+			continue
+		}
+		if !strings.HasPrefix(p.path, "/") {
+			add("%s %q must start with /", p.name, p.path)
+		}
+		if other, ok := paths[p.path]; ok {
+			add("%s %q is already used by %s", p.name, p.path, other)
+		}
+		paths[p.path] = p.name
+	}
+
+	for _, a := range []struct{ name, addr string }{
+		{"GraphiteAddress", config.GraphiteAddress},
+		{"GraphitePickleAddress", config.GraphitePickleAddress},
+		{"StatsdAddress", config.StatsdAddress},
+		{"ThanosStoreAddress", config.ThanosStoreAddress},
+	} {
+		if a.addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			add("%s is invalid: %w", a.name, err)
+		}
+	}
+	for name, value := range config.ThanosExternalLabels {
+		if !model.LabelName(name).IsValid() || value == "" {
+			add("ThanosExternalLabels %s=%q is not a valid label", name, value)
+		}
+	}
+	if _, err := compileRelabelConfigs(config.WriteRelabelConfigs); err != nil {
+		add("WriteRelabelConfigs is invalid: %w", err)
+	}
+	for _, t := range config.GraphiteTemplates {
+		if _, err := parseGraphiteTemplate(t); err != nil {
+			add("GraphiteTemplates %q is invalid: %w", t, err)
+		}
+	}
+	if config.StatsdAddress != "" && config.StatsdFlushInterval <= 0 {
+		add("StatsdFlushInterval must be positive, got %s", config.StatsdFlushInterval)
+	}
+	if config.StatsdDeleteIdle < 0 {
+		add("StatsdDeleteIdle must not be negative, got %d", config.StatsdDeleteIdle)
+	}
+
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"ServerReadTimeout", config.ServerReadTimeout},
+		{"ServerReadHeaderTimeout", config.ServerReadHeaderTimeout},
+		{"ServerWriteTimeout", config.ServerWriteTimeout},
+		{"ContextTimeout", config.ContextTimeout},
+		{"SlowLogThreshold", config.SlowLogThreshold},
+		{"ClickhouseFlushInterval", config.ClickhouseFlushInterval},
+		{"PromQLTimeout", config.PromQLTimeout},
+		{"PromQLLookbackDelta", config.PromQLLookbackDelta},
+		{"LabelLookback", config.LabelLookback},
+		{"ThanosRetention", config.ThanosRetention},
+		{"OTLPDeltaTTL", config.OTLPDeltaTTL},
+		{"ReadMaxRange", config.ReadMaxRange},
+		{"ReadTimeout", config.ReadTimeout},
+		{"ReadCacheRecent", config.ReadCacheRecent},
+		{"ReadCacheDiskTTL", config.ReadCacheDiskTTL},
+	} {
+		if d.d < 0 {
+			add("%s must not be negative, got %s", d.name, d.d)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validIdentifier reports whether s can be used as an unquoted clickhouse identifier
+func validIdentifier(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for _, ch := range s {
+		if ch != '_' && (ch < 'a' || ch > 'z') && (ch < 'A' || ch > 'Z') && (ch < '0' || ch > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package prom2click
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ClickhouseDSN = "clickhouse://127.0.0.1:9000/metrics"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Mode = "prod"
+	cfg.Network = "unix"
+	cfg.ClickhouseDSN = ""
+	cfg.ClickhouseTable = "samples; DROP TABLE x"
+	cfg.ClickhouseMaxSamples = 0
+	cfg.ClickhouseQuantile = 1.5
+	cfg.ExportHTTPPath = cfg.ImportHTTPPath
+	cfg.InfluxHTTPWritePath = "influx"
+	cfg.StatsdAddress = "8125"
+	cfg.GraphiteTemplates = []string{"a b c d"}
+	cfg.ContextTimeout = -1
+	err := cfg.Validate()
+	assert.Error(t, err)
+	for _, msg := range []string{
+		`Mode "prod"`,
+		`Network "unix" is not supported`,
+		"ClickhouseDSN is empty",
+		`ClickhouseTable "samples; DROP TABLE x" is not a valid identifier`,
+		"ClickhouseMaxSamples must be positive, got 0",
+		"ClickhouseQuantile must be in [0, 1], got 1.5",
+		`ExportHTTPPath "/api/v1/import" is already used by ImportHTTPPath`,
+		`InfluxHTTPWritePath "influx" must start with /`,
+		"StatsdAddress is invalid",
+		`GraphiteTemplates "a b c d" is invalid`,
+		"ContextTimeout must not be negative",
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
+
+func TestBuildE(t *testing.T) {
+	_, err := DefaultContainer().BuildE()
+	assert.EqualError(t, err, "ClickhouseDSN is empty")
+
+	c := DefaultContainer()
+	c.config.ClickhouseDSN = "clickhouse://127.0.0.1:9000"
+	c.config.Port = 0
+	comp, err := c.BuildE()
+	assert.NoError(t, err)
+	assert.NotNil(t, comp)
+}
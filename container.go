@@ -12,6 +12,8 @@ type Container struct {
 	config *config
 	name   string
 	logger *elog.Component
+	key    string // 配置key，用于热更新
+	index  int    // LoadBatch加载时配置在数组中的下标，Load加载时为-1
 }
 
 // DefaultContainer 默认容器
@@ -19,6 +21,7 @@ func DefaultContainer() *Container {
 	return &Container{
 		config: DefaultConfig(),
 		logger: elog.EgoLogger.With(elog.FieldComponent(PackageName)),
+		index:  -1,
 	}
 }
 
@@ -31,6 +34,8 @@ func Load(key string) *Container {
 		return c
 	}
 	c.name = key
+	c.key = key
+	c.watch()
 	return c
 }
 
@@ -44,89 +49,255 @@ func LoadBatch(key string) []*Container {
 	for index := range configs {
 		c := DefaultContainer()
 		c.logger = c.logger.With(elog.FieldComponentName(key))
-		cfg := configs[index]
-		if cfg.Host != "" {
-			c.config.Host = cfg.Host
-		}
-		if cfg.Port != 0 {
-			c.config.Port = cfg.Port
-		}
-		if cfg.ClickhouseDSN != "" {
-			c.config.ClickhouseDSN = cfg.ClickhouseDSN
-		}
-		if cfg.ClickhouseDB != "" {
-			c.config.ClickhouseDB = cfg.ClickhouseDB
-		}
-		if cfg.ClickhouseTable != "" {
-			c.config.ClickhouseTable = cfg.ClickhouseTable
-		}
-		if cfg.ClickhouseBatch != 0 {
-			c.config.ClickhouseBatch = cfg.ClickhouseBatch
-		}
-		if cfg.ClickhouseMaxSamples != 0 {
-			c.config.ClickhouseMaxSamples = cfg.ClickhouseMaxSamples
-		}
-		if cfg.ClickhouseMinPeriod != 0 {
-			c.config.ClickhouseMinPeriod = cfg.ClickhouseMinPeriod
-		}
-		if cfg.ClickhouseQuantile != 0 {
-			c.config.ClickhouseQuantile = cfg.ClickhouseQuantile
-		}
-		if cfg.ClickhouseHTTPWritePath != "" {
-			c.config.ClickhouseHTTPWritePath = cfg.ClickhouseHTTPWritePath
-		}
-		if cfg.ClickhouseHTTPReadPath != "" {
-			c.config.ClickhouseHTTPReadPath = cfg.ClickhouseHTTPReadPath
-		}
-		if cfg.ClickhouseChanSize != 0 {
-			c.config.ClickhouseChanSize = cfg.ClickhouseChanSize
-		}
-		if cfg.ServerReadTimeout != 0 {
-			c.config.ServerReadTimeout = cfg.ServerReadTimeout
-		}
-		if cfg.ServerReadHeaderTimeout != 0 {
-			c.config.ServerReadHeaderTimeout = cfg.ServerReadHeaderTimeout
-		}
-		if cfg.ServerWriteTimeout != 0 {
-			c.config.ServerWriteTimeout = cfg.ServerWriteTimeout
-		}
-		if cfg.ContextTimeout != 0 {
-			c.config.ContextTimeout = cfg.ContextTimeout
-		}
-		if cfg.EnableMetricInterceptor != nil {
-			c.config.EnableMetricInterceptor = cfg.EnableMetricInterceptor
-		}
-		if cfg.SlowLogThreshold != 0 {
-			c.config.SlowLogThreshold = cfg.SlowLogThreshold
-		}
-		if cfg.EnableAccessInterceptor != nil {
-			c.config.EnableAccessInterceptor = cfg.EnableAccessInterceptor
-		}
-		if cfg.EnableAccessInterceptorReq != nil {
-			c.config.EnableAccessInterceptorReq = cfg.EnableAccessInterceptorReq
-		}
-		if cfg.EnableAccessInterceptorRes != nil {
-			c.config.EnableAccessInterceptorRes = cfg.EnableAccessInterceptorRes
-		}
-		if cfg.EnableTrustedCustomHeader != nil {
-			c.config.EnableTrustedCustomHeader = cfg.EnableTrustedCustomHeader
-		}
-		if cfg.TrustedPlatform != "" {
-			c.config.TrustedPlatform = cfg.TrustedPlatform
-		}
-
+		mergeConfig(c.config, configs[index])
 		c.name = fmt.Sprintf("%s_%d", key, index)
+		c.key, c.index = key, index
+		c.watch()
 		containers = append(containers, c)
 	}
 	return containers
 }
 
+// mergeConfig 将src中设置了的配置项覆盖到dst
+func mergeConfig(dst, src *config) {
+	if src.Host != "" {
+		dst.Host = src.Host
+	}
+	if src.Port != 0 {
+		dst.Port = src.Port
+	}
+	if src.ClickhouseDSN != "" {
+		dst.ClickhouseDSN = src.ClickhouseDSN
+	}
+	if src.ClickhouseDB != "" {
+		dst.ClickhouseDB = src.ClickhouseDB
+	}
+	if src.ClickhouseTable != "" {
+		dst.ClickhouseTable = src.ClickhouseTable
+	}
+	if src.ClickhouseLabelIndexTable != "" {
+		dst.ClickhouseLabelIndexTable = src.ClickhouseLabelIndexTable
+	}
+	if src.ClickhouseLabelIndexCache != 0 {
+		dst.ClickhouseLabelIndexCache = src.ClickhouseLabelIndexCache
+	}
+	if src.ClickhouseBatch != 0 {
+		dst.ClickhouseBatch = src.ClickhouseBatch
+	}
+	if src.ClickhouseMaxSamples != 0 {
+		dst.ClickhouseMaxSamples = src.ClickhouseMaxSamples
+	}
+	if src.ClickhouseMinPeriod != 0 {
+		dst.ClickhouseMinPeriod = src.ClickhouseMinPeriod
+	}
+	if src.ClickhouseQuantile != 0 {
+		dst.ClickhouseQuantile = src.ClickhouseQuantile
+	}
+	if src.ClickhouseHTTPWritePath != "" {
+		dst.ClickhouseHTTPWritePath = src.ClickhouseHTTPWritePath
+	}
+	if src.ClickhouseHTTPReadPath != "" {
+		dst.ClickhouseHTTPReadPath = src.ClickhouseHTTPReadPath
+	}
+	if src.ClickhouseChanSize != 0 {
+		dst.ClickhouseChanSize = src.ClickhouseChanSize
+	}
+	if src.ClickhouseFlushInterval != 0 {
+		dst.ClickhouseFlushInterval = src.ClickhouseFlushInterval
+	}
+	if src.ClickhouseRawMaxRange != 0 {
+		dst.ClickhouseRawMaxRange = src.ClickhouseRawMaxRange
+	}
+	if src.EnableReadPushdown != nil {
+		dst.EnableReadPushdown = src.EnableReadPushdown
+	}
+	if src.ClickhouseReadConcurrency != 0 {
+		dst.ClickhouseReadConcurrency = src.ClickhouseReadConcurrency
+	}
+	if src.ReadDownsampleAggregate != "" {
+		dst.ReadDownsampleAggregate = src.ReadDownsampleAggregate
+	}
+	if src.ReadCounterAggregate != "" {
+		dst.ReadCounterAggregate = src.ReadCounterAggregate
+	}
+	if len(src.ReadDownsampleRules) > 0 {
+		dst.ReadDownsampleRules = src.ReadDownsampleRules
+	}
+	if src.ReadMaxSeries != 0 {
+		dst.ReadMaxSeries = src.ReadMaxSeries
+	}
+	if src.ReadMaxSamples != 0 {
+		dst.ReadMaxSamples = src.ReadMaxSamples
+	}
+	if src.ReadMaxRange != 0 {
+		dst.ReadMaxRange = src.ReadMaxRange
+	}
+	if src.ReadTimeout != 0 {
+		dst.ReadTimeout = src.ReadTimeout
+	}
+	if src.ReadCacheSize != 0 {
+		dst.ReadCacheSize = src.ReadCacheSize
+	}
+	if src.ReadCacheSplitInterval != 0 {
+		dst.ReadCacheSplitInterval = src.ReadCacheSplitInterval
+	}
+	if src.ReadCacheRecent != 0 {
+		dst.ReadCacheRecent = src.ReadCacheRecent
+	}
+	if src.ReadCacheDir != "" {
+		dst.ReadCacheDir = src.ReadCacheDir
+	}
+	if src.ReadCacheDiskTTL != 0 {
+		dst.ReadCacheDiskTTL = src.ReadCacheDiskTTL
+	}
+	if src.InfluxHTTPWritePath != "" {
+		dst.InfluxHTTPWritePath = src.InfluxHTTPWritePath
+	}
+	if src.InfluxV2HTTPWritePath != "" {
+		dst.InfluxV2HTTPWritePath = src.InfluxV2HTTPWritePath
+	}
+	if src.OTLPHTTPWritePath != "" {
+		dst.OTLPHTTPWritePath = src.OTLPHTTPWritePath
+	}
+	if src.OTLPDeltaTTL != 0 {
+		dst.OTLPDeltaTTL = src.OTLPDeltaTTL
+	}
+	if src.PromQLQueryPath != "" {
+		dst.PromQLQueryPath = src.PromQLQueryPath
+	}
+	if src.PromQLQueryRangePath != "" {
+		dst.PromQLQueryRangePath = src.PromQLQueryRangePath
+	}
+	if src.PromQLMaxSamples != 0 {
+		dst.PromQLMaxSamples = src.PromQLMaxSamples
+	}
+	if src.PromQLTimeout != 0 {
+		dst.PromQLTimeout = src.PromQLTimeout
+	}
+	if src.PromQLLookbackDelta != 0 {
+		dst.PromQLLookbackDelta = src.PromQLLookbackDelta
+	}
+	if src.LabelsPath != "" {
+		dst.LabelsPath = src.LabelsPath
+	}
+	if src.LabelValuesPath != "" {
+		dst.LabelValuesPath = src.LabelValuesPath
+	}
+	if src.SeriesPath != "" {
+		dst.SeriesPath = src.SeriesPath
+	}
+	if src.LabelMaxResults != 0 {
+		dst.LabelMaxResults = src.LabelMaxResults
+	}
+	if src.LabelLookback != 0 {
+		dst.LabelLookback = src.LabelLookback
+	}
+	if src.DebugQueryPath != "" {
+		dst.DebugQueryPath = src.DebugQueryPath
+	}
+	if src.ImportHTTPPath != "" {
+		dst.ImportHTTPPath = src.ImportHTTPPath
+	}
+	if src.ExportHTTPPath != "" {
+		dst.ExportHTTPPath = src.ExportHTTPPath
+	}
+	if src.ThanosStoreAddress != "" {
+		dst.ThanosStoreAddress = src.ThanosStoreAddress
+	}
+	if len(src.ThanosExternalLabels) != 0 {
+		dst.ThanosExternalLabels = src.ThanosExternalLabels
+	}
+	if src.ThanosRetention != 0 {
+		dst.ThanosRetention = src.ThanosRetention
+	}
+	if src.GraphiteAddress != "" {
+		dst.GraphiteAddress = src.GraphiteAddress
+	}
+	if src.GraphitePickleAddress != "" {
+		dst.GraphitePickleAddress = src.GraphitePickleAddress
+	}
+	if len(src.GraphiteTemplates) != 0 {
+		dst.GraphiteTemplates = src.GraphiteTemplates
+	}
+	if src.StatsdAddress != "" {
+		dst.StatsdAddress = src.StatsdAddress
+	}
+	if src.StatsdFlushInterval != 0 {
+		dst.StatsdFlushInterval = src.StatsdFlushInterval
+	}
+	if src.StatsdDeleteIdle != 0 {
+		dst.StatsdDeleteIdle = src.StatsdDeleteIdle
+	}
+	if src.ServerReadTimeout != 0 {
+		dst.ServerReadTimeout = src.ServerReadTimeout
+	}
+	if src.ServerReadHeaderTimeout != 0 {
+		dst.ServerReadHeaderTimeout = src.ServerReadHeaderTimeout
+	}
+	if src.ServerWriteTimeout != 0 {
+		dst.ServerWriteTimeout = src.ServerWriteTimeout
+	}
+	if src.ContextTimeout != 0 {
+		dst.ContextTimeout = src.ContextTimeout
+	}
+	if src.EnableMetricInterceptor != nil {
+		dst.EnableMetricInterceptor = src.EnableMetricInterceptor
+	}
+	if src.SlowLogThreshold != 0 {
+		dst.SlowLogThreshold = src.SlowLogThreshold
+	}
+	if src.EnableAccessInterceptor != nil {
+		dst.EnableAccessInterceptor = src.EnableAccessInterceptor
+	}
+	if src.EnableAccessInterceptorReq != nil {
+		dst.EnableAccessInterceptorReq = src.EnableAccessInterceptorReq
+	}
+	if src.EnableAccessInterceptorRes != nil {
+		dst.EnableAccessInterceptorRes = src.EnableAccessInterceptorRes
+	}
+	if src.EnableTrustedCustomHeader != nil {
+		dst.EnableTrustedCustomHeader = src.EnableTrustedCustomHeader
+	}
+	if src.TrustedPlatform != "" {
+		dst.TrustedPlatform = src.TrustedPlatform
+	}
+	if len(src.WriteRelabelConfigs) != 0 {
+		dst.WriteRelabelConfigs = src.WriteRelabelConfigs
+	}
+}
+
 // Build 构建组件
 func (c *Container) Build(options ...Option) *Component {
 	for _, option := range options {
 		option(c)
 	}
 	server := newComponent(c.name, c.config, c.logger)
+	c.use(server)
+	return server
+}
+
+// BuildE 校验配置并构建组件，出错时返回错误而不是panic
+func (c *Container) BuildE(options ...Option) (*Component, error) {
+	for _, option := range options {
+		option(c)
+	}
+	if err := c.config.Validate(); err != nil {
+		return nil, err
+	}
+	server, err := newComponentE(c.name, c.config, c.logger)
+	if err != nil {
+		return nil, err
+	}
+	c.use(server)
+	return server, nil
+}
+
+// Validate 校验配置
+func (c *Container) Validate() error {
+	return c.config.Validate()
+}
+
+func (c *Container) use(server *Component) {
 	server.Use(c.defaultServerInterceptor())
 	if c.config.ContextTimeout > 0 {
 		server.Use(timeoutMiddleware(c.config.ContextTimeout))
@@ -134,5 +305,4 @@ func (c *Container) Build(options ...Option) *Component {
 	if c.config.EnableMetricInterceptor != nil && *c.config.EnableMetricInterceptor {
 		server.Use(metricServerInterceptor())
 	}
-	return server
 }
@@ -0,0 +1,290 @@
+package prom2click
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotomicro/cetus/l"
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// ways a remote read query is answered
+const (
+	planRaw         = "raw"
+	planDownsampled = "downsampled"
+	planPushdown    = "pushdown"
+)
+
+// explainStatements are the EXPLAIN kinds of the explain parameter
+var explainStatements = map[string]string{
+	"plan":     "EXPLAIN PLAN",
+	"indexes":  "EXPLAIN PLAN indexes = 1",
+	"actions":  "EXPLAIN PLAN actions = 1",
+	"pipeline": "EXPLAIN PIPELINE",
+	"syntax":   "EXPLAIN SYNTAX",
+	"estimate": "EXPLAIN ESTIMATE",
+}
+
+// queryPlan is how the reader answers one query
+type queryPlan struct {
+	// SQL is empty when the query is read in Splits
+	SQL        string `json:"sql,omitempty"`
+	Table      string `json:"table"`
+	IndexTable string `json:"indexTable,omitempty"`
+	Start      int64  `json:"start"`
+	End        int64  `json:"end"`
+	Mode       string `json:"mode"`
+	Resolution int64  `json:"resolution"`
+	Aggregate  string `json:"aggregate,omitempty"`
+	// Splits are the intervals of ReadCacheSplitInterval the query is read in when the cache is enabled
+	Splits []*planSplit `json:"splits,omitempty"`
+}
+
+// planSplit is one interval of a query read through the cache
+type planSplit struct {
+	Start     int64    `json:"start"`
+	End       int64    `json:"end"`
+	Cacheable bool     `json:"cacheable"`
+	SQL       string   `json:"sql"`
+	Explain   []string `json:"explain,omitempty"`
+}
+
+// queries returns the SQL of every query run for the plan
+func (p *queryPlan) queries() []string {
+	if len(p.Splits) == 0 {
+		return []string{p.SQL}
+	}
+	queries := make([]string, 0, len(p.Splits))
+	for _, split := range p.Splits {
+		queries = append(queries, split.SQL)
+	}
+	return queries
+}
+
+// queryStats are measured by running the queries of a plan without returning their samples or using the cache
+type queryStats struct {
+	Series   int     `json:"series"`
+	Samples  int     `json:"samples"`
+	Duration float64 `json:"durationSeconds"`
+}
+
+type debugQuery struct {
+	Plan    *queryPlan  `json:"plan,omitempty"`
+	Explain []string    `json:"explain,omitempty"`
+	Stats   *queryStats `json:"stats,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// planQuery returns the SQL of query and the table, resolution and aggregate it is read with
+func (r *promReader) planQuery(query *prompb.Query) (*queryPlan, error) {
+	if err := validateMatchers(query.Matchers); err != nil {
+		return nil, err
+	}
+	tstart, tend, taggr, err := r.getTimePeriod(query)
+	if err != nil {
+		return nil, err
+	}
+	plan := &queryPlan{
+		Table: r.conf.ClickhouseDB + "." + r.conf.ClickhouseTable,
+		Start: tstart,
+		End:   tend,
+	}
+	bucket := r.queryBucket(query, tstart, tend, taggr)
+	// the same splits as readCached
+	interval := int64(r.conf.ReadCacheSplitInterval / time.Second)
+	if aligned, ok := r.cacheBucket(query, tstart, tend, taggr, interval); r.cache != nil && ok {
+		bucket = aligned
+		recent := time.Now().Add(-r.conf.ReadCacheRecent).Unix()
+		for _, split := range splitRange(tstart, tend, interval, recent) {
+			plan.Splits = append(plan.Splits, &planSplit{
+				Start:     split.start,
+				End:       split.end,
+				Cacheable: split.cacheable,
+				SQL:       r.rangeSQL(query, split.start, split.end, bucket),
+			})
+		}
+	} else {
+		plan.SQL = r.rangeSQL(query, tstart, tend, bucket)
+	}
+	plan.Resolution = bucket
+	if _, ok := r.labelIndexCond(query.Matchers, tstart, tend); ok {
+		plan.IndexTable = r.conf.ClickhouseDB + "." + r.conf.ClickhouseLabelIndexTable
+	}
+	switch _, pushdown := r.getPushdownSQL(query, tstart, tend); {
+	case pushdown:
+		plan.Mode, plan.Aggregate = planPushdown, query.Hints.Func
+	case bucket == 0:
+		plan.Mode = planRaw
+	default:
+		plan.Mode, plan.Aggregate = planDownsampled, string(r.downsampleExpr(query))
+	}
+	return plan, nil
+}
+
+// explain runs EXPLAIN of the given kind on sqlStr, every row is returned with its columns joined by tabs
+func (r *promReader) explain(ctx context.Context, kind, sqlStr string) ([]string, error) {
+	ctx, cancel := r.readContext(ctx)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, explainStatements[kind]+" "+sqlStr)
+	if err != nil {
+		return nil, r.timeoutError(ctx, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var lines []string
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		fields := make([]string, 0, len(values))
+		for _, v := range values {
+			fields = append(fields, fmt.Sprint(v))
+		}
+		lines = append(lines, strings.Join(fields, "\t"))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, r.timeoutError(ctx, err)
+	}
+	return lines, nil
+}
+
+// queryStats runs the queries of plan with the usual limits and counts what they return,
+// a series read in several splits is counted once
+func (r *promReader) queryStats(ctx context.Context, plan *queryPlan) (*queryStats, error) {
+	ctx, cancel := r.readContext(ctx)
+	defer cancel()
+	var stats queryStats
+	series := make(map[string]struct{})
+	tstart := time.Now()
+	for _, sqlStr := range plan.queries() {
+		_, err := r.querySQL(ctx, sqlStr, func(tags []string, samples []prompb.Sample) error {
+			series[strings.Join(tags, "\xff")] = struct{}{}
+			stats.Samples += len(samples)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	stats.Series = len(series)
+	stats.Duration = time.Since(tstart).Seconds()
+	return &stats, nil
+}
+
+// handleDebugQuery 返回remote read查询生成的SQL、使用的表和精度，开启缓存时返回每个分段的SQL，
+// 可选返回clickhouse的EXPLAIN结果(explain参数)和执行统计(stats参数)，不返回样本数据。请求为remote read的protobuf，或match[]、start、end、step、range、func参数
+func (c *Component) handleDebugQuery(ctx *gin.Context) {
+	queries, err := parseDebugQueries(ctx)
+	if err != nil {
+		apiError(ctx, errorBadData, err)
+		return
+	}
+	reader := c.reader
+	if aggregate := ctx.Query("aggregate"); aggregate != "" {
+		if !validAggregate(aggregate) {
+			apiError(ctx, errorBadData, fmt.Errorf("unknown aggregate %q", aggregate))
+			return
+		}
+		reader = reader.withAggregate(aggregate)
+	}
+	kind := ctx.Query("explain")
+	if _, ok := explainStatements[kind]; kind != "" && !ok {
+		apiError(ctx, errorBadData, fmt.Errorf("unknown explain %q", kind))
+		return
+	}
+	withStats, _ := strconv.ParseBool(ctx.Query("stats"))
+
+	results := make([]debugQuery, 0, len(queries))
+	for _, q := range queries {
+		var res debugQuery
+		res.Plan, err = reader.planQuery(q)
+		if err == nil && kind != "" {
+			if len(res.Plan.Splits) == 0 {
+				res.Explain, err = reader.explain(ctx.Request.Context(), kind, res.Plan.SQL)
+			}
+			for _, split := range res.Plan.Splits {
+				if split.Explain, err = reader.explain(ctx.Request.Context(), kind, split.SQL); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil && withStats {
+			res.Stats, err = reader.queryStats(ctx.Request.Context(), res.Plan)
+		}
+		if err != nil {
+			elog.Warn("debug query", l.E(err))
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	ctx.JSON(http.StatusOK, apiResponse{Status: "success", Data: results})
+}
+
+// parseDebugQueries reads the queries of a remote read request body or of the selector parameters
+func parseDebugQueries(ctx *gin.Context) ([]*prompb.Query, error) {
+	if ctx.Request.Method == http.MethodPost && strings.Contains(ctx.ContentType(), "protobuf") {
+		req, err := remote.DecodeReadRequest(ctx.Request)
+		if err != nil {
+			return nil, err
+		}
+		return req.Queries, nil
+	}
+	if err := ctx.Request.ParseForm(); err != nil {
+		return nil, err
+	}
+	selectors, err := parseSelectors(ctx.Request.Form["match[]"])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTime(ctx.Request.FormValue("end"), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter \"end\": %w", err)
+	}
+	start, err := parseTime(ctx.Request.FormValue("start"), end.Add(-time.Hour))
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter \"start\": %w", err)
+	}
+	var hints *prompb.ReadHints
+	step, rng, fn := ctx.Request.FormValue("step"), ctx.Request.FormValue("range"), ctx.Request.FormValue("func")
+	if step != "" || rng != "" || fn != "" {
+		hints = &prompb.ReadHints{StartMs: start.UnixMilli(), EndMs: end.UnixMilli(), Func: fn}
+		for _, p := range []struct {
+			name, value string
+			ms          *int64
+		}{{"step", step, &hints.StepMs}, {"range", rng, &hints.RangeMs}} {
+			if p.value == "" {
+				continue
+			}
+			d, err := parseDuration(p.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parameter %q: %w", p.name, err)
+			}
+			*p.ms = d.Milliseconds()
+		}
+	}
+	queries := make([]*prompb.Query, 0, len(selectors))
+	for _, matchers := range selectors {
+		queries = append(queries, &prompb.Query{
+			StartTimestampMs: start.UnixMilli(),
+			EndTimestampMs:   end.UnixMilli(),
+			Matchers:         matchers,
+			Hints:            hints,
+		})
+	}
+	return queries, nil
+}
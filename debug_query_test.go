@@ -0,0 +1,160 @@
+package prom2click
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDebugComponent(t *testing.T, queries *[]string, options ...func(*config)) *Component {
+	conf := DefaultConfig()
+	conf.DebugQueryPath = "/debug/query"
+	for _, option := range options {
+		option(conf)
+	}
+	db := openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		*queries = append(*queries, query)
+		if strings.HasPrefix(query, "EXPLAIN") {
+			return [][]driver.Value{{"Expression (Projection)"}, {"  ReadFromMergeTree (metrics.samples)"}}, nil
+		}
+		return [][]driver.Value{
+			{int64(1), int64(1000), "up", []string{"__name__=up", "job=a"}, 1.0},
+			{int64(1), int64(2000), "up", []string{"__name__=up", "job=a"}, 1.0},
+			{int64(1), int64(1000), "up", []string{"__name__=up", "job=b"}, 0.0},
+		}, nil
+	})
+	r := &promReader{conf: conf, db: db, metrics: newReaderMetrics(conf)}
+	var err error
+	r.cache, err = newReadCache(conf)
+	assert.NoError(t, err)
+	cmp := &Component{Engine: gin.New(), config: conf, reader: r}
+	cmp.route()
+	return cmp
+}
+
+func serveDebugQuery(cmp *Component, req *http.Request) (int, []debugQuery) {
+	w := httptest.NewRecorder()
+	cmp.ServeHTTP(w, req)
+	var resp struct {
+		Data []debugQuery `json:"data"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp.Data
+}
+
+func TestDebugQuery(t *testing.T) {
+	var queries []string
+	cmp := newDebugComponent(t, &queries)
+	get := func(params url.Values) (int, []debugQuery) {
+		return serveDebugQuery(cmp, httptest.NewRequest(http.MethodGet, "/debug/query?"+params.Encode(), nil))
+	}
+
+	code, res := get(url.Values{"match[]": {"up", `{__name__="down"}`}, "start": {"0"}, "end": {"3600"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, res, 2)
+	assert.Equal(t, planDownsampled, res[0].Plan.Mode)
+	assert.Equal(t, "metrics.samples", res[0].Plan.Table)
+	assert.Equal(t, int64(3600), res[0].Plan.End)
+	assert.Contains(t, res[1].Plan.SQL, "'down'")
+	// nothing is run without explain or stats
+	assert.Empty(t, queries)
+
+	code, res = get(url.Values{"match[]": {"up"}, "start": {"0"}, "end": {"3600"}, "explain": {"indexes"}, "stats": {"1"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"Expression (Projection)", "  ReadFromMergeTree (metrics.samples)"}, res[0].Explain)
+	assert.True(t, strings.HasPrefix(queries[0], "EXPLAIN PLAN indexes = 1 SELECT "))
+	assert.Equal(t, 2, res[0].Stats.Series)
+	assert.Equal(t, 3, res[0].Stats.Samples)
+
+	code, res = get(url.Values{"match[]": {"up"}, "start": {"0"}, "end": {"3600"}, "step": {"5"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, planRaw, res[0].Plan.Mode)
+	assert.Equal(t, int64(0), res[0].Plan.Resolution)
+
+	code, res = get(url.Values{"match[]": {"up"}, "start": {"0"}, "end": {"864000"}, "step": {"1h"}, "aggregate": {"max"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, planDownsampled, res[0].Plan.Mode)
+	assert.Equal(t, "max(val)", res[0].Plan.Aggregate)
+	assert.Greater(t, res[0].Plan.Resolution, int64(0))
+
+	code, res = get(url.Values{"match[]": {"up"}, "start": {"0"}, "end": {"3600"}, "step": {"60"}, "range": {"5m"}, "func": {"max_over_time"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, planPushdown, res[0].Plan.Mode)
+	assert.Equal(t, "max_over_time", res[0].Plan.Aggregate)
+
+	code, _ = get(url.Values{"match[]": {"up"}, "explain": {"all"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get(url.Values{"match[]": {"up{"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestDebugQueryReadRequest(t *testing.T) {
+	var queries []string
+	cmp := newDebugComponent(t, &queries)
+	pb, err := (&prompb.ReadRequest{Queries: []*prompb.Query{
+		{StartTimestampMs: 0, EndTimestampMs: 3600000, Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}},
+		{StartTimestampMs: 0, EndTimestampMs: 3600000, Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "job", Value: "("}}},
+	}}).Marshal()
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/debug/query", bytes.NewReader(snappy.Encode(nil, pb)))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+
+	code, res := serveDebugQuery(cmp, req)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, res, 2)
+	assert.Equal(t, planDownsampled, res[0].Plan.Mode)
+	// an invalid query is reported on its own
+	assert.Nil(t, res[1].Plan)
+	assert.NotEmpty(t, res[1].Error)
+	assert.Empty(t, queries)
+}
+
+func TestDebugQuerySplits(t *testing.T) {
+	var queries []string
+	cmp := newDebugComponent(t, &queries, func(conf *config) {
+		conf.ReadCacheSize = 1
+		conf.ReadCacheSplitInterval = time.Hour
+	})
+	get := func(params url.Values) (int, []debugQuery) {
+		return serveDebugQuery(cmp, httptest.NewRequest(http.MethodGet, "/debug/query?"+params.Encode(), nil))
+	}
+
+	code, res := get(url.Values{"match[]": {"up"}, "start": {"1800"}, "end": {"7200"}, "step": {"5"}, "explain": {"plan"}, "stats": {"1"}})
+	assert.Equal(t, http.StatusOK, code)
+	plan := res[0].Plan
+	assert.Empty(t, plan.SQL)
+	assert.Len(t, plan.Splits, 3)
+	assert.Equal(t, int64(1800), plan.Splits[0].Start)
+	assert.Equal(t, int64(3599), plan.Splits[0].End)
+	assert.False(t, plan.Splits[0].Cacheable)
+	assert.True(t, plan.Splits[1].Cacheable)
+	assert.Contains(t, plan.Splits[1].SQL, "(ts >= toDateTime(3600)) AND (ts <= toDateTime(7199))")
+	assert.NotEmpty(t, plan.Splits[2].Explain)
+	assert.Empty(t, res[0].Explain)
+	// 3 explains and 3 reads, the same series of every split counted once
+	assert.Len(t, queries, 6)
+	assert.Equal(t, 2, res[0].Stats.Series)
+	assert.Equal(t, 9, res[0].Stats.Samples)
+}
+
+func TestDebugQueryDisabled(t *testing.T) {
+	var queries []string
+	cmp := newDebugComponent(t, &queries, func(conf *config) {
+		conf.DebugQueryPath = DefaultConfig().DebugQueryPath
+	})
+	code, _ := serveDebugQuery(cmp, httptest.NewRequest(http.MethodGet, "/debug/query?match[]=up&stats=1", nil))
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Empty(t, queries)
+}
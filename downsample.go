@@ -0,0 +1,142 @@
+package prom2click
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// aggregates of the samples of one downsampling bucket
+const (
+	aggregateAvg      = "avg"
+	aggregateMin      = "min"
+	aggregateMax      = "max"
+	aggregateLast     = "last"
+	aggregateSum      = "sum"
+	aggregateAny      = "any"
+	aggregateQuantile = "quantile"
+)
+
+var downsampleAggregates = map[string]sqlExpr{
+	aggregateAvg:  "avg(val)",
+	aggregateMin:  "min(val)",
+	aggregateMax:  "max(val)",
+	aggregateLast: "argMax(val, ts)",
+	aggregateSum:  "sum(val)",
+	aggregateAny:  "any(val)",
+	// quantile takes ClickhouseQuantile, see aggregateExpr
+	aggregateQuantile: "",
+}
+
+// counterSuffixes are the metric name suffixes of counters by prometheus naming conventions,
+// any aggregate but the last value breaks rate() and increase() on them
+var counterSuffixes = []string{"_total", "_count", "_sum", "_bucket"}
+
+// downsampleRule 按指标名选择降采样聚合函数的规则
+type downsampleRule struct {
+	Metric    string // 指标名的正则表达式，与prometheus一样整体匹配
+	Aggregate string // 聚合函数，可选avg、min、max、last、sum、any、quantile
+}
+
+// compiledDownsampleRule is a downsampleRule with its metric regex compiled
+type compiledDownsampleRule struct {
+	pattern   string // anchored regex, for clickhouse
+	re        *regexp.Regexp
+	aggregate string
+}
+
+func validAggregate(name string) bool {
+	_, ok := downsampleAggregates[name]
+	return ok
+}
+
+func compileDownsampleRules(rules []*downsampleRule) ([]*compiledDownsampleRule, error) {
+	out := make([]*compiledDownsampleRule, 0, len(rules))
+	for i, rule := range rules {
+		if !validAggregate(rule.Aggregate) {
+			return nil, fmt.Errorf("rule %d: unknown aggregate %q", i, rule.Aggregate)
+		}
+		pattern := "^(?:" + rule.Metric + ")$"
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		out = append(out, &compiledDownsampleRule{pattern: pattern, re: re, aggregate: rule.Aggregate})
+	}
+	return out, nil
+}
+
+// setDownsampleRules 编译ReadDownsampleRules
+func (config *config) setDownsampleRules() error {
+	rules, err := compileDownsampleRules(config.ReadDownsampleRules)
+	if err != nil {
+		return err
+	}
+	config.downsampleRules = rules
+	return nil
+}
+
+// metricAggregate returns the aggregate of the metric called name: the first matching rule,
+// the counter aggregate for counters, the default aggregate otherwise
+func (config *config) metricAggregate(name string) string {
+	for _, rule := range config.downsampleRules {
+		if rule.re.MatchString(name) {
+			return rule.aggregate
+		}
+	}
+	for _, suffix := range counterSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return config.ReadCounterAggregate
+		}
+	}
+	return config.ReadDownsampleAggregate
+}
+
+// aggregateExpr returns the sql aggregating the samples of one bucket
+func (r *promReader) aggregateExpr(aggregate string) sqlExpr {
+	if aggregate == aggregateQuantile {
+		return sqlf("quantile(?)(val)", r.conf.quantile())
+	}
+	return downsampleAggregates[aggregate]
+}
+
+// downsampleExpr returns the aggregate of the buckets of query, the one of the request if set.
+// When the matchers do not fix the metric name it is chosen per series on the name column.
+func (r *promReader) downsampleExpr(query *prompb.Query) sqlExpr {
+	if r.aggregate != "" {
+		return r.aggregateExpr(r.aggregate)
+	}
+	if name, ok := metricName(query.Matchers); ok {
+		return r.aggregateExpr(r.conf.metricAggregate(name))
+	}
+	args := make([]sqlExpr, 0, 2*len(r.conf.downsampleRules)+3)
+	for _, rule := range r.conf.downsampleRules {
+		args = append(args, sqlf("match(name, ?)", rule.pattern), r.aggregateExpr(rule.aggregate))
+	}
+	counters := "(" + strings.Join(counterSuffixes, "|") + ")$"
+	args = append(args,
+		sqlf("match(name, ?)", counters), r.aggregateExpr(r.conf.ReadCounterAggregate),
+		r.aggregateExpr(r.conf.ReadDownsampleAggregate),
+	)
+	return "multiIf(" + joinExprs(args, ", ") + ")"
+}
+
+// metricName returns the metric name when an equality matcher fixes it
+func metricName(matchers []*prompb.LabelMatcher) (string, bool) {
+	for _, m := range matchers {
+		if m.Name == model.MetricNameLabel && m.Type == prompb.LabelMatcher_EQ {
+			return m.Value, true
+		}
+	}
+	return "", false
+}
+
+// withAggregate returns a reader downsampling every query with aggregate, for one request
+func (r *promReader) withAggregate(aggregate string) *promReader {
+	rr := *r
+	rr.aggregate = aggregate
+	return &rr
+}
@@ -0,0 +1,90 @@
+package prom2click
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricAggregate(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ReadDownsampleRules = []*downsampleRule{
+		{Metric: "node_memory_.*", Aggregate: "max"},
+		{Metric: "errors_total", Aggregate: "sum"},
+	}
+	assert.NoError(t, conf.setDownsampleRules())
+
+	assert.Equal(t, "quantile", conf.metricAggregate("up"))
+	assert.Equal(t, "last", conf.metricAggregate("http_requests_total"))
+	assert.Equal(t, "last", conf.metricAggregate("http_request_duration_seconds_bucket"))
+	assert.Equal(t, "max", conf.metricAggregate("node_memory_free_bytes"))
+	assert.Equal(t, "sum", conf.metricAggregate("errors_total"))
+	// rules match the whole name
+	assert.Equal(t, "quantile", conf.metricAggregate("x_node_memory_free_bytes"))
+
+	_, err := compileDownsampleRules([]*downsampleRule{{Metric: "up", Aggregate: "median"}})
+	assert.Error(t, err)
+	_, err = compileDownsampleRules([]*downsampleRule{{Metric: "(", Aggregate: "max"}})
+	assert.Error(t, err)
+}
+
+func TestDownsampleSQL(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ReadDownsampleRules = []*downsampleRule{{Metric: "node_.*", Aggregate: "max"}}
+	assert.NoError(t, conf.setDownsampleRules())
+	r := &promReader{conf: conf}
+	query := func(typ prompb.LabelMatcher_Type, name string) *prompb.Query {
+		return &prompb.Query{StartTimestampMs: 1000000, EndTimestampMs: 2000000, Matchers: []*prompb.LabelMatcher{
+			{Type: typ, Name: "__name__", Value: name},
+		}}
+	}
+
+	sql, err := r.getSQL(query(prompb.LabelMatcher_EQ, "http_requests_total"))
+	assert.NoError(t, err)
+	assert.Contains(t, sql, ", argMax(val, ts) AS value ")
+
+	sql, err = r.getSQL(query(prompb.LabelMatcher_EQ, "node_load1"))
+	assert.NoError(t, err)
+	assert.Contains(t, sql, ", max(val) AS value ")
+
+	// the name is only known per series
+	sql, err = r.getSQL(query(prompb.LabelMatcher_RE, "node_.*|.*_total"))
+	assert.NoError(t, err)
+	assert.Contains(t, sql, ", multiIf(match(name, '^(?:node_.*)$'), max(val), "+
+		"match(name, '(_total|_count|_sum|_bucket)$'), argMax(val, ts), quantile(0.75)(val)) AS value ")
+
+	// the request overrides everything
+	sql, err = r.withAggregate("avg").getSQL(query(prompb.LabelMatcher_EQ, "http_requests_total"))
+	assert.NoError(t, err)
+	assert.Contains(t, sql, ", avg(val) AS value ")
+	assert.Equal(t, "", r.aggregate)
+
+	conf.ReadDownsampleAggregate = "median"
+	assert.ErrorContains(t, conf.Validate(), `ReadDownsampleAggregate "median" is not supported`)
+}
+
+func TestReadAggregateParam(t *testing.T) {
+	cmp := &Component{
+		Engine: gin.New(),
+		config: &config{ClickhouseHTTPReadPath: "/read"},
+		reader: &promReader{},
+	}
+	cmp.route()
+	body, err := proto.Marshal(&prompb.ReadRequest{})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	cmp.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/read?aggregate=median", bytes.NewReader(snappy.Encode(nil, body))))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	cmp.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/read?aggregate=max", bytes.NewReader(snappy.Encode(nil, body))))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
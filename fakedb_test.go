@@ -0,0 +1,116 @@
+package prom2click
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeDriver answers queries with the rows returned by the handler registered for the dsn,
+// rows are cnt, t, name, tags, value like the reader queries unless they have fewer columns.
+// Statements executed in transactions, like the writer inserts, are passed to the handler once per Exec
+type fakeDriver struct{}
+
+type fakeHandler func(query string) ([][]driver.Value, error)
+
+var fakeHandlers sync.Map
+
+func init() {
+	sql.Register("p2cfake", fakeDriver{})
+}
+
+// openFakeDB returns a db whose queries are answered by h
+func openFakeDB(t *testing.T, h fakeHandler) *sql.DB {
+	fakeHandlers.Store(t.Name(), h)
+	db, err := sql.Open("p2cfake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeHandlers.Delete(t.Name())
+	})
+	return db
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	h, _ := fakeHandlers.Load(name)
+	return &fakeConn{handler: h.(fakeHandler)}, nil
+}
+
+type fakeConn struct {
+	handler fakeHandler
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+// CheckNamedValue accepts the arrays of the tags column as they are
+func (c *fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+// fakeStmt passes the query of every Exec to the handler, the arguments are not used
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, err := s.conn.handler(s.query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, driver.ErrSkip
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.handler(query)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{ctx: ctx, rows: rows}, nil
+}
+
+// fakeRows stops with the error of ctx once it is done, like a real driver would
+type fakeRows struct {
+	ctx  context.Context
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	columns := []string{"CNT", "t", "name", "tags", "value"}
+	if len(r.rows) > 0 && len(r.rows[0]) < len(columns) {
+		columns = columns[:len(r.rows[0])]
+	}
+	return columns
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,507 @@
+package prom2click
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotomicro/cetus/l"
+	"github.com/gotomicro/ego/core/elog"
+	ogórek "github.com/kisielk/og-rek"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// graphiteFlushLines is the number of lines read from one connection before they are handed to the writer
+	graphiteFlushLines = 1000
+	// graphiteMaxPickleSize limits the size of one pickle payload
+	graphiteMaxPickleSize = 16 << 20
+	// graphiteMaxPacketSize is the largest UDP datagram accepted
+	graphiteMaxPacketSize = 64 << 10
+)
+
+// graphiteTemplate splits a dotted graphite path into a metric name and labels,
+// written as "[filter] template [tag=value,...]" like the influxdb graphite templates
+type graphiteTemplate struct {
+	// filter segments, "*" matches any segment, empty matches every path
+	filter []string
+	// template segments: "measurement", "measurement*", a label name (suffixed with "*" to take the rest of the path) or "" to skip
+	parts []string
+	tags  []prompb.Label
+}
+
+func parseGraphiteTemplate(s string) (*graphiteTemplate, error) {
+	fields := strings.Fields(s)
+	t := &graphiteTemplate{}
+	var tmpl string
+	switch len(fields) {
+	case 1:
+		tmpl = fields[0]
+	case 2:
+		if strings.Contains(fields[1], "=") {
+			tmpl = fields[0]
+			t.tags = parseGraphiteTags(fields[1])
+		} else {
+			t.filter = strings.Split(fields[0], ".")
+			tmpl = fields[1]
+		}
+	case 3:
+		t.filter = strings.Split(fields[0], ".")
+		tmpl = fields[1]
+		t.tags = parseGraphiteTags(fields[2])
+	default:
+		return nil, fmt.Errorf("invalid graphite template %q", s)
+	}
+	t.parts = strings.Split(tmpl, ".")
+	hasMeasurement := false
+	for i, part := range t.parts {
+		if strings.HasSuffix(part, "*") && i != len(t.parts)-1 {
+			return nil, fmt.Errorf("invalid graphite template %q: wildcard must be the last segment", s)
+		}
+		if strings.HasPrefix(part, "measurement") {
+			hasMeasurement = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("invalid graphite template %q: no measurement segment", s)
+	}
+	return t, nil
+}
+
+func parseGraphiteTags(s string) []prompb.Label {
+	var tags []prompb.Label
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" || v == "" {
+			continue
+		}
+		tags = append(tags, prompb.Label{Name: sanitizeLabelName(k), Value: v})
+	}
+	return tags
+}
+
+func (t *graphiteTemplate) match(path []string) bool {
+	if len(t.filter) == 0 {
+		return true
+	}
+	if len(path) < len(t.filter) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f != "*" && f != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the metric name and labels of path
+func (t *graphiteTemplate) apply(path []string) (string, []prompb.Label) {
+	var name []string
+	labels := append([]prompb.Label(nil), t.tags...)
+	for i, part := range t.parts {
+		if i >= len(path) {
+			break
+		}
+		switch {
+		case part == "":
+		case part == "measurement":
+			name = append(name, path[i])
+		case part == "measurement*":
+			name = append(name, path[i:]...)
+		case strings.HasSuffix(part, "*"):
+			labels = append(labels, prompb.Label{Name: sanitizeLabelName(strings.TrimSuffix(part, "*")), Value: strings.Join(path[i:], ".")})
+		default:
+			labels = append(labels, prompb.Label{Name: sanitizeLabelName(part), Value: path[i]})
+		}
+	}
+	if len(name) == 0 {
+		name = path
+	}
+	return sanitizeMetricName(strings.Join(name, "_")), labels
+}
+
+// graphiteParser maps graphite paths to series using the most specific matching template
+type graphiteParser struct {
+	templates []*graphiteTemplate
+}
+
+func newGraphiteParser(templates []string) (*graphiteParser, error) {
+	p := &graphiteParser{}
+	for _, s := range templates {
+		t, err := parseGraphiteTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		p.templates = append(p.templates, t)
+	}
+	// longer filters are more specific, try them first
+	sort.SliceStable(p.templates, func(i, j int) bool {
+		return len(p.templates[i].filter) > len(p.templates[j].filter)
+	})
+	return p, nil
+}
+
+// series converts a graphite path (optionally in the tagged "path;tag=value" form) and sample to a series
+func (p *graphiteParser) series(path string, v float64, ts int64) prompb.TimeSeries {
+	var tags []prompb.Label
+	if i := strings.IndexByte(path, ';'); i >= 0 {
+		tags = parseGraphiteTags(strings.ReplaceAll(path[i+1:], ";", ","))
+		path = path[:i]
+	}
+	segments := strings.Split(path, ".")
+	var (
+		name   string
+		labels []prompb.Label
+	)
+	matched := false
+	for _, t := range p.templates {
+		if t.match(segments) {
+			name, labels = t.apply(segments)
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		name = sanitizeMetricName(strings.Join(segments, "_"))
+	}
+	// a label is set once, tags of the path take precedence over the labels of the template
+	all := make([]prompb.Label, 0, len(labels)+len(tags)+1)
+	all = append(all, prompb.Label{Name: model.MetricNameLabel, Value: name})
+	index := map[string]int{model.MetricNameLabel: 0}
+	for _, lb := range append(labels, tags...) {
+		if i, ok := index[lb.Name]; ok {
+			if i > 0 {
+				all[i] = lb
+			}
+			continue
+		}
+		index[lb.Name] = len(all)
+		all = append(all, lb)
+	}
+	return prompb.TimeSeries{
+		Labels:  all,
+		Samples: []prompb.Sample{{Value: v, Timestamp: ts}},
+	}
+}
+
+// parseLine parses a plaintext line "path value [timestamp]", a missing or negative timestamp means now
+func (p *graphiteParser) parseLine(line string, now time.Time) (prompb.TimeSeries, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return prompb.TimeSeries{}, fmt.Errorf("invalid graphite line %q", line)
+	}
+	v, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return prompb.TimeSeries{}, fmt.Errorf("invalid graphite value %q", fields[1])
+	}
+	ts := now.UnixMilli()
+	if len(fields) == 3 {
+		sec, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return prompb.TimeSeries{}, fmt.Errorf("invalid graphite timestamp %q", fields[2])
+		}
+		if sec >= 0 {
+			ts = int64(sec * 1000)
+		}
+	}
+	return p.series(fields[0], v, ts), nil
+}
+
+// parsePickle decodes one pickled list of (path, (timestamp, value)) tuples
+func (p *graphiteParser) parsePickle(r io.Reader, now time.Time) ([]prompb.TimeSeries, error) {
+	obj, err := ogórek.NewDecoder(r).Decode()
+	if err != nil {
+		return nil, err
+	}
+	items, ok := obj.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid pickle payload %T", obj)
+	}
+	series := make([]prompb.TimeSeries, 0, len(items))
+	for _, item := range items {
+		metric, ok := pickleTuple(item)
+		if !ok || len(metric) != 2 {
+			return nil, fmt.Errorf("invalid pickle metric %v", item)
+		}
+		path, ok := pickleString(metric[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid pickle path %v", metric[0])
+		}
+		point, ok := pickleTuple(metric[1])
+		if !ok || len(point) != 2 {
+			return nil, fmt.Errorf("invalid pickle datapoint %v", metric[1])
+		}
+		sec, ok1 := pickleFloat(point[0])
+		v, ok2 := pickleFloat(point[1])
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("invalid pickle datapoint %v", metric[1])
+		}
+		ts := now.UnixMilli()
+		if sec >= 0 {
+			ts = int64(sec * 1000)
+		}
+		series = append(series, p.series(path, v, ts))
+	}
+	return series, nil
+}
+
+func pickleTuple(v interface{}) ([]interface{}, bool) {
+	switch x := v.(type) {
+	case ogórek.Tuple:
+		return x, true
+	case []interface{}:
+		return x, true
+	}
+	return nil, false
+}
+
+func pickleString(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case ogórek.Bytes:
+		return string(x), true
+	}
+	return "", false
+}
+
+func pickleFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case int64:
+		return float64(x), true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(x).Float64()
+		return f, true
+	case string:
+		f, err := strconv.ParseFloat(x, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// graphiteServer runs the graphite plaintext (tcp/udp) and pickle (tcp) listeners
+type graphiteServer struct {
+	config    *config
+	writer    *promWriter
+	parser    *graphiteParser
+	logger    *elog.Component
+	plaintext net.Listener
+	pickle    net.Listener
+	packet    net.PacketConn
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	conns     map[net.Conn]struct{}
+	closed    bool // set by stop, connections accepted afterwards are closed right away
+}
+
+func newGraphiteServer(config *config, writer *promWriter, logger *elog.Component) (*graphiteServer, error) {
+	parser, err := newGraphiteParser(config.GraphiteTemplates)
+	if err != nil {
+		return nil, err
+	}
+	return &graphiteServer{
+		config: config,
+		writer: writer,
+		parser: parser,
+		logger: logger,
+		conns:  make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// listen opens the configured listeners
+func (g *graphiteServer) listen() error {
+	var err error
+	if g.config.GraphiteAddress != "" {
+		if g.plaintext, err = net.Listen("tcp", g.config.GraphiteAddress); err != nil {
+			return err
+		}
+		if g.packet, err = net.ListenPacket("udp", g.config.GraphiteAddress); err != nil {
+			return err
+		}
+	}
+	if g.config.GraphitePickleAddress != "" {
+		if g.pickle, err = net.Listen("tcp", g.config.GraphitePickleAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start serves the listeners opened by listen in background goroutines
+func (g *graphiteServer) start() {
+	if g.plaintext != nil {
+		g.logger.Info("graphite plaintext listener", elog.String("addr", g.plaintext.Addr().String()))
+		g.wg.Add(1)
+		go g.accept(g.plaintext, g.handlePlaintext)
+	}
+	if g.packet != nil {
+		g.logger.Info("graphite udp listener", elog.String("addr", g.packet.LocalAddr().String()))
+		g.wg.Add(1)
+		go g.servePacket()
+	}
+	if g.pickle != nil {
+		g.logger.Info("graphite pickle listener", elog.String("addr", g.pickle.Addr().String()))
+		g.wg.Add(1)
+		go g.accept(g.pickle, g.handlePickle)
+	}
+}
+
+// stop closes every listener and connection and waits until no more samples are handed to the writer
+func (g *graphiteServer) stop() {
+	if g.plaintext != nil {
+		g.plaintext.Close()
+	}
+	if g.packet != nil {
+		g.packet.Close()
+	}
+	if g.pickle != nil {
+		g.pickle.Close()
+	}
+	g.mu.Lock()
+	g.closed = true
+	for conn := range g.conns {
+		conn.Close()
+	}
+	g.mu.Unlock()
+	g.wg.Wait()
+}
+
+// track registers conn to be closed by stop, false when stop already ran and conn is closed instead
+func (g *graphiteServer) track(conn net.Conn) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		conn.Close()
+		return false
+	}
+	g.conns[conn] = struct{}{}
+	return true
+}
+
+func (g *graphiteServer) accept(ln net.Listener, handle func(net.Conn)) {
+	defer g.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				g.logger.Error("graphite accept", elog.FieldErr(err))
+			}
+			return
+		}
+		// accepted just before the listener was closed, its reads would block stop forever
+		if !g.track(conn) {
+			continue
+		}
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			defer func() {
+				g.mu.Lock()
+				delete(g.conns, conn)
+				g.mu.Unlock()
+				conn.Close()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+func (g *graphiteServer) handlePlaintext(conn net.Conn) {
+	req := &prompb.WriteRequest{}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		ts, err := g.parser.parseLine(line, time.Now())
+		if err != nil {
+			elog.Warn("graphite", l.S("step", "parse"), l.E(err))
+			continue
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+		if len(req.Timeseries) >= graphiteFlushLines {
+			g.writer.process(req)
+			req = &prompb.WriteRequest{}
+		}
+	}
+	if len(req.Timeseries) > 0 {
+		g.writer.process(req)
+	}
+}
+
+func (g *graphiteServer) handlePickle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		var size uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				elog.Warn("graphite", l.S("step", "pickle"), l.E(err))
+			}
+			return
+		}
+		if size > graphiteMaxPickleSize {
+			elog.Warn("graphite", l.S("step", "pickle"), l.E(fmt.Errorf("pickle payload too large: %d bytes", size)))
+			return
+		}
+		payload := io.LimitReader(reader, int64(size))
+		series, err := g.parser.parsePickle(payload, time.Now())
+		if err != nil {
+			elog.Warn("graphite", l.S("step", "pickle"), l.E(err))
+			return
+		}
+		// skip anything the decoder left after the STOP opcode to stay aligned on frames
+		if _, err = io.Copy(io.Discard, payload); err != nil {
+			return
+		}
+		g.writer.process(&prompb.WriteRequest{Timeseries: series})
+	}
+}
+
+func (g *graphiteServer) servePacket() {
+	defer g.wg.Done()
+	buf := make([]byte, graphiteMaxPacketSize)
+	for {
+		n, _, err := g.packet.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				g.logger.Error("graphite udp read", elog.FieldErr(err))
+			}
+			return
+		}
+		req := &prompb.WriteRequest{}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			ts, err := g.parser.parseLine(line, time.Now())
+			if err != nil {
+				elog.Warn("graphite", l.S("step", "parse"), l.E(err))
+				continue
+			}
+			req.Timeseries = append(req.Timeseries, ts)
+		}
+		if len(req.Timeseries) > 0 {
+			g.writer.process(req)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package prom2click
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gotomicro/ego/core/elog"
+	ogórek "github.com/kisielk/og-rek"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphiteTemplates(t *testing.T) {
+	p, err := newGraphiteParser([]string{
+		"servers.* .host.measurement* region=eu",
+		"stats.*.*.latency .app.host.measurement.quantile*",
+		"measurement.measurement.field*",
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		path   string
+		labels []prompb.Label
+	}{
+		{
+			path: "servers.web01.cpu.idle",
+			labels: []prompb.Label{
+				{Name: "__name__", Value: "cpu_idle"},
+				{Name: "region", Value: "eu"},
+				{Name: "host", Value: "web01"},
+			},
+		},
+		{
+			path: "stats.api.web02.latency.p99.9",
+			labels: []prompb.Label{
+				{Name: "__name__", Value: "latency"},
+				{Name: "app", Value: "api"},
+				{Name: "host", Value: "web02"},
+				{Name: "quantile", Value: "p99.9"},
+			},
+		},
+		{
+			path: "disk.usage.sda1.free",
+			labels: []prompb.Label{
+				{Name: "__name__", Value: "disk_usage"},
+				{Name: "field", Value: "sda1.free"},
+			},
+		},
+		{
+			path: "mem.free;host=a;dc=b",
+			labels: []prompb.Label{
+				{Name: "__name__", Value: "mem_free"},
+				{Name: "host", Value: "a"},
+				{Name: "dc", Value: "b"},
+			},
+		},
+		{
+			// the tags of the path win over the template, the metric name is kept
+			path: "servers.web03.cpu;host=web04;region=us;__name__=x",
+			labels: []prompb.Label{
+				{Name: "__name__", Value: "cpu"},
+				{Name: "region", Value: "us"},
+				{Name: "host", Value: "web04"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ts := p.series(tt.path, 1, 1000)
+			assert.Equal(t, tt.labels, ts.Labels)
+		})
+	}
+
+	_, err = newGraphiteParser([]string{"host.cpu"})
+	assert.Error(t, err)
+	_, err = newGraphiteParser([]string{"measurement*.host"})
+	assert.Error(t, err)
+}
+
+func TestGraphiteParseLine(t *testing.T) {
+	p, err := newGraphiteParser(nil)
+	assert.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+
+	ts, err := p.parseLine("foo.bar-baz 1.5 1600000000", now)
+	assert.NoError(t, err)
+	assert.Equal(t, prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "foo_bar_baz"}},
+		Samples: []prompb.Sample{{Value: 1.5, Timestamp: 1600000000000}},
+	}, ts)
+
+	ts, err = p.parseLine("foo 2 -1", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.UnixMilli(), ts.Samples[0].Timestamp)
+
+	for _, line := range []string{"foo", "foo x 1", "foo 1 x", "foo 1 2 3"} {
+		_, err = p.parseLine(line, now)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestGraphiteParsePickle(t *testing.T) {
+	p, err := newGraphiteParser(nil)
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, ogórek.NewEncoder(&buf).Encode([]interface{}{
+		ogórek.Tuple{"a.b", ogórek.Tuple{int64(1600000000), 1.5}},
+		ogórek.Tuple{"c", ogórek.Tuple{1600000001.5, int64(2)}},
+	}))
+	series, err := p.parsePickle(&buf, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "a_b"}}, Samples: []prompb.Sample{{Value: 1.5, Timestamp: 1600000000000}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "c"}}, Samples: []prompb.Sample{{Value: 2, Timestamp: 1600000001500}}},
+	}, series)
+}
+
+func TestGraphiteServer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.GraphiteAddress = "127.0.0.1:0"
+	cfg.GraphitePickleAddress = "127.0.0.1:0"
+	w, err := NewWriter(cfg)
+	assert.NoError(t, err)
+	g, err := newGraphiteServer(cfg, w, elog.DefaultLogger)
+	assert.NoError(t, err)
+	assert.NoError(t, g.listen())
+	g.start()
+	defer g.stop()
+
+	conn, err := net.Dial("tcp", g.plaintext.Addr().String())
+	assert.NoError(t, err)
+	fmt.Fprintf(conn, "tcp.metric 1 1600000000\n")
+	conn.Close()
+	assert.Equal(t, "tcp_metric", (<-w.requests).name)
+
+	conn, err = net.Dial("udp", g.packet.LocalAddr().String())
+	assert.NoError(t, err)
+	fmt.Fprintf(conn, "udp.metric 2 1600000000\n")
+	conn.Close()
+	assert.Equal(t, "udp_metric", (<-w.requests).name)
+
+	var payload bytes.Buffer
+	assert.NoError(t, ogórek.NewEncoder(&payload).Encode([]interface{}{
+		ogórek.Tuple{"pickle.metric", ogórek.Tuple{int64(1600000000), 3.0}},
+	}))
+	conn, err = net.Dial("tcp", g.pickle.Addr().String())
+	assert.NoError(t, err)
+	assert.NoError(t, binary.Write(conn, binary.BigEndian, uint32(payload.Len())))
+	_, err = conn.Write(payload.Bytes())
+	assert.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, "pickle_metric", (<-w.requests).name)
+}
+
+func TestGraphiteAcceptAfterStop(t *testing.T) {
+	g, err := newGraphiteServer(DefaultConfig(), nil, elog.DefaultLogger)
+	assert.NoError(t, err)
+	g.stop()
+	server, client := net.Pipe()
+	defer client.Close()
+	assert.False(t, g.track(server))
+	assert.Empty(t, g.conns)
+	// the connection is closed, the client sees it
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,283 @@
+package prom2click
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotomicro/cetus/l"
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// importFlushSeries is the number of imported series handed to the writer at once
+const importFlushSeries = 1000
+
+// jsonLine is one series in the VictoriaMetrics JSON line format
+type jsonLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// handleImport 处理JSON line格式的数据导入
+func (c *Component) handleImport(ctx *gin.Context) {
+	body, err := requestBody(ctx)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	defer body.Close()
+	if err = importJSONLines(body, c.writer.process); err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// importJSONLines decodes JSON lines from r and passes them to process in batches.
+// Like the influx write the whole body is decoded first, a bad line rejects it without writing anything
+// so that the client can send it again.
+func importJSONLines(r io.Reader, process func(*prompb.WriteRequest)) error {
+	dec := json.NewDecoder(r)
+	var series []prompb.TimeSeries
+	for n := 1; ; n++ {
+		var line jsonLine
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		ts, err := line.timeseries()
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		series = append(series, ts)
+	}
+	for len(series) > 0 {
+		n := len(series)
+		if n > importFlushSeries {
+			n = importFlushSeries
+		}
+		process(&prompb.WriteRequest{Timeseries: series[:n]})
+		series = series[n:]
+	}
+	return nil
+}
+
+func (j jsonLine) timeseries() (prompb.TimeSeries, error) {
+	if j.Metric["__name__"] == "" {
+		return prompb.TimeSeries{}, fmt.Errorf("missing metric name")
+	}
+	if len(j.Values) != len(j.Timestamps) {
+		return prompb.TimeSeries{}, fmt.Errorf("got %d values and %d timestamps", len(j.Values), len(j.Timestamps))
+	}
+	ts := prompb.TimeSeries{
+		Labels:  make([]prompb.Label, 0, len(j.Metric)),
+		Samples: make([]prompb.Sample, 0, len(j.Values)),
+	}
+	for k, v := range j.Metric {
+		ts.Labels = append(ts.Labels, prompb.Label{Name: k, Value: v})
+	}
+	sort.Slice(ts.Labels, func(a, b int) bool { return ts.Labels[a].Name < ts.Labels[b].Name })
+	for i, v := range j.Values {
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: v, Timestamp: j.Timestamps[i]})
+	}
+	return ts, nil
+}
+
+// handleExport 以JSON line格式导出match[]匹配的原始数据
+func (c *Component) handleExport(ctx *gin.Context) {
+	selectors, err := parseSelectors(ctx.QueryArray("match[]"))
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	end, err := parseTime(ctx.Query("end"), time.Now())
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	// without start the export goes back as far as ReadMaxRange allows
+	defStart := time.Unix(0, 0)
+	if maxRange := c.config.ReadMaxRange; maxRange > 0 {
+		defStart = end.Add(-maxRange)
+	}
+	start, err := parseTime(ctx.Query("start"), defStart)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx.Header("Content-Type", "application/stream+json")
+	ctx.Status(http.StatusOK)
+	enc := json.NewEncoder(ctx.Writer)
+	err = c.reader.export(ctx.Request.Context(), selectors, start.UnixMilli(), end.UnixMilli(), func(tags []string, timestamps []int64, values []float64) error {
+		line := jsonLine{
+			Metric:     make(map[string]string, len(tags)),
+			Values:     make([]float64, 0, len(values)),
+			Timestamps: make([]int64, 0, len(timestamps)),
+		}
+		// JSON has no NaN, staleness markers and other NaNs are left out
+		for i, v := range values {
+			if math.IsNaN(v) {
+				continue
+			}
+			line.Values = append(line.Values, v)
+			line.Timestamps = append(line.Timestamps, timestamps[i])
+		}
+		for _, lb := range makeLabels(tags) {
+			line.Metric[lb.Name] = lb.Value
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+		ctx.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		elog.Error("export", l.E(err))
+		if !ctx.Writer.Written() {
+			ctx.String(readErrorStatus(err), err.Error())
+			return
+		}
+		// headers are already sent, the best we can do is to cut the stream
+		ctx.Abort()
+	}
+}
+
+// parseSelectors parses prometheus series selectors into remote read label matchers
+func parseSelectors(selectors []string) ([][]*prompb.LabelMatcher, error) {
+	if len(selectors) == 0 {
+		return nil, fmt.Errorf("no match[] parameter provided")
+	}
+	out := make([][]*prompb.LabelMatcher, 0, len(selectors))
+	for _, s := range selectors {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		q, err := remote.ToQuery(0, 0, matchers, nil)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, q.Matchers)
+	}
+	return out, nil
+}
+
+// parseTime parses a unix timestamp in seconds (possibly fractional) or a RFC3339 time, empty returns def
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// export streams the raw samples of every series matching one of the selectors,
+// fn is called once per series in tags order. The read limits apply like they do to remote reads,
+// a limit reached half way stops the stream with an error.
+func (r *promReader) export(ctx context.Context, selectors [][]*prompb.LabelMatcher, start, end int64,
+	fn func(tags []string, timestamps []int64, values []float64) error) error {
+	sqlStr, err := r.getExportSQL(selectors, start, end)
+	if err != nil {
+		return err
+	}
+	elog.Debug("export", l.S("sql", sqlStr))
+	ctx, cancel := r.readContext(ctx)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, sqlStr)
+	if err != nil {
+		return r.timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	var (
+		key        string
+		tags       []string
+		timestamps []int64
+		values     []float64
+		nseries    int
+		nsamples   int
+	)
+	for rows.Next() {
+		nsamples++
+		if err = r.checkSamples(nsamples); err != nil {
+			return err
+		}
+		var (
+			rowTags []string
+			t       int64
+			v       float64
+		)
+		if err = rows.Scan(&rowTags, &t, &v); err != nil {
+			return err
+		}
+		rowKey := strings.Join(rowTags, "\xff")
+		if rowKey != key && len(timestamps) > 0 {
+			if err = fn(tags, timestamps, values); err != nil {
+				return err
+			}
+			timestamps, values = nil, nil
+		}
+		if rowKey != key || nseries == 0 {
+			nseries++
+			if err = r.checkSeries(nseries); err != nil {
+				return err
+			}
+		}
+		key, tags = rowKey, rowTags
+		timestamps = append(timestamps, t)
+		values = append(values, v)
+	}
+	if err = rows.Err(); err != nil {
+		return r.timeoutError(ctx, err)
+	}
+	if len(timestamps) > 0 {
+		return fn(tags, timestamps, values)
+	}
+	return nil
+}
+
+// getExportSQL selects raw samples in [start, end] milliseconds matching any of the selectors,
+// bounded by the read limits
+func (r *promReader) getExportSQL(selectors [][]*prompb.LabelMatcher, start, end int64) (string, error) {
+	if end < start {
+		return "", fmt.Errorf("Start time is after end time")
+	}
+	if maxRange := r.conf.ReadMaxRange; maxRange > 0 && time.Duration(end-start)*time.Millisecond > maxRange {
+		return "", fmt.Errorf("%w: time range is longer than %s", errQueryLimit, maxRange)
+	}
+	ors := make([]sqlExpr, 0, len(selectors))
+	for _, matchers := range selectors {
+		if len(matchers) == 0 {
+			return "", fmt.Errorf("empty selector")
+		}
+		ors = append(ors, sqlAnd(r.seriesConds(matchers, start/1000, end/1000)))
+	}
+	return r.withLimits(newSelect("tags", "toUnixTimestamp(ts) * 1000 AS t", "val").
+		From(r.conf.ClickhouseDB, r.conf.ClickhouseTable).
+		Where(timeRangeConds(start/1000, end/1000)...).
+		Where(sqlOr(ors)).
+		OrderBy("tags", "t")).
+		String(), nil
+}
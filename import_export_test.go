@@ -0,0 +1,167 @@
+package prom2click
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportJSONLines(t *testing.T) {
+	body := `{"metric":{"__name__":"up","job":"a"},"values":[1,0],"timestamps":[1000,2000]}
+{"metric":{"__name__":"up","job":"b"},"values":[1],"timestamps":[3000]}
+`
+	var reqs []*prompb.WriteRequest
+	err := importJSONLines(strings.NewReader(body), func(req *prompb.WriteRequest) {
+		reqs = append(reqs, req)
+	})
+	assert.NoError(t, err)
+	assert.Len(t, reqs, 1)
+	assert.Equal(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 0, Timestamp: 2000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 3000}},
+		},
+	}, reqs[0].Timeseries)
+
+	// nothing is written from a body with a bad line, even after a full batch
+	var good strings.Builder
+	for i := 0; i <= importFlushSeries; i++ {
+		good.WriteString(`{"metric":{"__name__":"up"},"values":[1],"timestamps":[1000]}` + "\n")
+	}
+	processed := 0
+	process := func(req *prompb.WriteRequest) { processed += len(req.Timeseries) }
+	assert.Error(t, importJSONLines(strings.NewReader(good.String()+`{"metric":`), process))
+	assert.Equal(t, 0, processed)
+	assert.NoError(t, importJSONLines(strings.NewReader(good.String()), process))
+	assert.Equal(t, importFlushSeries+1, processed)
+
+	for _, bad := range []string{
+		`{"metric":{"job":"a"},"values":[1],"timestamps":[1]}`,
+		`{"metric":{"__name__":"up"},"values":[1,2],"timestamps":[1]}`,
+		`{"metric":`,
+	} {
+		assert.Error(t, importJSONLines(strings.NewReader(bad), func(*prompb.WriteRequest) {}), bad)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	def := time.Unix(42, 0)
+	got, err := parseTime("", def)
+	assert.NoError(t, err)
+	assert.Equal(t, def, got)
+
+	got, err = parseTime("1700000000.5", def)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1700000000500), got.UnixMilli())
+
+	got, err = parseTime("2023-11-14T22:13:20Z", def)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1700000000), got.Unix())
+
+	_, err = parseTime("yesterday", def)
+	assert.Error(t, err)
+}
+
+func TestGetExportSQL(t *testing.T) {
+	r := &promReader{conf: DefaultConfig()}
+	selectors, err := parseSelectors([]string{`up{job="a"}`, `{__name__="down"}`})
+	assert.NoError(t, err)
+	sql, err := r.getExportSQL(selectors, 1000000, 2000000)
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT tags, toUnixTimestamp(ts) * 1000 AS t, val FROM `metrics`.`samples` "+
+		"WHERE (date >= toDate(1000)) AND (ts >= toDateTime(1000)) AND (ts <= toDateTime(2000)) AND "+
+		"(((has(tags, 'job=a')) AND (name = 'up')) OR ((name = 'down'))) ORDER BY tags, t", sql)
+
+	_, err = r.getExportSQL(selectors, 2000, 1000)
+	assert.Error(t, err)
+
+	r.conf.ReadMaxSamples = 10
+	r.conf.ReadTimeout = 5 * time.Second
+	r.conf.ReadMaxRange = time.Hour
+	sql, err = r.getExportSQL(selectors, 1000000, 2000000)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(sql, "ORDER BY tags, t LIMIT 11 SETTINGS max_execution_time = 5"), sql)
+	_, err = r.getExportSQL(selectors, 0, 2000000*1000)
+	assert.ErrorIs(t, err, errQueryLimit)
+	_, err = parseSelectors(nil)
+	assert.Error(t, err)
+	_, err = parseSelectors([]string{"up{"})
+	assert.Error(t, err)
+}
+
+func TestImportRoute(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ExportHTTPPath = "/api/v1/export"
+	cmp := &Component{
+		Engine: gin.New(),
+		config: cfg,
+	}
+	var err error
+	cmp.writer, err = NewWriter(cfg)
+	assert.NoError(t, err)
+	cmp.route()
+
+	body := `{"metric":{"__name__":"up"},"values":[1],"timestamps":[1000]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/import", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	cmp.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "up", (<-cmp.writer.requests).name)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/export", nil)
+	w = httptest.NewRecorder()
+	cmp.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestExportLimits(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ReadMaxSamples = 3
+	r := &promReader{conf: conf, db: openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		return [][]driver.Value{
+			{[]string{"__name__=up", "job=a"}, int64(1000), 1.0},
+			{[]string{"__name__=up", "job=a"}, int64(2000), 1.0},
+			{[]string{"__name__=up", "job=b"}, int64(1000), 1.0},
+			{[]string{"__name__=up", "job=b"}, int64(2000), 1.0},
+		}, nil
+	})}
+	selectors, err := parseSelectors([]string{"up"})
+	assert.NoError(t, err)
+	var series int
+	export := func() error {
+		series = 0
+		return r.export(context.Background(), selectors, 0, 3000, func([]string, []int64, []float64) error {
+			series++
+			return nil
+		})
+	}
+	assert.ErrorIs(t, export(), errQueryLimit)
+	assert.Equal(t, 1, series)
+
+	conf.ReadMaxSamples, conf.ReadMaxSeries = 0, 1
+	assert.ErrorIs(t, export(), errQueryLimit)
+	conf.ReadMaxSeries = 2
+	assert.NoError(t, export())
+	assert.Equal(t, 2, series)
+}
+
+func TestExportDisabledByDefault(t *testing.T) {
+	cmp := &Component{Engine: gin.New(), config: DefaultConfig()}
+	cmp.route()
+	w := httptest.NewRecorder()
+	cmp.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/export?match[]=up", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,283 @@
+package prom2click
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// influxPoint is one parsed line of InfluxDB line protocol
+type influxPoint struct {
+	measurement string
+	tags        []prompb.Label
+	fields      []influxField
+	// timestamp in the request precision, only set when hasTimestamp is
+	timestamp    int64
+	hasTimestamp bool
+}
+
+type influxField struct {
+	key   string
+	value float64
+}
+
+// handleInfluxWrite 处理influxdb v1/v2 line protocol写入请求
+func (c *Component) handleInfluxWrite(ctx *gin.Context) {
+	tstart := time.Now()
+	body, err := requestBody(ctx)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	defer body.Close()
+	prompbReq, err := decodeInfluxWriteRequest(body, ctx.Query("precision"), time.Now())
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.writer.metrics.stage(stageDecode, time.Since(tstart).Seconds())
+	c.writer.process(prompbReq)
+	ctx.Status(http.StatusNoContent)
+}
+
+// decodeInfluxWriteRequest converts a line protocol body into a remote write request,
+// lines without a timestamp are stamped with now
+func decodeInfluxWriteRequest(r io.Reader, precision string, now time.Time) (*prompb.WriteRequest, error) {
+	toMillis, err := influxPrecision(precision)
+	if err != nil {
+		return nil, err
+	}
+	req := &prompb.WriteRequest{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := parseInfluxLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		ts := now.UnixMilli()
+		if point.hasTimestamp {
+			ts = toMillis(point.timestamp)
+		}
+		req.Timeseries = append(req.Timeseries, point.timeseries(ts)...)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// influxPrecision returns a converter from a timestamp in the given precision to milliseconds
+func influxPrecision(precision string) (func(int64) int64, error) {
+	switch precision {
+	case "", "n", "ns":
+		return func(ts int64) int64 { return ts / int64(time.Millisecond) }, nil
+	case "u", "us", "µ", "µs":
+		return func(ts int64) int64 { return ts / 1000 }, nil
+	case "ms":
+		return func(ts int64) int64 { return ts }, nil
+	case "s":
+		return func(ts int64) int64 { return ts * 1000 }, nil
+	case "m":
+		return func(ts int64) int64 { return ts * 60 * 1000 }, nil
+	case "h":
+		return func(ts int64) int64 { return ts * 3600 * 1000 }, nil
+	}
+	return nil, fmt.Errorf("invalid precision %q", precision)
+}
+
+// timeseries maps every numeric field to a series named <measurement>_<field>,
+// a field called "value" keeps the bare measurement name like telegraf does
+func (p influxPoint) timeseries(ts int64) []prompb.TimeSeries {
+	series := make([]prompb.TimeSeries, 0, len(p.fields))
+	for _, f := range p.fields {
+		name := p.measurement
+		if f.key != "value" {
+			name = name + "_" + f.key
+		}
+		labels := make([]prompb.Label, 0, len(p.tags)+1)
+		labels = append(labels, prompb.Label{Name: model.MetricNameLabel, Value: sanitizeMetricName(name)})
+		labels = append(labels, p.tags...)
+		series = append(series, prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: f.value, Timestamp: ts}},
+		})
+	}
+	return series
+}
+
+// parseInfluxLine parses `measurement[,tag=value...] field=value[,field=value...] [timestamp]`,
+// string fields are skipped since they can not be stored as samples
+func parseInfluxLine(line string) (influxPoint, error) {
+	var point influxPoint
+	head, rest := cutUnescaped(line, ' ')
+	rest = strings.TrimLeft(rest, " ")
+	if rest == "" {
+		return point, fmt.Errorf("missing fields")
+	}
+
+	keys := splitInflux(head, ',', false)
+	point.measurement = unescapeInflux(keys[0])
+	if point.measurement == "" {
+		return point, fmt.Errorf("missing measurement")
+	}
+	seen := make(map[string]struct{}, len(keys)-1)
+	for _, kv := range keys[1:] {
+		k, v := cutUnescaped(kv, '=')
+		k, v = unescapeInflux(k), unescapeInflux(v)
+		if k == "" || v == "" {
+			return point, fmt.Errorf("invalid tag %q", kv)
+		}
+		name := sanitizeLabelName(k)
+		// __name__ and the other __ labels are set by prom2click and prometheus only
+		if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return point, fmt.Errorf("reserved tag key %q", k)
+		}
+		// the first of repeated keys wins, also of keys which are only the same once sanitized
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		point.tags = append(point.tags, prompb.Label{Name: name, Value: v})
+	}
+
+	sections := splitInflux(rest, ' ', true)
+	switch {
+	case len(sections) > 2:
+		return point, fmt.Errorf("unexpected data after timestamp")
+	case len(sections) == 2:
+		ts, err := strconv.ParseInt(sections[1], 10, 64)
+		if err != nil {
+			return point, fmt.Errorf("invalid timestamp %q", sections[1])
+		}
+		point.timestamp, point.hasTimestamp = ts, true
+	}
+
+	for _, kv := range splitInflux(sections[0], ',', true) {
+		k, v := cutUnescaped(kv, '=')
+		k = unescapeInflux(k)
+		if k == "" || v == "" {
+			return point, fmt.Errorf("invalid field %q", kv)
+		}
+		if strings.HasPrefix(v, `"`) {
+			continue
+		}
+		val, err := parseInfluxValue(v)
+		if err != nil {
+			return point, fmt.Errorf("invalid field %q: %w", kv, err)
+		}
+		point.fields = append(point.fields, influxField{key: k, value: val})
+	}
+	return point, nil
+}
+
+func parseInfluxValue(v string) (float64, error) {
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	switch v[len(v)-1] {
+	case 'i':
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return float64(i), err
+	case 'u':
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		return float64(u), err
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// splitInflux splits s on every sep that is neither escaped nor, if quoted is set, inside double quotes
+func splitInflux(s string, sep byte, quoted bool) []string {
+	var parts []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inQuote = !inQuote
+		case s[i] == sep && !inQuote:
+			if i > start {
+				parts = append(parts, s[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		parts = append(parts, s[start:])
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "")
+	}
+	return parts
+}
+
+// cutUnescaped slices s around the first sep not preceded by a backslash
+func cutUnescaped(s string, sep byte) (string, string) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// sanitizeMetricName replaces every character not allowed in a prometheus metric name with '_'
+func sanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+// sanitizeLabelName replaces every character not allowed in a prometheus label name with '_'
+func sanitizeLabelName(name string) string {
+	return sanitizeName(name, false)
+}
+
+func sanitizeName(name string, colons bool) string {
+	b := []byte(name)
+	for i, ch := range b {
+		valid := ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') ||
+			(ch >= '0' && ch <= '9') || (colons && ch == ':')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
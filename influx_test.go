@@ -0,0 +1,124 @@
+package prom2click
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		point  influxPoint
+		hasErr bool
+	}{
+		{
+			line: "cpu,host=a,region=us-west usage_idle=99.5,usage_user=0.5 1465839830100400200",
+			point: influxPoint{
+				measurement:  "cpu",
+				tags:         []prompb.Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us-west"}},
+				fields:       []influxField{{key: "usage_idle", value: 99.5}, {key: "usage_user", value: 0.5}},
+				timestamp:    1465839830100400200,
+				hasTimestamp: true,
+			},
+		},
+		{
+			// repeated keys keep the first value
+			line: "cpu,host=a,host=b,ho.st=c value=1",
+			point: influxPoint{
+				measurement: "cpu",
+				tags:        []prompb.Label{{Name: "host", Value: "a"}, {Name: "ho_st", Value: "c"}},
+				fields:      []influxField{{key: "value", value: 1}},
+			},
+		},
+		{
+			line: `disk\ io,path=/var\,log,dev\=x=sda free=10i,total=20u,ro=t,note="a b, c=d"`,
+			point: influxPoint{
+				measurement: "disk io",
+				tags:        []prompb.Label{{Name: "path", Value: "/var,log"}, {Name: "dev_x", Value: "sda"}},
+				fields:      []influxField{{key: "free", value: 10}, {key: "total", value: 20}, {key: "ro", value: 1}},
+			},
+		},
+		{line: "cpu", hasErr: true},
+		{line: "cpu,host value=1", hasErr: true},
+		{line: "cpu value=abc", hasErr: true},
+		{line: "cpu value=1 notatime", hasErr: true},
+		{line: "cpu value=1 1 2", hasErr: true},
+		{line: "cpu,__name__=x value=1", hasErr: true},
+		{line: "cpu,__meta=x value=1", hasErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			point, err := parseInfluxLine(tt.line)
+			if tt.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.point, point)
+		})
+	}
+}
+
+func TestDecodeInfluxWriteRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := "# comment\n\nmem,host=a value=1 1700000001\nmem,host=a used=2\n"
+	req, err := decodeInfluxWriteRequest(strings.NewReader(body), "s", now)
+	assert.NoError(t, err)
+	assert.Equal(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "mem"}, {Name: "host", Value: "a"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1700000001000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "mem_used"}, {Name: "host", Value: "a"}},
+			Samples: []prompb.Sample{{Value: 2, Timestamp: now.UnixMilli()}},
+		},
+	}, req.Timeseries)
+
+	// an explicit zero timestamp is kept
+	req, err = decodeInfluxWriteRequest(strings.NewReader("mem value=1 0\n"), "s", now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), req.Timeseries[0].Samples[0].Timestamp)
+
+	_, err = decodeInfluxWriteRequest(strings.NewReader(body), "d", now)
+	assert.Error(t, err)
+}
+
+func TestSanitizeName(t *testing.T) {
+	assert.Equal(t, "http_requests:rate", sanitizeMetricName("http.requests:rate"))
+	assert.Equal(t, "http_requests_rate", sanitizeLabelName("http.requests:rate"))
+	assert.Equal(t, "_1xx", sanitizeLabelName("1xx"))
+}
+
+func TestInfluxWriteRoute(t *testing.T) {
+	cfg := DefaultConfig()
+	cmp := &Component{
+		Engine: gin.New(),
+		config: cfg,
+	}
+	var err error
+	cmp.writer, err = NewWriter(cfg)
+	assert.NoError(t, err)
+	cmp.route()
+
+	for _, path := range []string{"/influx/write", "/api/v2/write"} {
+		req := httptest.NewRequest(http.MethodPost, path+"?precision=ms", bytes.NewBufferString("cpu,host=a idle=1 1700000000000\n"))
+		w := httptest.NewRecorder()
+		cmp.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "cpu_idle", (<-cmp.writer.requests).name)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/influx/write", bytes.NewBufferString("cpu\n"))
+	w := httptest.NewRecorder()
+	cmp.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
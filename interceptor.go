@@ -197,7 +197,10 @@ func (c *Container) defaultServerInterceptor() gin.HandlerFunc {
 				return
 			}
 			// todo 如果不记录日志的时候，应该早点return
-			if c.config.EnableAccessInterceptor != nil && *c.config.EnableAccessInterceptor {
+			c.config.mu.RLock()
+			enableAccess := c.config.EnableAccessInterceptor != nil && *c.config.EnableAccessInterceptor
+			c.config.mu.RUnlock()
+			if enableAccess {
 				fields = append(fields,
 					elog.FieldEvent(event),
 					elog.FieldErrAny(ctx.Errors.ByType(gin.ErrorTypePrivate).String()),
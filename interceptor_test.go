@@ -39,6 +39,8 @@ func TestPanicInHandler(t *testing.T) {
 	router.GET("/recovery", func(_ *gin.Context) {
 		panic("we have a panic")
 	})
+	// 清理其他用例写入的日志，保证只读到本次请求的日志
+	os.Remove(path.Join(logger.ConfigDir(), logger.ConfigName()))
 	// 调用触发panic的接口
 	w := performRequest(router, "GET", "/recovery")
 	logged, err := ioutil.ReadFile(path.Join(logger.ConfigDir(), logger.ConfigName()))
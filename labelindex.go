@@ -0,0 +1,202 @@
+package prom2click
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/gotomicro/cetus/l"
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// The label index is an inverted index of the samples table, one row per label of every series and day:
+//
+//	CREATE TABLE metrics.samples_labels (
+//		date        Date,
+//		label       String,
+//		value       String,
+//		fingerprint UInt64
+//	) ENGINE = ReplacingMergeTree
+//	PARTITION BY toYYYYMM(date)
+//	ORDER BY (label, value, date, fingerprint)
+//
+// The writer fills it for new series, data written before it was enabled is indexed with
+//
+//	INSERT INTO metrics.samples_labels
+//	SELECT DISTINCT date, substring(tag, 1, position(tag, '=') - 1), substring(tag, position(tag, '=') + 1),
+//		xxHash64(arrayStringConcat(tags, '\xFF'))
+//	FROM metrics.samples ARRAY JOIN tags AS tag
+
+var insertIndexSQL = `INSERT INTO %s.%s
+	(date, label, value, fingerprint)
+	VALUES	(?, ?, ?, ?)`
+
+// fingerprintColumn computes the fingerprint of the series of a samples row the same way as seriesFingerprint
+const fingerprintColumn sqlExpr = `xxHash64(arrayStringConcat(tags, '\xFF'))`
+
+// seriesFingerprint identifies a series by its sorted tags, 0xff does not occur in utf-8 label values
+func seriesFingerprint(tags []string) uint64 {
+	return xxhash.Sum64String(strings.Join(tags, "\xff"))
+}
+
+// labelIndexKey is a series on one day, every key is written to the index once while it is remembered
+type labelIndexKey struct {
+	day         int64
+	fingerprint uint64
+}
+
+// indexDay is the number of the day of ts since the epoch
+func indexDay(ts time.Time) int64 {
+	return ts.Unix() / 86400
+}
+
+// indexedSeries remembers up to max series written to the label index, the least recently written
+// are forgotten first. A forgotten series is written again, which the ReplacingMergeTree deduplicates.
+// It is only used by the goroutine writing the batches.
+type indexedSeries struct {
+	max   int
+	lru   *list.List
+	items map[labelIndexKey]*list.Element
+}
+
+func newIndexedSeries(max int) *indexedSeries {
+	return &indexedSeries{max: max, lru: list.New(), items: make(map[labelIndexKey]*list.Element)}
+}
+
+// has reports whether key is remembered and marks it as recently written
+func (s *indexedSeries) has(key labelIndexKey) bool {
+	el, ok := s.items[key]
+	if ok {
+		s.lru.MoveToFront(el)
+	}
+	return ok
+}
+
+// add remembers key, forgetting the least recently written series beyond max
+func (s *indexedSeries) add(key labelIndexKey) {
+	if el, ok := s.items[key]; ok {
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.items[key] = s.lru.PushFront(key)
+	for s.lru.Len() > s.max {
+		el := s.lru.Back()
+		s.lru.Remove(el)
+		delete(s.items, el.Value.(labelIndexKey))
+	}
+}
+
+// newIndexSeries returns one request per series and day of reqs which is not indexed yet
+func (w *promWriter) newIndexSeries(reqs []*promRequest) map[labelIndexKey]*promRequest {
+	series := make(map[labelIndexKey]*promRequest)
+	for _, req := range reqs {
+		key := labelIndexKey{day: indexDay(req.ts), fingerprint: seriesFingerprint(req.tags)}
+		if w.indexed.has(key) {
+			continue
+		}
+		series[key] = req
+	}
+	return series
+}
+
+// markIndexed remembers series as indexed
+func (w *promWriter) markIndexed(series map[labelIndexKey]*promRequest) {
+	for key := range series {
+		w.indexed.add(key)
+	}
+}
+
+// insertIndex writes the label index rows of the series of reqs which are not indexed yet,
+// the tags of reqs are sorted by seriesTags already
+func (w *promWriter) insertIndex(reqs []*promRequest) error {
+	if w.config.ClickhouseLabelIndexTable == "" {
+		return nil
+	}
+	series := w.newIndexSeries(reqs)
+	if len(series) == 0 {
+		return nil
+	}
+	tx, err := w.db.Begin()
+	if err != nil {
+		elog.Error("writer", l.S("step", "index begin"), l.E(err))
+		return err
+	}
+	smt, err := tx.Prepare(fmt.Sprintf(insertIndexSQL, w.config.ClickhouseDB, w.config.ClickhouseLabelIndexTable))
+	if err != nil {
+		_ = tx.Rollback()
+		elog.Error("writer", l.S("step", "index prepare"), l.E(err))
+		return err
+	}
+	for key, req := range series {
+		for _, tag := range req.tags {
+			name, value, _ := strings.Cut(tag, "=")
+			if _, err = smt.Exec(req.ts, name, value, key.fingerprint); err != nil {
+				_ = tx.Rollback()
+				elog.Error("writer", l.S("step", "index exec"), l.E(err))
+				return err
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		elog.Error("writer", l.S("step", "index commit"), l.E(err))
+		return err
+	}
+	// series are retried with the next batch unless committed
+	w.markIndexed(series)
+	return nil
+}
+
+// seriesConds returns the where conditions selecting the series of matchers between tstart and tend seconds,
+// with a label index the series are first resolved to fingerprints through it
+func (r *promReader) seriesConds(matchers []*prompb.LabelMatcher, tstart, tend int64) []sqlExpr {
+	conds := matchersConds(matchers)
+	if cond, ok := r.labelIndexCond(matchers, tstart, tend); ok {
+		conds = append(conds, cond)
+	}
+	return conds
+}
+
+// labelIndexCond restricts rows to the fingerprints having a label matched by every indexable matcher.
+// Matchers which match the empty value also select series without the label, which are not in the index,
+// they are left to the conditions on the tags column.
+func (r *promReader) labelIndexCond(matchers []*prompb.LabelMatcher, tstart, tend int64) (sqlExpr, bool) {
+	if r.conf.ClickhouseLabelIndexTable == "" {
+		return "", false
+	}
+	var ors, having []sqlExpr
+	for _, m := range matchers {
+		lm, err := labels.NewMatcher(labels.MatchType(m.Type), m.Name, m.Value)
+		if err != nil || lm.Matches("") {
+			continue
+		}
+		var cond sqlExpr
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			cond = sqlf("label = ? AND value = ?", m.Name, m.Value)
+		case prompb.LabelMatcher_RE:
+			cond = sqlf("label = ? AND match(value, ?)", m.Name, anchorRegex(m.Value))
+		default:
+			// != and !~ only exclude values, a series without the label matches them
+			continue
+		}
+		ors = append(ors, cond)
+		having = append(having, sqlf("countIf(?) > 0", cond))
+	}
+	if len(ors) == 0 {
+		return "", false
+	}
+	fingerprints := newSelect("fingerprint").
+		From(r.conf.ClickhouseDB, r.conf.ClickhouseLabelIndexTable).
+		Where(
+			sqlf("date >= toDate(?)", tstart),
+			sqlf("date <= toDate(?)", tend),
+			sqlOr(ors),
+		).
+		GroupBy("fingerprint").
+		Having(having...)
+	return sqlf("? IN (?)", fingerprintColumn, sqlExpr(fingerprints.String())), true
+}
@@ -0,0 +1,68 @@
+package prom2click
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesFingerprint(t *testing.T) {
+	// xxHash64 with seed 0 like clickhouse, SELECT xxHash64('') is 17241709254077376921
+	assert.Equal(t, uint64(17241709254077376921), seriesFingerprint(nil))
+	assert.NotEqual(t, seriesFingerprint([]string{"a=b", "c=d"}), seriesFingerprint([]string{"a=b,c=d"}))
+}
+
+func TestLabelIndexCond(t *testing.T) {
+	conf := DefaultConfig()
+	r := &promReader{conf: conf}
+	matchers := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api|web"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "env", Value: "dev"},
+		{Type: prompb.LabelMatcher_RE, Name: "instance", Value: ".*"},
+		{Type: prompb.LabelMatcher_EQ, Name: "zone", Value: ""},
+	}
+	assert.Len(t, r.seriesConds(matchers, 86400, 2*86400), len(matchers))
+
+	conf.ClickhouseLabelIndexTable = "samples_labels"
+	conds := r.seriesConds(matchers, 86400, 2*86400)
+	assert.Len(t, conds, len(matchers)+1)
+	assert.Equal(t, sqlExpr(`xxHash64(arrayStringConcat(tags, '\xFF')) IN (`+
+		"SELECT fingerprint FROM `metrics`.`samples_labels` WHERE (date >= toDate(86400)) AND (date <= toDate(172800)) "+
+		"AND ((label = '__name__' AND value = 'up') OR (label = 'job' AND match(value, '(?-s)^(?:api|web)$'))) "+
+		"GROUP BY fingerprint HAVING (countIf(label = '__name__' AND value = 'up') > 0) "+
+		"AND (countIf(label = 'job' AND match(value, '(?-s)^(?:api|web)$')) > 0))"), conds[len(conds)-1])
+
+	// only matchers which may select series without the label, the index can not help
+	_, ok := r.labelIndexCond(matchers[2:], 0, 0)
+	assert.False(t, ok)
+
+	sql, err := r.getSQL(&prompb.Query{StartTimestampMs: 1000000, EndTimestampMs: 2000000, Matchers: matchers[:1]})
+	assert.NoError(t, err)
+	assert.Contains(t, sql, "AND (xxHash64(arrayStringConcat(tags, '\\xFF')) IN (SELECT fingerprint FROM `metrics`.`samples_labels`")
+}
+
+func TestLabelIndexSeen(t *testing.T) {
+	w := &promWriter{indexed: newIndexedSeries(2)}
+	day := time.Unix(100*86400, 0)
+	a := &promRequest{tags: []string{"__name__=up", "job=a"}, ts: day}
+	b := &promRequest{tags: []string{"__name__=up", "job=b"}, ts: day.Add(time.Hour)}
+	reqs := []*promRequest{a, b, a}
+
+	series := w.newIndexSeries(reqs)
+	assert.Len(t, series, 2)
+	w.markIndexed(series)
+	assert.Empty(t, w.newIndexSeries(reqs))
+
+	// a new day indexes the series again, the least recently written series is forgotten
+	assert.Empty(t, w.newIndexSeries([]*promRequest{a}))
+	next := &promRequest{tags: a.tags, ts: day.Add(24 * time.Hour)}
+	series = w.newIndexSeries([]*promRequest{next})
+	assert.Len(t, series, 1)
+	w.markIndexed(series)
+	assert.Equal(t, 2, w.indexed.lru.Len())
+	assert.Len(t, w.newIndexSeries([]*promRequest{b}), 1)
+	assert.Empty(t, w.newIndexSeries([]*promRequest{a, next}))
+}
@@ -0,0 +1,248 @@
+package prom2click
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gotomicro/cetus/l"
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// labelQuery filters the series the label and series endpoints look at
+type labelQuery struct {
+	selectors  [][]*prompb.LabelMatcher // series matching any selector, all series when empty
+	start, end int64                    // milliseconds
+	limit      int                      // at most this many results, 0 for LabelMaxResults
+}
+
+// labelNames returns the sorted label names of the matching series,
+// truncated is true when there were more than the limit
+func (r *promReader) labelNames(ctx context.Context, q labelQuery) (names []string, truncated bool, err error) {
+	b, limit, err := r.labelSelect(q, sqlf("arrayJoin(arrayMap(x -> substring(x, 1, position(x, '=') - 1), tags)) AS label"))
+	if err != nil {
+		return nil, false, err
+	}
+	b.OrderBy("label")
+	return r.queryStrings(ctx, b, limit)
+}
+
+// labelValues returns the sorted values of label name in the matching series
+func (r *promReader) labelValues(ctx context.Context, name string, q labelQuery) (values []string, truncated bool, err error) {
+	if !model.LabelName(name).IsValid() {
+		return nil, false, fmt.Errorf("invalid label name: %q", name)
+	}
+	column := labelColumn(name)
+	b, limit, err := r.labelSelect(q, sqlf("? AS value", column))
+	if err != nil {
+		return nil, false, err
+	}
+	b.Where(sqlf("? != ''", column)).OrderBy("value")
+	return r.queryStrings(ctx, b, limit)
+}
+
+// series returns the sorted tags of the matching series
+func (r *promReader) series(ctx context.Context, q labelQuery) (series [][]string, truncated bool, err error) {
+	b, limit, err := r.labelSelect(q, "tags")
+	if err != nil {
+		return nil, false, err
+	}
+	sqlStr := b.OrderBy("tags").String()
+	elog.Debug("series", l.S("sql", sqlStr))
+
+	ctx, cancel := r.readContext(ctx)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, sqlStr)
+	if err != nil {
+		return nil, false, r.timeoutError(ctx, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tags []string
+		if err = rows.Scan(&tags); err != nil {
+			return nil, false, err
+		}
+		series = append(series, tags)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, false, r.timeoutError(ctx, err)
+	}
+	if limit > 0 && len(series) > limit {
+		return series[:limit], true, nil
+	}
+	return series, false, nil
+}
+
+// labelSelect selects the distinct column over the series of q, one row beyond the limit tells if there are more
+func (r *promReader) labelSelect(q labelQuery, column sqlExpr) (*selectBuilder, int, error) {
+	if q.end < q.start {
+		return nil, 0, fmt.Errorf("end timestamp must not be before start time")
+	}
+	if r.conf.ReadMaxRange > 0 && time.Duration(q.end-q.start)*time.Millisecond > r.conf.ReadMaxRange {
+		return nil, 0, fmt.Errorf("%w: range longer than %s", errQueryLimit, r.conf.ReadMaxRange)
+	}
+	limit := r.conf.LabelMaxResults
+	if q.limit > 0 && (limit <= 0 || q.limit < limit) {
+		limit = q.limit
+	}
+	b := newSelect(column).Distinct().
+		From(r.conf.ClickhouseDB, r.conf.ClickhouseTable).
+		Where(timeRangeConds(q.start/1000, q.end/1000)...)
+	if len(q.selectors) > 0 {
+		ors := make([]sqlExpr, 0, len(q.selectors))
+		for _, matchers := range q.selectors {
+			if err := validateMatchers(matchers); err != nil {
+				return nil, 0, err
+			}
+			ors = append(ors, sqlAnd(r.seriesConds(matchers, q.start/1000, q.end/1000)))
+		}
+		b.Where(sqlOr(ors))
+	}
+	if limit > 0 {
+		b.Limit(limit + 1)
+	}
+	return r.withTimeout(b), limit, nil
+}
+
+func (r *promReader) queryStrings(ctx context.Context, b *selectBuilder, limit int) ([]string, bool, error) {
+	sqlStr := b.String()
+	elog.Debug("labels", l.S("sql", sqlStr))
+
+	ctx, cancel := r.readContext(ctx)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, sqlStr)
+	if err != nil {
+		return nil, false, r.timeoutError(ctx, err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			return nil, false, err
+		}
+		out = append(out, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, false, r.timeoutError(ctx, err)
+	}
+	if limit > 0 && len(out) > limit {
+		return out[:limit], true, nil
+	}
+	return out, false, nil
+}
+
+// handleLabels 返回匹配序列的标签名，与prometheus的/api/v1/labels一致
+func (c *Component) handleLabels(ctx *gin.Context) {
+	q, ok := c.parseLabelQuery(ctx, false)
+	if !ok {
+		return
+	}
+	names, truncated, err := c.reader.labelNames(ctx.Request.Context(), q)
+	if names == nil {
+		names = []string{}
+	}
+	labelResponse(ctx, names, truncated, err)
+}
+
+// handleLabelValues 返回匹配序列中某个标签的取值，与prometheus的/api/v1/label/<name>/values一致
+func (c *Component) handleLabelValues(ctx *gin.Context) {
+	q, ok := c.parseLabelQuery(ctx, false)
+	if !ok {
+		return
+	}
+	name := ctx.Param("name")
+	if !model.LabelName(name).IsValid() {
+		apiError(ctx, errorBadData, fmt.Errorf("invalid label name: %q", name))
+		return
+	}
+	values, truncated, err := c.reader.labelValues(ctx.Request.Context(), name, q)
+	if values == nil {
+		values = []string{}
+	}
+	labelResponse(ctx, values, truncated, err)
+}
+
+// handleSeries 返回匹配序列的标签集合，与prometheus的/api/v1/series一致
+func (c *Component) handleSeries(ctx *gin.Context) {
+	q, ok := c.parseLabelQuery(ctx, true)
+	if !ok {
+		return
+	}
+	series, truncated, err := c.reader.series(ctx.Request.Context(), q)
+	data := make([]map[string]string, 0, len(series))
+	for _, tags := range series {
+		metric := make(map[string]string, len(tags))
+		for _, lb := range makeLabels(tags) {
+			metric[lb.Name] = lb.Value
+		}
+		data = append(data, metric)
+	}
+	labelResponse(ctx, data, truncated, err)
+}
+
+// parseLabelQuery reads match[], start, end and limit, writing the error response when they are invalid
+func (c *Component) parseLabelQuery(ctx *gin.Context, needMatch bool) (labelQuery, bool) {
+	var (
+		q   labelQuery
+		err error
+	)
+	if err = ctx.Request.ParseForm(); err != nil {
+		apiError(ctx, errorBadData, err)
+		return q, false
+	}
+	if matches := ctx.Request.Form["match[]"]; len(matches) > 0 || needMatch {
+		if q.selectors, err = parseSelectors(matches); err != nil {
+			apiError(ctx, errorBadData, err)
+			return q, false
+		}
+	}
+	end, err := parseTime(ctx.Request.FormValue("end"), time.Now())
+	if err != nil {
+		apiError(ctx, errorBadData, fmt.Errorf("invalid parameter \"end\": %w", err))
+		return q, false
+	}
+	start, err := parseTime(ctx.Request.FormValue("start"), end.Add(-c.config.LabelLookback))
+	if err != nil {
+		apiError(ctx, errorBadData, fmt.Errorf("invalid parameter \"start\": %w", err))
+		return q, false
+	}
+	if end.Before(start) {
+		apiError(ctx, errorBadData, fmt.Errorf("end timestamp must not be before start time"))
+		return q, false
+	}
+	q.start, q.end = start.UnixMilli(), end.UnixMilli()
+	if s := ctx.Request.FormValue("limit"); s != "" {
+		if q.limit, err = strconv.Atoi(s); err != nil || q.limit < 0 {
+			apiError(ctx, errorBadData, fmt.Errorf("invalid parameter \"limit\": %q", s))
+			return q, false
+		}
+	}
+	return q, true
+}
+
+func labelResponse(ctx *gin.Context, data interface{}, truncated bool, err error) {
+	if err != nil {
+		elog.Error("labels", l.E(err))
+		switch {
+		case errors.Is(err, errQueryLimit):
+			apiError(ctx, errorExec, err)
+		case ctx.Request.Context().Err() != nil:
+			apiError(ctx, errorCanceled, err)
+		default:
+			apiError(ctx, errorInternal, err)
+		}
+		return
+	}
+	resp := apiResponse{Status: "success", Data: data}
+	if truncated {
+		resp.Warnings = []string{errTruncated.Error()}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
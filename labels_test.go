@@ -0,0 +1,99 @@
+package prom2click
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelSQL(t *testing.T) {
+	conf := DefaultConfig()
+	conf.LabelMaxResults = 100
+	r := &promReader{conf: conf}
+	selectors, err := parseSelectors([]string{`up{job="a"}`, `node_load1`})
+	assert.NoError(t, err)
+
+	b, limit, err := r.labelSelect(labelQuery{selectors: selectors, start: 1000000, end: 2000000, limit: 10}, labelColumn("job"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, limit)
+	assert.Equal(t, "SELECT DISTINCT substring(arrayFirst(x -> startsWith(x, 'job='), tags), 5) FROM `metrics`.`samples` "+
+		"WHERE (date >= toDate(1000)) AND (ts >= toDateTime(1000)) AND (ts <= toDateTime(2000)) "+
+		"AND (((has(tags, 'job=a')) AND (name = 'up')) OR ((name = 'node_load1'))) LIMIT 11", b.String())
+
+	_, limit, err = r.labelSelect(labelQuery{end: 1000, limit: 1000}, "tags")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, limit)
+
+	_, _, err = r.labelSelect(labelQuery{start: 2000, end: 1000}, "tags")
+	assert.Error(t, err)
+}
+
+func TestLabelEndpoints(t *testing.T) {
+	conf := DefaultConfig()
+	var queries []string
+	db := openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		queries = append(queries, query)
+		switch {
+		case strings.HasPrefix(query, "SELECT DISTINCT tags"):
+			return [][]driver.Value{
+				{[]string{"__name__=up", "job=a"}},
+				{[]string{"__name__=up", "job=b"}},
+			}, nil
+		case strings.Contains(query, " AS label "):
+			return [][]driver.Value{{"__name__"}, {"instance"}, {"job"}}, nil
+		}
+		return [][]driver.Value{{"a"}, {"b"}}, nil
+	})
+	r := &promReader{conf: conf, db: db, metrics: newReaderMetrics(conf)}
+	cmp := &Component{Engine: gin.New(), config: conf, reader: r}
+	cmp.route()
+
+	code, resp, _ := servePromQL(cmp, http.MethodGet, "/api/v1/labels", url.Values{"start": {"0"}, "end": {"3600"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"__name__", "instance", "job"}, resp.Data)
+	assert.Contains(t, queries[0], "ORDER BY label LIMIT 10001")
+
+	code, resp, _ = servePromQL(cmp, http.MethodGet, "/api/v1/label/job/values", url.Values{"match[]": {"up"}, "limit": {"1"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"a"}, resp.Data)
+	assert.Equal(t, []string{"results truncated due to limit"}, resp.Warnings)
+	assert.Contains(t, queries[1], "(name = 'up')")
+	assert.Contains(t, queries[1], "ORDER BY value LIMIT 2")
+
+	code, resp, _ = servePromQL(cmp, http.MethodPost, "/api/v1/series", url.Values{"match[]": {"up"}, "start": {"0"}, "end": {"60"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"__name__": "up", "job": "a"},
+		map[string]interface{}{"__name__": "up", "job": "b"},
+	}, resp.Data)
+	assert.Nil(t, resp.Warnings)
+
+	for _, tc := range []struct {
+		path   string
+		params url.Values
+	}{
+		{"/api/v1/series", url.Values{}},
+		{"/api/v1/series", url.Values{"match[]": {"up{"}}},
+		{"/api/v1/labels", url.Values{"start": {"60"}, "end": {"0"}}},
+		{"/api/v1/labels", url.Values{"limit": {"-1"}}},
+		{"/api/v1/label/a-b/values", url.Values{}},
+	} {
+		code, resp, _ = servePromQL(cmp, http.MethodGet, tc.path, tc.params)
+		assert.Equal(t, http.StatusBadRequest, code, tc.path, tc.params)
+		assert.Equal(t, errorBadData, resp.ErrorType, tc.path, tc.params)
+	}
+
+	// the promql engine gets label names and values through the queryable
+	qr, err := (&queryable{reader: r}).Querier(context.Background(), 0, 60000)
+	assert.NoError(t, err)
+	names, warnings, err := qr.LabelNames()
+	assert.NoError(t, err)
+	assert.Nil(t, warnings)
+	assert.Equal(t, []string{"__name__", "instance", "job"}, names)
+}
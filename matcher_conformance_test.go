@@ -0,0 +1,102 @@
+package prom2click
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+// evalLabelCond evaluates c on one row the way clickhouse evaluates c.sql()
+func evalLabelCond(t *testing.T, c labelCond, name string, tags []string) bool {
+	if c.usesHas() {
+		// has(tags, 'k=v')
+		has := false
+		for _, tag := range tags {
+			has = has || tag == c.tag()
+		}
+		return has != (c.typ == prompb.LabelMatcher_NEQ)
+	}
+	column := name
+	if c.name != "__name__" {
+		// substring(arrayFirst(x -> startsWith(x, 'k='), tags), len('k=') + 1), arrayFirst gives '' when nothing matches
+		column = ""
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, c.name+"=") {
+				column = tag[len(c.name)+1:]
+				break
+			}
+		}
+	}
+	// clickhouse lets . match line breaks by default
+	re, err := regexp.Compile("(?s)" + c.value)
+	switch c.typ {
+	case prompb.LabelMatcher_EQ:
+		return column == c.value
+	case prompb.LabelMatcher_NEQ:
+		return column != c.value
+	case prompb.LabelMatcher_RE:
+		assert.NoError(t, err)
+		return re.MatchString(column)
+	default:
+		assert.NoError(t, err)
+		return !re.MatchString(column)
+	}
+}
+
+// TestMatcherConformance checks the translated matchers select exactly the series prometheus selects
+func TestMatcherConformance(t *testing.T) {
+	series := [][]prompb.Label{
+		{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}, {Name: "instance", Value: "a:9090"}},
+		{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api-canary"}},
+		{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "b"}},
+		{{Name: "__name__", Value: "go_gc"}, {Name: "job", Value: ""}, {Name: "env", Value: "prod"}},
+		{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a|b"}},
+		{{Name: "__name__", Value: "up"}, {Name: "job", Value: "line\nbreak"}},
+		{{Name: "__name__", Value: "node_load1"}, {Name: "jobx", Value: "api"}},
+		{{Name: "__name__", Value: "node_load1"}, {Name: "job", Value: "x=y"}},
+	}
+	names := []string{"__name__", "job", "instance", "missing"}
+	values := []string{
+		"", "api", "up", "a|b", "x=y", "line\nbreak",
+		"api.*", ".*", ".+", "api|up", "^api$", "ap", "a.*|", "line.break", "(?s)line.break", "node_.*", "a:.*", "[^=]*",
+	}
+	types := []prompb.LabelMatcher_Type{
+		prompb.LabelMatcher_EQ, prompb.LabelMatcher_NEQ, prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE,
+	}
+
+	for _, typ := range types {
+		for _, name := range names {
+			for _, value := range values {
+				m := &prompb.LabelMatcher{Type: typ, Name: name, Value: value}
+				assert.NoError(t, validateMatchers([]*prompb.LabelMatcher{m}))
+				want, err := labels.NewMatcher(labels.MatchType(typ), name, value)
+				assert.NoError(t, err)
+				c := newLabelCond(m)
+				for _, s := range series {
+					rowName, tags := seriesTags(s)
+					lset := labels.Labels{}
+					for _, l := range s {
+						lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+					}
+					assert.Equal(t, want.Matches(lset.Get(name)), evalLabelCond(t, c, rowName, tags),
+						"%s %s %q on %v: %s", name, typ, value, s, c.sql())
+				}
+			}
+		}
+	}
+}
+
+func TestValidateMatchers(t *testing.T) {
+	assert.NoError(t, validateMatchers([]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "job", Value: "a.*"}}))
+	assert.Error(t, validateMatchers([]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "job", Value: "("}}))
+
+	r := &promReader{conf: DefaultConfig()}
+	_, err := r.getSQL(&prompb.Query{EndTimestampMs: 1000, Matchers: []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_NRE, Name: "job", Value: "a["},
+	}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,210 @@
+package prom2click
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pipeline stages observed by stageDuration
+const (
+	stageDecode  = "decode"
+	stageEnqueue = "enqueue"
+	stageInsert  = "insert"
+	stageCommit  = "commit"
+)
+
+// reasons for which samples are dropped
+const (
+	dropReasonBegin   = "begin"
+	dropReasonPrepare = "prepare"
+	dropReasonExec    = "exec"
+	dropReasonCommit  = "commit"
+	dropReasonRelabel = "relabel"
+	dropReasonClosed  = "closed"
+)
+
+var metricLabels = []string{"host", "port"}
+
+// collectors are registered once for the process and partitioned by host/port,
+// so several components (see LoadBatch) can share them without colliding
+var (
+	receivedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "received_samples_total",
+		Help: "Total number of received samples.",
+	}, metricLabels)
+
+	sentSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sent_samples_total",
+		Help: "Total number of processed samples sent to remote storage.",
+	}, metricLabels)
+
+	failedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "failed_samples_total",
+		Help: "Total number of processed samples which failed on send to remote storage.",
+	}, metricLabels)
+
+	droppedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dropped_samples_total",
+		Help: "Total number of samples dropped before reaching remote storage, by reason.",
+	}, append(metricLabels, "reason"))
+
+	testSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_remote_storage_sent_batch_duration_seconds_bucket_test",
+		Help: "Test metric to ensure backfilled metrics are readable via prometheus.",
+	}, metricLabels)
+
+	sentBatchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sent_batch_duration_seconds",
+		Help:    "Duration of sample batch send calls to the remote storage.",
+		Buckets: prometheus.DefBuckets,
+	}, metricLabels)
+
+	sentBatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sent_batch_size_samples",
+		Help:    "Number of samples in each batch sent to the remote storage.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 9),
+	}, metricLabels)
+
+	stageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pipeline_stage_duration_seconds",
+		Help:    "Duration of each write pipeline stage (decode, enqueue, insert, commit).",
+		Buckets: prometheus.DefBuckets,
+	}, append(metricLabels, "stage"))
+
+	queueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "queue_length_samples",
+		Help: "Number of samples waiting in the writer queue.",
+	}, metricLabels)
+
+	queueCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "queue_capacity_samples",
+		Help: "Capacity of the writer queue.",
+	}, metricLabels)
+
+	readQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "read_query_duration_seconds",
+		Help:    "Duration of remote read queries against clickhouse.",
+		Buckets: prometheus.DefBuckets,
+	}, metricLabels)
+
+	readQuerySeries = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "read_query_series",
+		Help:    "Number of series returned by each remote read query.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 9),
+	}, metricLabels)
+
+	readCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "read_cache_requests_total",
+		Help: "Total number of time ranges looked up in the read cache, by result.",
+	}, append(metricLabels, "result"))
+)
+
+func init() {
+	prometheus.MustRegister(
+		receivedSamples,
+		sentSamples,
+		failedSamples,
+		droppedSamples,
+		testSamples,
+		sentBatchDuration,
+		sentBatchSize,
+		stageDuration,
+		queueLength,
+		queueCapacity,
+		readQueryDuration,
+		readQuerySeries,
+		readCacheRequests,
+	)
+}
+
+// writerMetrics holds the collectors of one writer, curried with its host/port
+type writerMetrics struct {
+	rx            prometheus.Counter
+	tx            prometheus.Counter
+	ko            prometheus.Counter
+	test          prometheus.Counter
+	timings       prometheus.Observer
+	batchSize     prometheus.Observer
+	queueLength   prometheus.Gauge
+	queueCapacity prometheus.Gauge
+	dropped       *prometheus.CounterVec
+	stages        prometheus.ObserverVec
+}
+
+func newWriterMetrics(conf *config) *writerMetrics {
+	labels := prometheus.Labels{"host": conf.Host, "port": strconv.Itoa(conf.Port)}
+	return &writerMetrics{
+		rx:            receivedSamples.With(labels),
+		tx:            sentSamples.With(labels),
+		ko:            failedSamples.With(labels),
+		test:          testSamples.With(labels),
+		timings:       sentBatchDuration.With(labels),
+		batchSize:     sentBatchSize.With(labels),
+		queueLength:   queueLength.With(labels),
+		queueCapacity: queueCapacity.With(labels),
+		dropped:       droppedSamples.MustCurryWith(labels),
+		stages:        stageDuration.MustCurryWith(labels),
+	}
+}
+
+// drop records n samples lost for the given reason
+func (m *writerMetrics) drop(reason string, n int) {
+	m.ko.Add(float64(n))
+	m.dropped.WithLabelValues(reason).Add(float64(n))
+}
+
+// stage records the duration in seconds of one pipeline stage
+func (m *writerMetrics) stage(stage string, seconds float64) {
+	m.stages.WithLabelValues(stage).Observe(seconds)
+}
+
+// readerMetrics holds the collectors of one reader, curried with its host/port
+type readerMetrics struct {
+	duration prometheus.Observer
+	series   prometheus.Observer
+	cache    *prometheus.CounterVec
+}
+
+func newReaderMetrics(conf *config) *readerMetrics {
+	labels := prometheus.Labels{"host": conf.Host, "port": strconv.Itoa(conf.Port)}
+	return &readerMetrics{
+		duration: readQueryDuration.With(labels),
+		series:   readQuerySeries.With(labels),
+		cache:    readCacheRequests.MustCurryWith(labels),
+	}
+}
+
+// rebindMetrics moves the collectors of w and r to the port of conf, a configured port 0 is only known
+// once the listener is bound. The series of the former port are deleted.
+func rebindMetrics(conf *config, formerPort int, w *promWriter, r *promReader) {
+	labels := prometheus.Labels{"host": conf.Host, "port": strconv.Itoa(formerPort)}
+	for _, vec := range []interface{ Delete(prometheus.Labels) bool }{
+		receivedSamples, sentSamples, failedSamples, testSamples, sentBatchDuration, sentBatchSize,
+		queueLength, queueCapacity, readQueryDuration, readQuerySeries,
+	} {
+		vec.Delete(labels)
+	}
+	for _, reason := range []string{dropReasonBegin, dropReasonPrepare, dropReasonExec, dropReasonCommit, dropReasonRelabel, dropReasonClosed} {
+		droppedSamples.Delete(withLabel(labels, "reason", reason))
+	}
+	for _, stage := range []string{stageDecode, stageEnqueue, stageInsert, stageCommit} {
+		stageDuration.Delete(withLabel(labels, "stage", stage))
+	}
+	for _, result := range []string{"hit", "miss"} {
+		readCacheRequests.Delete(withLabel(labels, "result", result))
+	}
+
+	w.metrics = newWriterMetrics(conf)
+	w.metrics.queueCapacity.Set(float64(cap(w.requests)))
+	r.metrics = newReaderMetrics(conf)
+}
+
+// withLabel returns a copy of labels with name set to value
+func withLabel(labels prometheus.Labels, name, value string) prometheus.Labels {
+	out := prometheus.Labels{name: value}
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
@@ -9,8 +9,8 @@ import (
 
 func TestInterceptor(t *testing.T) {
 	comp := DefaultContainer().Build()
-	// healthcheck，默认中间件，监控中间件
-	assert.Equal(t, 3, len(comp.Handlers))
+	// 默认中间件，监控中间件
+	assert.Equal(t, 2, len(comp.Handlers))
 }
 
 func TestWithTrustedPlatform(t *testing.T) {
@@ -0,0 +1,447 @@
+package prom2click
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpUnits maps UCUM units to the prometheus unit suffix
+var otlpUnits = map[string]string{
+	"d":    "days",
+	"h":    "hours",
+	"min":  "minutes",
+	"s":    "seconds",
+	"ms":   "milliseconds",
+	"us":   "microseconds",
+	"ns":   "nanoseconds",
+	"By":   "bytes",
+	"KiBy": "kibibytes",
+	"MiBy": "mebibytes",
+	"GiBy": "gibibytes",
+	"TiBy": "tibibytes",
+	"KBy":  "kilobytes",
+	"MBy":  "megabytes",
+	"GBy":  "gigabytes",
+	"TBy":  "terabytes",
+	"m":    "meters",
+	"V":    "volts",
+	"A":    "amperes",
+	"J":    "joules",
+	"W":    "watts",
+	"g":    "grams",
+	"Cel":  "celsius",
+	"Hz":   "hertz",
+	"%":    "percent",
+}
+
+// otlpPerUnits maps UCUM units used as denominator (after '/') to their prometheus name
+var otlpPerUnits = map[string]string{
+	"s":  "second",
+	"m":  "minute",
+	"h":  "hour",
+	"d":  "day",
+	"w":  "week",
+	"mo": "month",
+	"y":  "year",
+}
+
+// otlpConverter converts OTLP metrics to prometheus series,
+// delta sums and histograms are accumulated into cumulative values per series
+type otlpConverter struct {
+	mu         sync.Mutex
+	cumulative map[string]*otlpTotal
+	// ttl is how long the total of a series is kept without updates, 0 keeps them forever
+	ttl       time.Duration
+	lastEvict time.Time
+}
+
+// otlpTotal is the running total of a delta series
+type otlpTotal struct {
+	value   float64
+	updated time.Time
+}
+
+func newOTLPConverter(ttl time.Duration) *otlpConverter {
+	return &otlpConverter{cumulative: make(map[string]*otlpTotal), ttl: ttl, lastEvict: time.Now()}
+}
+
+// handleOTLPWrite 处理OTLP/HTTP metrics写入请求，支持protobuf与json编码
+func (c *Component) handleOTLPWrite(ctx *gin.Context) {
+	tstart := time.Now()
+	body, err := requestBody(ctx)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	defer body.Close()
+	buf, err := io.ReadAll(body)
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	otlpReq := &colmetricpb.ExportMetricsServiceRequest{}
+	isJSON := strings.HasPrefix(ctx.ContentType(), "application/json")
+	if isJSON {
+		err = protojson.Unmarshal(buf, otlpReq)
+	} else {
+		err = proto.Unmarshal(buf, otlpReq)
+	}
+	if err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.writer.metrics.stage(stageDecode, time.Since(tstart).Seconds())
+	c.writer.process(c.otlp.convert(otlpReq))
+
+	resp := &colmetricpb.ExportMetricsServiceResponse{}
+	if isJSON {
+		buf, err = protojson.Marshal(resp)
+	} else {
+		buf, err = proto.Marshal(resp)
+	}
+	if err != nil {
+		ctx.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx.Data(http.StatusOK, ctx.ContentType(), buf)
+}
+
+// convert translates an export request into a remote write request
+func (o *otlpConverter) convert(req *colmetricpb.ExportMetricsServiceRequest) *prompb.WriteRequest {
+	out := &prompb.WriteRequest{}
+	for _, rm := range req.GetResourceMetrics() {
+		resource := otlpResourceLabels(rm.GetResource().GetAttributes())
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				out.Timeseries = append(out.Timeseries, o.convertMetric(m, resource)...)
+			}
+		}
+		for _, ilm := range rm.GetInstrumentationLibraryMetrics() {
+			for _, m := range ilm.GetMetrics() {
+				out.Timeseries = append(out.Timeseries, o.convertMetric(m, resource)...)
+			}
+		}
+	}
+	return out
+}
+
+func (o *otlpConverter) convertMetric(m *metricpb.Metric, resource []prompb.Label) []prompb.TimeSeries {
+	var series []prompb.TimeSeries
+	switch {
+	case m.GetGauge() != nil:
+		name := otlpMetricName(m.GetName(), m.GetUnit(), false, true)
+		for _, p := range m.GetGauge().GetDataPoints() {
+			series = append(series, otlpSample(name, p.GetAttributes(), resource, nil, numberValue(p), p.GetTimeUnixNano(), p.GetFlags()))
+		}
+	case m.GetSum() != nil:
+		sum := m.GetSum()
+		monotonic := sum.GetIsMonotonic()
+		delta := sum.GetAggregationTemporality() == metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		name := otlpMetricName(m.GetName(), m.GetUnit(), monotonic, !monotonic)
+		for _, p := range sum.GetDataPoints() {
+			ts := otlpSample(name, p.GetAttributes(), resource, nil, numberValue(p), p.GetTimeUnixNano(), p.GetFlags())
+			// a non monotonic delta can not be turned into a meaningful cumulative value, keep it as gauge
+			if delta && monotonic {
+				o.accumulate(&ts)
+			}
+			series = append(series, ts)
+		}
+	case m.GetHistogram() != nil:
+		h := m.GetHistogram()
+		delta := h.GetAggregationTemporality() == metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		name := otlpMetricName(m.GetName(), m.GetUnit(), false, false)
+		for _, p := range h.GetDataPoints() {
+			buckets := make([]otlpBucket, 0, len(p.GetBucketCounts()))
+			var cum uint64
+			for i, cnt := range p.GetBucketCounts() {
+				cum += cnt
+				bound := math.Inf(1)
+				if i < len(p.GetExplicitBounds()) {
+					bound = p.GetExplicitBounds()[i]
+				}
+				buckets = append(buckets, otlpBucket{upper: bound, count: cum})
+			}
+			series = append(series, o.histogramSeries(name, p.GetAttributes(), resource, buckets,
+				p.GetSum(), p.GetCount(), p.GetTimeUnixNano(), p.GetFlags(), delta)...)
+		}
+	case m.GetExponentialHistogram() != nil:
+		h := m.GetExponentialHistogram()
+		delta := h.GetAggregationTemporality() == metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		name := otlpMetricName(m.GetName(), m.GetUnit(), false, false)
+		for _, p := range h.GetDataPoints() {
+			series = append(series, o.histogramSeries(name, p.GetAttributes(), resource, exponentialBuckets(p),
+				p.GetSum(), p.GetCount(), p.GetTimeUnixNano(), p.GetFlags(), delta)...)
+		}
+	case m.GetSummary() != nil:
+		name := otlpMetricName(m.GetName(), m.GetUnit(), false, false)
+		for _, p := range m.GetSummary().GetDataPoints() {
+			for _, q := range p.GetQuantileValues() {
+				extra := []prompb.Label{{Name: model.QuantileLabel, Value: formatFloat(q.GetQuantile())}}
+				series = append(series, otlpSample(name, p.GetAttributes(), resource, extra, q.GetValue(), p.GetTimeUnixNano(), p.GetFlags()))
+			}
+			series = append(series,
+				otlpSample(name+"_sum", p.GetAttributes(), resource, nil, p.GetSum(), p.GetTimeUnixNano(), p.GetFlags()),
+				otlpSample(name+"_count", p.GetAttributes(), resource, nil, float64(p.GetCount()), p.GetTimeUnixNano(), p.GetFlags()),
+			)
+		}
+	}
+	return series
+}
+
+// otlpBucket is a cumulative histogram bucket
+type otlpBucket struct {
+	upper float64
+	count uint64
+}
+
+// histogramSeries expands a histogram data point into _bucket, _sum and _count series
+func (o *otlpConverter) histogramSeries(name string, attrs []*commonpb.KeyValue, resource []prompb.Label,
+	buckets []otlpBucket, sum float64, count uint64, tsNano uint64, flags uint32, delta bool) []prompb.TimeSeries {
+	series := make([]prompb.TimeSeries, 0, len(buckets)+3)
+	hasInf := false
+	for _, b := range buckets {
+		if math.IsInf(b.upper, 1) {
+			hasInf = true
+			b.count = count
+		}
+		extra := []prompb.Label{{Name: model.BucketLabel, Value: formatFloat(b.upper)}}
+		series = append(series, otlpSample(name+"_bucket", attrs, resource, extra, float64(b.count), tsNano, flags))
+	}
+	if !hasInf {
+		extra := []prompb.Label{{Name: model.BucketLabel, Value: "+Inf"}}
+		series = append(series, otlpSample(name+"_bucket", attrs, resource, extra, float64(count), tsNano, flags))
+	}
+	series = append(series,
+		otlpSample(name+"_sum", attrs, resource, nil, sum, tsNano, flags),
+		otlpSample(name+"_count", attrs, resource, nil, float64(count), tsNano, flags),
+	)
+	if delta {
+		for i := range series {
+			o.accumulate(&series[i])
+		}
+	}
+	return series
+}
+
+// exponentialBuckets converts exponential buckets into cumulative buckets with explicit upper bounds,
+// bucket index i covers (base^i, base^(i+1)] with base = 2^(2^-scale)
+func exponentialBuckets(p *metricpb.ExponentialHistogramDataPoint) []otlpBucket {
+	base := math.Pow(2, math.Pow(2, -float64(p.GetScale())))
+	var buckets []otlpBucket
+	var cum uint64
+	neg := p.GetNegative()
+	// negative buckets mirror the positive ones, walk them from the most negative upwards
+	for i := len(neg.GetBucketCounts()) - 1; i >= 0; i-- {
+		cum += neg.GetBucketCounts()[i]
+		idx := int(neg.GetOffset()) + i
+		buckets = append(buckets, otlpBucket{upper: -math.Pow(base, float64(idx)), count: cum})
+	}
+	cum += p.GetZeroCount()
+	buckets = append(buckets, otlpBucket{upper: 0, count: cum})
+	pos := p.GetPositive()
+	for i, cnt := range pos.GetBucketCounts() {
+		cum += cnt
+		idx := int(pos.GetOffset()) + i
+		buckets = append(buckets, otlpBucket{upper: math.Pow(base, float64(idx+1)), count: cum})
+	}
+	return buckets
+}
+
+// accumulate adds the sample value to the running total of its series
+func (o *otlpConverter) accumulate(ts *prompb.TimeSeries) {
+	if len(ts.Samples) == 0 || value.IsStaleNaN(ts.Samples[0].Value) {
+		return
+	}
+	key := labelsKey(ts.Labels)
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	total, ok := o.cumulative[key]
+	if !ok {
+		total = &otlpTotal{}
+		o.cumulative[key] = total
+	}
+	total.value += ts.Samples[0].Value
+	total.updated = now
+	ts.Samples[0].Value = total.value
+	// sweep at most once per ttl so a batch does not scan every series
+	if o.ttl > 0 && now.Sub(o.lastEvict) >= o.ttl {
+		o.evict(now)
+	}
+}
+
+// evict drops the totals not updated within the ttl, a series coming back starts again from zero
+// like a restarted counter. The caller holds o.mu.
+func (o *otlpConverter) evict(now time.Time) {
+	for key, total := range o.cumulative {
+		if now.Sub(total.updated) > o.ttl {
+			delete(o.cumulative, key)
+		}
+	}
+	o.lastEvict = now
+}
+
+func labelsKey(labels []prompb.Label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		b.WriteString(l.Value)
+		b.WriteByte('\xff')
+	}
+	return b.String()
+}
+
+func numberValue(p *metricpb.NumberDataPoint) float64 {
+	if v, ok := p.GetValue().(*metricpb.NumberDataPoint_AsInt); ok {
+		return float64(v.AsInt)
+	}
+	return p.GetAsDouble()
+}
+
+// otlpSample builds a one sample series, points flagged with no recorded value become stale markers
+func otlpSample(name string, attrs []*commonpb.KeyValue, resource, extra []prompb.Label, v float64, tsNano uint64, flags uint32) prompb.TimeSeries {
+	labels := make([]prompb.Label, 0, len(attrs)+len(resource)+len(extra)+1)
+	seen := make(map[string]struct{}, cap(labels))
+	add := func(l prompb.Label) {
+		if l.Value == "" {
+			return
+		}
+		if _, ok := seen[l.Name]; ok {
+			return
+		}
+		seen[l.Name] = struct{}{}
+		labels = append(labels, l)
+	}
+	add(prompb.Label{Name: model.MetricNameLabel, Value: name})
+	for _, l := range extra {
+		add(l)
+	}
+	for _, kv := range attrs {
+		add(prompb.Label{Name: sanitizeLabelName(kv.GetKey()), Value: anyValueString(kv.GetValue())})
+	}
+	for _, l := range resource {
+		add(l)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	if flags&uint32(metricpb.DataPointFlags_FLAG_NO_RECORDED_VALUE) != 0 {
+		v = math.Float64frombits(value.StaleNaN)
+	}
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: v, Timestamp: int64(tsNano / uint64(time.Millisecond))}},
+	}
+}
+
+// otlpResourceLabels derives job and instance from the service resource attributes
+func otlpResourceLabels(attrs []*commonpb.KeyValue) []prompb.Label {
+	var name, namespace, instance string
+	for _, kv := range attrs {
+		switch kv.GetKey() {
+		case "service.name":
+			name = anyValueString(kv.GetValue())
+		case "service.namespace":
+			namespace = anyValueString(kv.GetValue())
+		case "service.instance.id":
+			instance = anyValueString(kv.GetValue())
+		}
+	}
+	var labels []prompb.Label
+	if name != "" {
+		if namespace != "" {
+			name = namespace + "/" + name
+		}
+		labels = append(labels, prompb.Label{Name: model.JobLabel, Value: name})
+	}
+	if instance != "" {
+		labels = append(labels, prompb.Label{Name: model.InstanceLabel, Value: instance})
+	}
+	return labels
+}
+
+func anyValueString(v *commonpb.AnyValue) string {
+	switch x := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return x.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(x.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(x.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return formatFloat(x.DoubleValue)
+	case *commonpb.AnyValue_BytesValue:
+		return string(x.BytesValue)
+	case *commonpb.AnyValue_ArrayValue, *commonpb.AnyValue_KvlistValue:
+		buf, _ := protojson.Marshal(v)
+		return string(buf)
+	}
+	return ""
+}
+
+// otlpMetricName applies the OTLP to prometheus naming translation:
+// sanitize, append the unit suffix, "_total" for monotonic sums and "_ratio" for unit "1" on gauges
+func otlpMetricName(name, unit string, monotonic, gauge bool) string {
+	parts := strings.FieldsFunc(sanitizeMetricName(name), func(r rune) bool { return r == '_' })
+	mainUnit, perUnit := unit, ""
+	if i := strings.Index(unit, "/"); i >= 0 {
+		mainUnit, perUnit = unit[:i], unit[i+1:]
+	}
+	if !strings.ContainsAny(mainUnit, "{}") && mainUnit != "1" && mainUnit != "" {
+		if u, ok := otlpUnits[mainUnit]; ok {
+			mainUnit = u
+		}
+		parts = appendSuffix(parts, strings.FieldsFunc(sanitizeMetricName(mainUnit), func(r rune) bool { return r == '_' })...)
+	}
+	if perUnit != "" && !strings.ContainsAny(perUnit, "{}") {
+		if u, ok := otlpPerUnits[perUnit]; ok {
+			perUnit = u
+		}
+		parts = appendSuffix(parts, "per", sanitizeMetricName(perUnit))
+	}
+	if gauge && unit == "1" {
+		parts = appendSuffix(parts, "ratio")
+	}
+	if monotonic {
+		parts = removeSuffix(parts, "total")
+		parts = append(parts, "total")
+	}
+	return strings.Join(parts, "_")
+}
+
+// appendSuffix appends suffix unless parts already end with it
+func appendSuffix(parts []string, suffix ...string) []string {
+	if len(parts) >= len(suffix) {
+		tail := parts[len(parts)-len(suffix):]
+		if strings.Join(tail, "_") == strings.Join(suffix, "_") {
+			return parts
+		}
+	}
+	return append(parts, suffix...)
+}
+
+func removeSuffix(parts []string, suffix string) []string {
+	if len(parts) > 0 && parts[len(parts)-1] == suffix {
+		return parts[:len(parts)-1]
+	}
+	return parts
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
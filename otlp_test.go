@@ -0,0 +1,165 @@
+package prom2click
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPMetricName(t *testing.T) {
+	tests := []struct {
+		name      string
+		unit      string
+		monotonic bool
+		gauge     bool
+		want      string
+	}{
+		{name: "http.server.duration", unit: "ms", want: "http_server_duration_milliseconds"},
+		{name: "system.memory.usage", unit: "By", gauge: true, want: "system_memory_usage_bytes"},
+		{name: "requests", unit: "{request}", monotonic: true, want: "requests_total"},
+		{name: "requests_total", unit: "1", monotonic: true, want: "requests_total"},
+		{name: "cpu.utilization", unit: "1", gauge: true, want: "cpu_utilization_ratio"},
+		{name: "network.io", unit: "By/s", gauge: true, want: "network_io_bytes_per_second"},
+		{name: "latency_seconds", unit: "s", want: "latency_seconds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, otlpMetricName(tt.name, tt.unit, tt.monotonic, tt.gauge))
+		})
+	}
+}
+
+func otlpRequest(metrics ...*metricpb.Metric) *colmetricpb.ExportMetricsServiceRequest {
+	return &colmetricpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricpb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				{Key: "service.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "api"}}},
+				{Key: "service.instance.id", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "i-1"}}},
+			}},
+			ScopeMetrics: []*metricpb.ScopeMetrics{{Metrics: metrics}},
+		}},
+	}
+}
+
+func TestOTLPConvertSum(t *testing.T) {
+	attrs := []*commonpb.KeyValue{{Key: "http.method", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "GET"}}}}
+	sum := func(v int64, ts uint64) *metricpb.Metric {
+		return &metricpb.Metric{Name: "requests", Data: &metricpb.Metric_Sum{Sum: &metricpb.Sum{
+			IsMonotonic:            true,
+			AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+			DataPoints: []*metricpb.NumberDataPoint{{
+				Attributes:   attrs,
+				TimeUnixNano: ts,
+				Value:        &metricpb.NumberDataPoint_AsInt{AsInt: v},
+			}},
+		}}}
+	}
+	conv := newOTLPConverter(time.Hour)
+	req := conv.convert(otlpRequest(sum(3, 1e9)))
+	assert.Equal(t, []prompb.TimeSeries{{
+		Labels: []prompb.Label{
+			{Name: "__name__", Value: "requests_total"},
+			{Name: "http_method", Value: "GET"},
+			{Name: "instance", Value: "i-1"},
+			{Name: "job", Value: "api"},
+		},
+		Samples: []prompb.Sample{{Value: 3, Timestamp: 1000}},
+	}}, req.Timeseries)
+
+	// delta points are accumulated into a cumulative counter
+	req = conv.convert(otlpRequest(sum(4, 2e9)))
+	assert.Equal(t, prompb.Sample{Value: 7, Timestamp: 2000}, req.Timeseries[0].Samples[0])
+
+	// totals not updated within the ttl are dropped
+	conv.mu.Lock()
+	conv.evict(time.Now().Add(30 * time.Minute))
+	assert.Len(t, conv.cumulative, 1)
+	conv.evict(time.Now().Add(2 * time.Hour))
+	assert.Empty(t, conv.cumulative)
+	conv.mu.Unlock()
+	req = conv.convert(otlpRequest(sum(4, 3e9)))
+	assert.Equal(t, prompb.Sample{Value: 4, Timestamp: 3000}, req.Timeseries[0].Samples[0])
+}
+
+func TestOTLPConvertHistograms(t *testing.T) {
+	conv := newOTLPConverter(time.Hour)
+	req := conv.convert(otlpRequest(&metricpb.Metric{Name: "latency", Unit: "s", Data: &metricpb.Metric_Histogram{Histogram: &metricpb.Histogram{
+		AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		DataPoints: []*metricpb.HistogramDataPoint{{
+			TimeUnixNano:   1e9,
+			Count:          6,
+			Sum:            proto.Float64(4.5),
+			BucketCounts:   []uint64{1, 2, 3},
+			ExplicitBounds: []float64{0.1, 1},
+		}},
+	}}}))
+	got := map[string]float64{}
+	for _, ts := range req.Timeseries {
+		got[labelsKey(ts.Labels)] = ts.Samples[0].Value
+	}
+	assert.Equal(t, map[string]float64{
+		labelsKey([]prompb.Label{{Name: "__name__", Value: "latency_seconds_bucket"}, {Name: "instance", Value: "i-1"}, {Name: "job", Value: "api"}, {Name: "le", Value: "0.1"}}):  1,
+		labelsKey([]prompb.Label{{Name: "__name__", Value: "latency_seconds_bucket"}, {Name: "instance", Value: "i-1"}, {Name: "job", Value: "api"}, {Name: "le", Value: "1"}}):    3,
+		labelsKey([]prompb.Label{{Name: "__name__", Value: "latency_seconds_bucket"}, {Name: "instance", Value: "i-1"}, {Name: "job", Value: "api"}, {Name: "le", Value: "+Inf"}}): 6,
+		labelsKey([]prompb.Label{{Name: "__name__", Value: "latency_seconds_sum"}, {Name: "instance", Value: "i-1"}, {Name: "job", Value: "api"}}):                                 4.5,
+		labelsKey([]prompb.Label{{Name: "__name__", Value: "latency_seconds_count"}, {Name: "instance", Value: "i-1"}, {Name: "job", Value: "api"}}):                               6,
+	}, got)
+
+	buckets := exponentialBuckets(&metricpb.ExponentialHistogramDataPoint{
+		Scale:     0,
+		ZeroCount: 1,
+		Positive:  &metricpb.ExponentialHistogramDataPoint_Buckets{Offset: 0, BucketCounts: []uint64{2, 3}},
+		Negative:  &metricpb.ExponentialHistogramDataPoint_Buckets{Offset: 1, BucketCounts: []uint64{4}},
+	})
+	assert.Equal(t, []otlpBucket{
+		{upper: -2, count: 4},
+		{upper: 0, count: 5},
+		{upper: 2, count: 7},
+		{upper: 4, count: 10},
+	}, buckets)
+}
+
+func TestOTLPNoRecordedValue(t *testing.T) {
+	ts := otlpSample("up", nil, nil, nil, 1, 1e9, uint32(metricpb.DataPointFlags_FLAG_NO_RECORDED_VALUE))
+	assert.True(t, value.IsStaleNaN(ts.Samples[0].Value))
+	assert.True(t, math.IsNaN(ts.Samples[0].Value))
+}
+
+func TestOTLPWriteRoute(t *testing.T) {
+	cfg := DefaultConfig()
+	cmp := &Component{
+		Engine: gin.New(),
+		config: cfg,
+		otlp:   newOTLPConverter(time.Hour),
+	}
+	var err error
+	cmp.writer, err = NewWriter(cfg)
+	assert.NoError(t, err)
+	cmp.route()
+
+	buf, err := proto.Marshal(otlpRequest(&metricpb.Metric{Name: "temperature", Unit: "Cel", Data: &metricpb.Metric_Gauge{Gauge: &metricpb.Gauge{
+		DataPoints: []*metricpb.NumberDataPoint{{TimeUnixNano: 1e9, Value: &metricpb.NumberDataPoint_AsDouble{AsDouble: 21.5}}},
+	}}}))
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(buf))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	cmp.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	p2c := <-cmp.writer.requests
+	assert.Equal(t, "temperature_celsius", p2c.name)
+	assert.Equal(t, 21.5, p2c.val)
+}
@@ -1,100 +1,212 @@
 package prom2click
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gotomicro/cetus/l"
 	"github.com/gotomicro/ego/core/elog"
-	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 )
 
 type promReader struct {
-	conf *config
-	db   *sql.DB
+	conf    *config
+	db      *sql.DB
+	metrics *readerMetrics
+	cache   *readCache
+	// aggregate downsamples every query of one request, empty for the configured aggregates
+	aggregate string
 }
 
 func NewReader(conf *config) (*promReader, error) {
 	var err error
 	r := new(promReader)
 	r.conf = conf
+	r.metrics = newReaderMetrics(conf)
 	r.db, err = sql.Open("clickhouse", r.conf.ClickhouseDSN)
 	if err != nil {
 		elog.Error("reader", l.E(err))
 		return r, err
 	}
+	if err = conf.setDownsampleRules(); err != nil {
+		elog.Error("reader", l.E(err), l.S("step", "downsample"))
+		return r, err
+	}
+	r.cache, err = newReadCache(conf)
+	if err != nil {
+		elog.Error("reader", l.E(err), l.S("step", "cache"))
+		return r, err
+	}
 
 	return r, nil
 }
 
-func (r *promReader) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
-	var err error
-	var sqlStr string
-	var rows *sql.Rows
-
+// Read answers every query of req with its own QueryResult, in the order of req.Queries.
+// Up to ClickhouseReadConcurrency queries run at the same time.
+func (r *promReader) Read(ctx context.Context, req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
 	resp := prompb.ReadResponse{
-		Results: []*prompb.QueryResult{
-			{Timeseries: make([]*prompb.TimeSeries, 0, 0)},
-		},
+		Results: make([]*prompb.QueryResult, len(req.Queries)),
+	}
+	if len(req.Queries) == 0 {
+		return &resp, nil
+	}
+	errs := make([]error, len(req.Queries))
+
+	concurrency := r.conf.ClickhouseReadConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, q := range req.Queries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, q *prompb.Query) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			resp.Results[i], errs[i] = r.readQuery(ctx, q)
+		}(i, q)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return &resp, err
+	}
+	elog.Debug("reader", l.S("step", "query"), l.I("queries", len(req.Queries)))
+	return &resp, nil
+}
+
+// readQuery returns the series matching one query
+func (r *promReader) readQuery(ctx context.Context, q *prompb.Query) (*prompb.QueryResult, error) {
+	if r.cache != nil {
+		if res, ok, err := r.readCached(ctx, q); ok || err != nil {
+			return res, err
+		}
 	}
-	// need to map tags to timeseries to record samples
-	var tsres = make(map[string]*prompb.TimeSeries)
+	res := &prompb.QueryResult{Timeseries: make([]*prompb.TimeSeries, 0)}
+	// rows are sorted by tags so every series comes back once
+	err := r.querySeries(ctx, q, func(tags []string, samples []prompb.Sample) error {
+		res.Timeseries = append(res.Timeseries, &prompb.TimeSeries{
+			Labels:  makeLabels(tags),
+			Samples: samples,
+		})
+		return nil
+	})
+	return res, err
+}
+
+// querySeries runs one query and calls fn with the samples of every series in time order.
+// Rows are sorted by tags so only the current series is held in memory.
+func (r *promReader) querySeries(ctx context.Context, q *prompb.Query, fn func(tags []string, samples []prompb.Sample) error) error {
+	sqlStr, err := r.getSQL(q)
+	elog.Debug("reader", l.I64("start", q.StartTimestampMs), l.I64("end", q.EndTimestampMs), l.S("sql", sqlStr))
+	if err != nil {
+		elog.Error("reader", l.E(err), l.S("step", "getSQL"))
+		return err
+	}
+	ctx, cancel := r.readContext(ctx)
+	defer cancel()
+	if p, ok := r.pushdownPlan(q); ok {
+		next := fn
+		fn = func(tags []string, samples []prompb.Sample) error {
+			return next(tags, p.markGaps(samples))
+		}
+	}
+	tstart := time.Now()
+	nseries, err := r.querySQL(ctx, sqlStr, fn)
+	if err != nil {
+		return err
+	}
+	r.metrics.duration.Observe(time.Since(tstart).Seconds())
+	r.metrics.series.Observe(float64(nseries))
+	return nil
+}
 
-	// for debugging/figuring out query format/etc
-	rcount := 0
-	for _, q := range req.Queries {
-		// remove me..
-		// get the select sql
-		sqlStr, err = r.getSQL(q)
-		elog.Debug("reader", l.I64("start", q.StartTimestampMs), l.I64("end", q.EndTimestampMs), l.S("sql", sqlStr))
-		if err != nil {
-			elog.Error("reader", l.E(err), l.S("step", "getSQL"))
-			return &resp, err
+// querySQL runs sqlStr and calls fn for every series of the rows, it returns the number of series.
+// The ReadMaxSeries and ReadMaxSamples limits are checked while scanning.
+func (r *promReader) querySQL(ctx context.Context, sqlStr string, fn func(tags []string, samples []prompb.Sample) error) (int, error) {
+	rows, err := r.db.QueryContext(ctx, sqlStr)
+	if err != nil {
+		elog.Error("reader", l.E(err), l.S("step", "query"), l.S("sql", sqlStr))
+		return 0, r.timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	var (
+		nseries int
+		nrows   int
+		current []string
+		samples []prompb.Sample
+	)
+	emit := func() error {
+		if len(samples) == 0 {
+			return nil
 		}
-		rows, err = r.db.Query(sqlStr)
-		if err != nil {
-			elog.Error("reader", l.E(err), l.S("step", "query"), l.S("sql", sqlStr))
-			return &resp, err
+		nseries++
+		err := fn(current, samples)
+		samples = nil
+		return err
+	}
+	for rows.Next() {
+		var (
+			cnt   int
+			t     int64
+			name  string
+			tags  []string
+			value float64
+		)
+		if err = rows.Scan(&cnt, &t, &name, &tags, &value); err != nil {
+			elog.Error("reader", l.S("step", "scan"), l.E(err))
+			return nseries, err
 		}
-		for rows.Next() {
-			rcount++
-			var (
-				cnt   int
-				t     int64
-				name  string
-				tags  []string
-				value float64
-			)
-			if err = rows.Scan(&cnt, &t, &name, &tags, &value); err != nil {
-				elog.Error("reader", l.S("step", "scan"), l.E(err))
+		nrows++
+		if err = r.checkSamples(nrows); err != nil {
+			return nseries, err
+		}
+		if !sameTags(tags, current) {
+			if err = emit(); err != nil {
+				return nseries, err
 			}
-
-			// borrowed from influx remote storage adapter - array sep
-			key := strings.Join(tags, "\xff")
-			ts, ok := tsres[key]
-			if !ok {
-				ts = &prompb.TimeSeries{
-					Labels: makeLabels(tags),
-				}
-				tsres[key] = ts
+			if err = r.checkSeries(nseries + 1); err != nil {
+				return nseries, err
 			}
-			ts.Samples = append(ts.Samples, prompb.Sample{
-				Value:     value,
-				Timestamp: t,
-			})
+			current = tags
+		}
+		// raw samples are stored with second precision,
+		// keep a single one when several fall into the same second
+		if n := len(samples); n > 0 && samples[n-1].Timestamp == t {
+			samples[n-1].Value = value
+			continue
 		}
+		samples = append(samples, prompb.Sample{
+			Value:     value,
+			Timestamp: t,
+		})
 	}
-
-	// now add results to response
-	for _, ts := range tsres {
-		resp.Results[0].Timeseries = append(resp.Results[0].Timeseries, ts)
+	if err = rows.Err(); err != nil {
+		elog.Error("reader", l.S("step", "rows"), l.E(err))
+		return nseries, r.timeoutError(ctx, err)
 	}
-	elog.Debug("reader", l.S("step", "query"), l.I("count", rcount), l.I("queries", len(req.Queries)))
-	return &resp, nil
+	return nseries, emit()
+}
 
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func makeLabels(tags []string) []prompb.Label {
@@ -119,146 +231,107 @@ func makeLabels(tags []string) []prompb.Label {
 }
 
 func (r *promReader) getSQL(query *prompb.Query) (string, error) {
-	// time related select sql, where sql chunks
-	tselectSQL, twhereSQL, err := r.getTimePeriod(query)
+	if err := validateMatchers(query.Matchers); err != nil {
+		return "", err
+	}
+	// time range and aggregation period
+	tstart, tend, taggr, err := r.getTimePeriod(query)
 	if err != nil {
 		return "", err
 	}
+	return r.rangeSQL(query, tstart, tend, r.queryBucket(query, tstart, tend, taggr)), nil
+}
 
-	// match sql chunk
-	var mwhereSQL []string
-	// build an sql statement chunk for each matcher in the query
-	// yeah, this is a bit ugly..
-	for _, m := range query.Matchers {
-		// __name__ is handled specially - match it directly
-		// as it is stored in the name column (it's also in tags as __name__)
-		// note to self: add name to index.. otherwise this will be slow..
-		if m.Name == model.MetricNameLabel {
-			var whereAdd string
-			switch m.Type {
-			case prompb.LabelMatcher_EQ:
-				whereAdd = fmt.Sprintf(` name='%s' `, strings.Replace(m.Value, `'`, `\'`, -1))
-			case prompb.LabelMatcher_NEQ:
-				whereAdd = fmt.Sprintf(` name!='%s' `, strings.Replace(m.Value, `'`, `\'`, -1))
-			case prompb.LabelMatcher_RE:
-				whereAdd = fmt.Sprintf(` match(name, %s) = 1 `, strings.Replace(m.Value, `/`, `\/`, -1))
-			case prompb.LabelMatcher_NRE:
-				whereAdd = fmt.Sprintf(` match(name, %s) = 0 `, strings.Replace(m.Value, `/`, `\/`, -1))
-			}
-			mwhereSQL = append(mwhereSQL, whereAdd)
-			continue
-		}
-
-		switch m.Type {
-		case prompb.LabelMatcher_EQ:
-			var insql bytes.Buffer
-			asql := "arrayExists(x -> x IN (%s), tags) = 1"
-			// value appears to be | sep'd for multiple matches
-			for i, val := range strings.Split(m.Value, "|") {
-				if len(val) < 1 {
-					continue
-				}
-				if i == 0 {
-					istr := fmt.Sprintf(`'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				} else {
-					istr := fmt.Sprintf(`,'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				}
-			}
-
-			wstr := fmt.Sprintf(asql, emptySQLHandling(insql.String()))
-			mwhereSQL = append(mwhereSQL, wstr)
-
-		case prompb.LabelMatcher_NEQ:
-			var insql bytes.Buffer
-			asql := "arrayExists(x -> x IN (%s), tags) = 0"
-			// value appears to be | sep'd for multiple matches
-			for i, val := range strings.Split(m.Value, "|") {
-				if len(val) < 1 {
-					continue
-				}
-				if i == 0 {
-					istr := fmt.Sprintf(`'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				} else {
-					istr := fmt.Sprintf(`,'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
-					insql.WriteString(istr)
-				}
-			}
-
-			wstr := fmt.Sprintf(asql, emptySQLHandling(insql.String()))
-			mwhereSQL = append(mwhereSQL, wstr)
-
-		case prompb.LabelMatcher_RE:
-			asql := `arrayExists(x -> 1 == match(x, '^%s=%s'),tags) = 1`
-			// we can't have ^ in the regexp since keys are stored in arrays of key=value
-			if strings.HasPrefix(m.Value, "^") {
-				val := strings.Replace(m.Value, "^", "", 1)
-				val = strings.Replace(val, `/`, `\/`, -1)
-				mwhereSQL = append(mwhereSQL, fmt.Sprintf(asql, m.Name, val))
-			} else {
-				val := strings.Replace(m.Value, `/`, `\/`, -1)
-				mwhereSQL = append(mwhereSQL, fmt.Sprintf(asql, m.Name, val))
-			}
+// queryBucket returns the size in seconds of the buckets rows of query are aggregated over, 0 for raw samples
+func (r *promReader) queryBucket(query *prompb.Query, tstart, tend, taggr int64) int64 {
+	if p, ok := r.pushdownPlan(query); ok {
+		return p.resolution()
+	}
+	if r.useRaw(query, taggr) {
+		return 0
+	}
+	return taggr
+}
 
-		case prompb.LabelMatcher_NRE:
-			asql := `arrayExists(x -> 1 == match(x, '^%s=%s'),tags) = 0`
-			if strings.HasPrefix(m.Value, "^") {
-				val := strings.Replace(m.Value, "^", "", 1)
-				val = strings.Replace(val, `/`, `\/`, -1)
-				mwhereSQL = append(mwhereSQL, fmt.Sprintf(asql, m.Name, val))
-			} else {
-				val := strings.Replace(m.Value, `/`, `\/`, -1)
-				mwhereSQL = append(mwhereSQL, fmt.Sprintf(asql, m.Name, val))
-			}
-		}
+// rangeSQL returns the sql reading query between tstart and tend seconds with the given bucket,
+// the result of a range is the same whether it is read alone or as part of a larger one
+func (r *promReader) rangeSQL(query *prompb.Query, tstart, tend, bucket int64) string {
+	if b, ok := r.getPushdownSQL(query, tstart, tend); ok {
+		return r.withLimits(b).String()
+	}
+	if bucket == 0 {
+		return r.withLimits(r.rawSelect(query, tstart, tend).OrderBy("tags", "t")).String()
 	}
 
 	// put select and where together with group by etc
-	tempSQL := "%s, name, tags, quantile(%f)(val) as value FROM %s.%s %s AND %s GROUP BY t, name, tags ORDER BY t"
-	sql := fmt.Sprintf(tempSQL, tselectSQL, r.conf.ClickhouseQuantile, r.conf.ClickhouseDB, r.conf.ClickhouseTable, twhereSQL,
-		strings.Join(mwhereSQL, " AND "))
-	return sql, nil
+	return r.withLimits(newSelect(
+		"COUNT() AS CNT",
+		sqlf("(intDiv(toUInt32(ts), ?) * ?) * 1000 AS t", bucket, bucket),
+		"name",
+		"tags",
+		sqlf("? AS value", r.downsampleExpr(query)),
+	).
+		From(r.conf.ClickhouseDB, r.conf.ClickhouseTable).
+		Where(timeRangeConds(tstart, tend)...).
+		Where(r.seriesConds(query.Matchers, tstart, tend)...).
+		GroupBy("t", "name", "tags").
+		OrderBy("tags", "t")).
+		String()
 }
 
-func emptySQLHandling(sql string) string {
-	if sql == "" {
-		return `''`
-	}
-	return sql
+// rawSelect returns the unordered select of the original samples of query between tstart and tend seconds,
+// with the same columns as the aggregated queries so rows are read the same way
+func (r *promReader) rawSelect(query *prompb.Query, tstart, tend int64) *selectBuilder {
+	return newSelect("1 AS CNT", "toUnixTimestamp(ts) * 1000 AS t", "name", "tags", "val AS value").
+		From(r.conf.ClickhouseDB, r.conf.ClickhouseTable).
+		Where(timeRangeConds(tstart, tend)...).
+		Where(r.seriesConds(query.Matchers, tstart, tend)...)
 }
 
-// getTimePeriod return select and where SQL chunks relating to the time period -or- error
-func (r *promReader) getTimePeriod(query *prompb.Query) (string, string, error) {
+// useRaw decides from the read hints whether the query returns the original samples
+// instead of quantile buckets of period seconds
+func (r *promReader) useRaw(query *prompb.Query, period int64) bool {
+	hints := query.Hints
+	if hints == nil {
+		return false
+	}
+	maxRange := r.conf.ClickhouseRawMaxRange
+	if maxRange < 0 || time.Duration(query.EndTimestampMs-query.StartTimestampMs)*time.Millisecond > maxRange {
+		return false
+	}
+	// range vector functions (rate, increase, *_over_time...) compute from individual samples,
+	// other functions which were not pushed down get raw samples as well
+	if hints.RangeMs > 0 || hints.Func != "" {
+		return true
+	}
+	// plain selectors, raw when the step is finer than the buckets
+	return hints.StepMs < period*1000
+}
 
-	var tselSQL = "SELECT COUNT() AS CNT, (intDiv(toUInt32(ts), %d) * %d) * 1000 as t"
-	var twhereSQL = "WHERE date >= toDate(%d) AND ts >= toDateTime(%d) AND ts <= toDateTime(%d)"
-	var err error
+// getTimePeriod returns the query time range in seconds and the aggregation period -or- error
+func (r *promReader) getTimePeriod(query *prompb.Query) (int64, int64, int64, error) {
 	tstart := query.StartTimestampMs / 1000
 	tend := query.EndTimestampMs / 1000
 
 	// valid time period
 	if tend < tstart {
-		err = fmt.Errorf("Start time is after end time")
-		return "", "", err
+		return 0, 0, 0, fmt.Errorf("Start time is after end time")
+	}
+	if maxRange := r.conf.ReadMaxRange; maxRange > 0 && time.Duration(query.EndTimestampMs-query.StartTimestampMs)*time.Millisecond > maxRange {
+		return 0, 0, 0, fmt.Errorf("%w: time range is longer than %s", errQueryLimit, maxRange)
 	}
 
 	// need time period in seconds
 	tperiod := tend - tstart
 
 	// need to split time period into <nsamples> - also, don't divide by zero
-	if r.conf.ClickhouseMaxSamples < 1 {
-		err = fmt.Errorf(fmt.Sprintf("Invalid ClickhouseMaxSamples: %d", r.conf.ClickhouseMaxSamples))
-		return "", "", err
+	maxSamples := r.conf.maxSamples()
+	if maxSamples < 1 {
+		return 0, 0, 0, fmt.Errorf("Invalid ClickhouseMaxSamples: %d", maxSamples)
 	}
-	taggr := tperiod / int64(r.conf.ClickhouseMaxSamples)
+	taggr := tperiod / int64(maxSamples)
 	if taggr < int64(r.conf.ClickhouseMinPeriod) {
 		taggr = int64(r.conf.ClickhouseMinPeriod)
 	}
-
-	selectSQL := fmt.Sprintf(tselSQL, taggr, taggr)
-	whereSQL := fmt.Sprintf(twhereSQL, tstart, tstart, tend)
-
-	return selectSQL, whereSQL, nil
+	return tstart, tend, taggr, nil
 }
@@ -0,0 +1,112 @@
+package prom2click
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUseRaw(t *testing.T) {
+	r := &promReader{conf: DefaultConfig()}
+	// 30 minutes, 10s buckets
+	query := func(hints *prompb.ReadHints) *prompb.Query {
+		return &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 30 * 60 * 1000, Hints: hints}
+	}
+	cases := []struct {
+		name  string
+		hints *prompb.ReadHints
+		raw   bool
+	}{
+		{"no hints", nil, false},
+		{"rate", &prompb.ReadHints{Func: "rate", StepMs: 60000, RangeMs: 300000}, true},
+		{"over time", &prompb.ReadHints{Func: "max_over_time", StepMs: 60000, RangeMs: 60000}, true},
+		{"timestamp", &prompb.ReadHints{Func: "timestamp", StepMs: 60000}, true},
+		{"instant", &prompb.ReadHints{}, true},
+		{"fine step", &prompb.ReadHints{StepMs: 5000}, true},
+		{"coarse step", &prompb.ReadHints{StepMs: 60000}, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.raw, r.useRaw(query(c.hints), 10), c.name)
+	}
+
+	// too long to return raw samples
+	long := &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 2 * 3600 * 1000, Hints: &prompb.ReadHints{Func: "rate", RangeMs: 300000}}
+	assert.False(t, r.useRaw(long, 10))
+
+	r.conf.ClickhouseRawMaxRange = -1
+	assert.False(t, r.useRaw(query(&prompb.ReadHints{Func: "rate", RangeMs: 300000}), 10))
+}
+
+func TestGetRawSQL(t *testing.T) {
+	r := &promReader{conf: DefaultConfig()}
+	sql, err := r.getSQL(&prompb.Query{
+		StartTimestampMs: 1000000,
+		EndTimestampMs:   1300000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+		Hints:            &prompb.ReadHints{Func: "rate", StepMs: 15000, RangeMs: 60000},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT 1 AS CNT, toUnixTimestamp(ts) * 1000 AS t, name, tags, val AS value FROM `metrics`.`samples` "+
+		"WHERE (date >= toDate(1000)) AND (ts >= toDateTime(1000)) AND (ts <= toDateTime(1300)) AND (name = 'up') ORDER BY tags, t", sql)
+}
+
+func TestReadPerQuery(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ClickhouseReadConcurrency = 2
+	var running, maxRunning int32
+	db := openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		switch {
+		case strings.Contains(query, "name = 'a'"):
+			return [][]driver.Value{
+				{int64(1), int64(1000), "a", []string{"__name__=a", "job=x"}, 1.0},
+				{int64(1), int64(1000), "a", []string{"__name__=a", "job=x"}, 2.0},
+				{int64(1), int64(2000), "a", []string{"__name__=a", "job=x"}, 3.0},
+				{int64(1), int64(1000), "a", []string{"__name__=a", "job=y"}, 4.0},
+			}, nil
+		case strings.Contains(query, "name = 'b'"):
+			return [][]driver.Value{{int64(1), int64(1000), "b", []string{"__name__=b"}, 5.0}}, nil
+		case strings.Contains(query, "name = 'err'"):
+			return nil, errors.New("boom")
+		}
+		return nil, nil
+	})
+	r := &promReader{conf: conf, db: db, metrics: newReaderMetrics(conf)}
+	query := func(name string) *prompb.Query {
+		return &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 60000, Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: name},
+		}}
+	}
+
+	resp, err := r.Read(context.Background(), &prompb.ReadRequest{Queries: []*prompb.Query{query("a"), query("none"), query("b"), query("a")}})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Results, 4)
+	assert.Equal(t, []*prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "a"}, {Name: "job", Value: "x"}},
+			Samples: []prompb.Sample{{Value: 2, Timestamp: 1000}, {Value: 3, Timestamp: 2000}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "a"}, {Name: "job", Value: "y"}},
+			Samples: []prompb.Sample{{Value: 4, Timestamp: 1000}}},
+	}, resp.Results[0].Timeseries)
+	assert.Empty(t, resp.Results[1].Timeseries)
+	assert.Len(t, resp.Results[2].Timeseries, 1)
+	assert.Equal(t, resp.Results[0], resp.Results[3])
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+
+	_, err = r.Read(context.Background(), &prompb.ReadRequest{Queries: []*prompb.Query{query("a"), query("err")}})
+	assert.EqualError(t, err, "boom")
+}
@@ -4,14 +4,12 @@ import (
 	"database/sql"
 	"fmt"
 	"sort"
-	"strconv"
 	"sync"
 	"time"
 
 	_ "github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/gotomicro/cetus/l"
 	"github.com/gotomicro/ego/core/elog"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 )
@@ -32,11 +30,14 @@ type promWriter struct {
 	requests chan *promRequest
 	wg       sync.WaitGroup
 	db       *sql.DB
-	tx       prometheus.Counter
-	ko       prometheus.Counter
-	test     prometheus.Counter
-	timings  prometheus.Histogram
-	rx       prometheus.Counter
+	metrics  *writerMetrics
+	// indexed are the series already in the label index
+	indexed *indexedSeries
+	// cache of the reader, invalidated by samples written later than ReadCacheRecent
+	cache *readCache
+	// mu guards closed, process holds it for reading so requests is never closed under a sender
+	mu     sync.RWMutex
+	closed bool
 }
 
 func NewWriter(conf *config) (*promWriter, error) {
@@ -44,80 +45,42 @@ func NewWriter(conf *config) (*promWriter, error) {
 	w := new(promWriter)
 	w.config = conf
 	w.requests = make(chan *promRequest, conf.ClickhouseChanSize)
+	w.indexed = newIndexedSeries(conf.ClickhouseLabelIndexCache)
+	w.metrics = newWriterMetrics(conf)
+	w.metrics.queueCapacity.Set(float64(cap(w.requests)))
+	if err = conf.setRelabelConfigs(); err != nil {
+		return w, err
+	}
 	w.db, err = sql.Open("clickhouse", w.config.ClickhouseDSN)
 	if err != nil {
 		elog.Error("writer", l.S("step", "open"), l.E(err))
 		return w, err
 	}
-
-	w.tx = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name:        "sent_samples_total",
-			Help:        "Total number of processed samples sent to remote storage.",
-			ConstLabels: map[string]string{"host": conf.Host, "port": strconv.Itoa(conf.Port)},
-		},
-	)
-
-	w.ko = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name:        "failed_samples_total",
-			Help:        "Total number of processed samples which failed on send to remote storage.",
-			ConstLabels: map[string]string{"host": conf.Host, "port": strconv.Itoa(conf.Port)},
-		},
-	)
-
-	w.test = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name:        "prometheus_remote_storage_sent_batch_duration_seconds_bucket_test",
-			Help:        "Test metric to ensure backfilled metrics are readable via prometheus.",
-			ConstLabels: map[string]string{"host": conf.Host, "port": strconv.Itoa(conf.Port)},
-		},
-	)
-
-	w.timings = prometheus.NewHistogram(
-		prometheus.HistogramOpts{
-			Name:        "sent_batch_duration_seconds",
-			Help:        "Duration of sample batch send calls to the remote storage.",
-			Buckets:     prometheus.DefBuckets,
-			ConstLabels: map[string]string{"host": conf.Host, "port": strconv.Itoa(conf.Port)},
-		},
-	)
-
-	w.rx = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name:        "received_samples_total",
-			Help:        "Total number of received samples.",
-			ConstLabels: map[string]string{"host": conf.Host, "port": strconv.Itoa(conf.Port)},
-		},
-	)
-
-	prometheus.MustRegister(w.rx)
-	prometheus.MustRegister(w.tx)
-	prometheus.MustRegister(w.ko)
-	prometheus.MustRegister(w.test)
-	prometheus.MustRegister(w.timings)
 	return w, nil
 }
 
 func (w *promWriter) process(req *prompb.WriteRequest) {
+	tstart := time.Now()
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		for _, series := range req.Timeseries {
+			w.metrics.drop(dropReasonClosed, len(series.Samples))
+		}
+		return
+	}
+	rules := w.config.writeRelabelConfigs()
 	for _, series := range req.Timeseries {
-		w.rx.Add(float64(len(series.Samples)))
-		var (
-			name string
-			tags []string
-		)
-
-		for _, label := range series.Labels {
-			if model.LabelName(label.Name) == model.MetricNameLabel {
-				name = label.Value
+		w.metrics.rx.Add(float64(len(series.Samples)))
+		pbLabels := series.Labels
+		if len(rules) > 0 {
+			var keep bool
+			if pbLabels, keep = relabelSeries(pbLabels, rules); !keep {
+				w.metrics.drop(dropReasonRelabel, len(series.Samples))
+				continue
 			}
-			// store tags in <key>=<value> format
-			// allows for has(tags, "key=val") searches
-			// probably impossible/difficult to do regex searches on tags
-			t := fmt.Sprintf("%s=%s", label.Name, label.Value)
-			tags = append(tags, t)
 		}
-
+		name, tags := seriesTags(pbLabels)
 		for _, sample := range series.Samples {
 			p2c := new(promRequest)
 			p2c.name = name
@@ -128,78 +91,170 @@ func (w *promWriter) process(req *prompb.WriteRequest) {
 		}
 
 	}
+	w.metrics.queueLength.Set(float64(len(w.requests)))
+	w.metrics.stage(stageEnqueue, time.Since(tstart).Seconds())
+}
+
+// seriesTags returns the metric name and the tags column of a series,
+// the tags are sorted as k=v strings like the column stores them and seriesFingerprint hashes them
+func seriesTags(labels []prompb.Label) (string, []string) {
+	var (
+		name string
+		tags []string
+	)
+	for _, label := range labels {
+		if model.LabelName(label.Name) == model.MetricNameLabel {
+			name = label.Value
+		}
+		// store tags in <key>=<value> format
+		// allows for has(tags, "key=val") searches
+		// probably impossible/difficult to do regex searches on tags
+		t := fmt.Sprintf("%s=%s", label.Name, label.Value)
+		tags = append(tags, t)
+	}
+	// label name order is not the order of the strings, foo1=… sorts before foo=…
+	sort.Strings(tags)
+	return name, tags
 }
 
 func (w *promWriter) Start() {
+	w.wg.Add(1)
 	go func() {
-		w.wg.Add(1)
 		elog.Info("writer", l.S("step", "start"))
 		sql := fmt.Sprintf(insertSQL, w.config.ClickhouseDB, w.config.ClickhouseTable)
 		ok := true
 		for ok {
-			w.test.Add(1)
-			// get next batch of requests
-			var reqs []*promRequest
-
-			tstart := time.Now()
-			for i := 0; i < w.config.ClickhouseBatch; i++ {
-				var req *promRequest
-				// get requet and also check if channel is closed
-				req, ok = <-w.requests
-				if !ok {
-					elog.Info("writer", l.S("step", "stopping"))
-					break
+			w.metrics.test.Add(1)
+			// the batch size may be changed by a config reload,
+			// a zero batch size would never drain the channel and spin forever
+			batch := w.config.batchSize()
+			if batch < 1 {
+				batch = 1
+			}
+			// get next batch of requests, a partial batch is sent once the flush interval
+			// since its first request has passed
+			var (
+				reqs    []*promRequest
+				timeout <-chan time.Time
+			)
+		collect:
+			for len(reqs) < batch {
+				select {
+				case req, more := <-w.requests:
+					// get requet and also check if channel is closed
+					if !more {
+						elog.Info("writer", l.S("step", "stopping"))
+						ok = false
+						break collect
+					}
+					if len(reqs) == 0 {
+						if flush := w.config.flushInterval(); flush > 0 {
+							timeout = time.After(flush)
+						}
+					}
+					reqs = append(reqs, req)
+				case <-timeout:
+					break collect
 				}
-				reqs = append(reqs, req)
 			}
+			w.metrics.queueLength.Set(float64(len(w.requests)))
 
 			// ensure we have something to send..
 			nmetrics := len(reqs)
 			if nmetrics < 1 {
 				continue
 			}
+			w.metrics.batchSize.Observe(float64(nmetrics))
 
-			// post them to db all at once
-			tx, err := w.db.Begin()
-			if err != nil {
-				elog.Error("writer", l.S("step", "begin"), l.E(err))
-				w.ko.Add(1.0)
-				continue
-			}
+			// post them to db all at once, failures are logged and counted by insert
+			_ = w.insert(sql, reqs)
+			_ = w.insertIndex(reqs)
+			w.invalidateCache(reqs)
+		}
+		elog.Info("writer", l.S("step", "stopped"))
+		w.wg.Done()
+	}()
+}
 
-			// build statements
-			smt, err := tx.Prepare(sql)
-			for _, req := range reqs {
-				if err != nil {
-					elog.Error("writer", l.S("step", "prepare"), l.E(err))
-					w.ko.Add(1.0)
-					continue
-				}
+// insert writes one batch of samples in a single transaction and records the writer metrics,
+// an error is returned unless every sample of the batch was committed
+func (w *promWriter) insert(sql string, reqs []*promRequest) error {
+	nmetrics := len(reqs)
+	tinsert := time.Now()
+	tx, err := w.db.Begin()
+	if err != nil {
+		elog.Error("writer", l.S("step", "begin"), l.E(err))
+		w.metrics.drop(dropReasonBegin, nmetrics)
+		return err
+	}
 
-				// ensure tags are inserted in the same order each time
-				// possibly/probably impacts indexing?
-				sort.Strings(req.tags)
-				_, err = smt.Exec(req.ts, req.name, req.tags, req.val, req.ts)
+	// build statements
+	nfailed := 0
+	var execErr error
+	smt, err := tx.Prepare(sql)
+	for _, req := range reqs {
+		if err != nil {
+			elog.Error("writer", l.S("step", "prepare"), l.E(err))
+			w.metrics.drop(dropReasonPrepare, nmetrics)
+			nfailed = nmetrics
+			execErr = err
+			break
+		}
 
-				if err != nil {
-					elog.Error("writer", l.S("step", "exec"), l.E(err))
-					w.ko.Add(1.0)
-				}
-			}
+		// ensure tags are inserted in the same order each time
+		// possibly/probably impacts indexing?
+		sort.Strings(req.tags)
+		_, err = smt.Exec(req.ts, req.name, req.tags, req.val, req.ts)
 
-			// commit and record metrics
-			if err = tx.Commit(); err != nil {
-				elog.Error("writer", l.S("step", "commit"), l.E(err))
-				w.ko.Add(1.0)
-			} else {
-				w.tx.Add(float64(nmetrics))
-				w.timings.Observe(float64(time.Since(tstart)))
-			}
+		if err != nil {
+			elog.Error("writer", l.S("step", "exec"), l.E(err))
+			w.metrics.drop(dropReasonExec, 1)
+			nfailed++
+			execErr = err
+			err = nil
+		}
+	}
+	w.metrics.stage(stageInsert, time.Since(tinsert).Seconds())
 
+	// commit and record metrics
+	tcommit := time.Now()
+	defer func() { w.metrics.stage(stageCommit, time.Since(tcommit).Seconds()) }()
+	if err = tx.Commit(); err != nil {
+		elog.Error("writer", l.S("step", "commit"), l.E(err))
+		w.metrics.drop(dropReasonCommit, nmetrics-nfailed)
+		return err
+	}
+	w.metrics.tx.Add(float64(nmetrics - nfailed))
+	w.metrics.timings.Observe(time.Since(tinsert).Seconds())
+	if nfailed > 0 {
+		return fmt.Errorf("%d of %d samples failed: %w", nfailed, nmetrics, execErr)
+	}
+	return nil
+}
+
+// invalidateCache drops the cached reads once samples older than ReadCacheRecent were written,
+// they may fall into intervals already cached as complete. Failed inserts count too, some rows may be in.
+func (w *promWriter) invalidateCache(reqs []*promRequest) {
+	if w.cache == nil {
+		return
+	}
+	recent := time.Now().Add(-w.config.ReadCacheRecent)
+	for _, req := range reqs {
+		if req.ts.Before(recent) {
+			w.cache.invalidate()
+			return
 		}
-		elog.Info("writer", l.S("step", "stopped"))
-		w.wg.Done()
-	}()
+	}
+}
+
+// close stops accepting samples, the writer goroutine exits once the queued ones are inserted
+func (w *promWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.requests)
+	}
 }
 
 func (w *promWriter) Wait() {
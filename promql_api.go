@@ -0,0 +1,207 @@
+package prom2click
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// error types of the prometheus http api
+const (
+	errorBadData  = "bad_data"
+	errorExec     = "execution"
+	errorTimeout  = "timeout"
+	errorCanceled = "canceled"
+	errorInternal = "internal"
+)
+
+// maxQueryPoints is the number of points per series above which prometheus refuses range queries
+const maxQueryPoints = 11000
+
+// apiResponse is the envelope of every prometheus http api response
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+}
+
+type queryData struct {
+	ResultType parser.ValueType `json:"resultType"`
+	Result     parser.Value     `json:"result"`
+}
+
+func newPromQLEngine(conf *config) *promql.Engine {
+	return promql.NewEngine(promql.EngineOpts{
+		Logger:               log.NewNopLogger(),
+		MaxSamples:           conf.PromQLMaxSamples,
+		Timeout:              conf.PromQLTimeout,
+		LookbackDelta:        conf.PromQLLookbackDelta,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
+		NoStepSubqueryIntervalFn: func(int64) int64 {
+			return time.Minute.Milliseconds()
+		},
+	})
+}
+
+// handleQuery 处理PromQL即时查询，与prometheus的/api/v1/query一致
+func (c *Component) handleQuery(ctx *gin.Context) {
+	ts, err := parseTime(ctx.Request.FormValue("time"), time.Now())
+	if err != nil {
+		apiError(ctx, errorBadData, fmt.Errorf("invalid parameter \"time\": %w", err))
+		return
+	}
+	qctx, cancel, err := queryContext(ctx)
+	if err != nil {
+		apiError(ctx, errorBadData, err)
+		return
+	}
+	defer cancel()
+	qry, err := c.engine.NewInstantQuery(c.queryable, nil, ctx.Request.FormValue("query"), ts)
+	if err != nil {
+		apiError(ctx, errorBadData, err)
+		return
+	}
+	c.execQuery(ctx, qctx, qry)
+}
+
+// handleQueryRange 处理PromQL范围查询，与prometheus的/api/v1/query_range一致
+func (c *Component) handleQueryRange(ctx *gin.Context) {
+	var (
+		params [2]time.Time
+		err    error
+	)
+	for i, name := range []string{"start", "end"} {
+		value := ctx.Request.FormValue(name)
+		if value == "" {
+			apiError(ctx, errorBadData, fmt.Errorf("invalid parameter %q: missing", name))
+			return
+		}
+		if params[i], err = parseTime(value, time.Time{}); err != nil {
+			apiError(ctx, errorBadData, fmt.Errorf("invalid parameter %q: %w", name, err))
+			return
+		}
+	}
+	start, end := params[0], params[1]
+	if end.Before(start) {
+		apiError(ctx, errorBadData, errors.New("end timestamp must not be before start time"))
+		return
+	}
+	step, err := parseDuration(ctx.Request.FormValue("step"))
+	if err != nil {
+		apiError(ctx, errorBadData, fmt.Errorf("invalid parameter \"step\": %w", err))
+		return
+	}
+	if step <= 0 {
+		apiError(ctx, errorBadData, errors.New("zero or negative query resolution step widths are not accepted. Try a positive integer"))
+		return
+	}
+	if end.Sub(start)/step > maxQueryPoints {
+		apiError(ctx, errorBadData, errors.New("exceeded maximum resolution of 11,000 points per timeseries. Try decreasing the query resolution (?step=XX)"))
+		return
+	}
+
+	qctx, cancel, err := queryContext(ctx)
+	if err != nil {
+		apiError(ctx, errorBadData, err)
+		return
+	}
+	defer cancel()
+	qry, err := c.engine.NewRangeQuery(c.queryable, nil, ctx.Request.FormValue("query"), start, end, step)
+	if err != nil {
+		apiError(ctx, errorBadData, err)
+		return
+	}
+	c.execQuery(ctx, qctx, qry)
+}
+
+func (c *Component) execQuery(ctx *gin.Context, qctx context.Context, qry promql.Query) {
+	defer qry.Close()
+	res := qry.Exec(qctx)
+	if res.Err != nil {
+		apiError(ctx, queryErrorType(res.Err), res.Err)
+		return
+	}
+	var warnings []string
+	for _, w := range res.Warnings {
+		warnings = append(warnings, w.Error())
+	}
+	// the result is only valid until the query is closed
+	ctx.JSON(http.StatusOK, apiResponse{
+		Status:   "success",
+		Data:     queryData{ResultType: res.Value.Type(), Result: res.Value},
+		Warnings: warnings,
+	})
+}
+
+// queryContext returns the request context bounded by the optional timeout parameter
+func queryContext(ctx *gin.Context) (context.Context, context.CancelFunc, error) {
+	value := ctx.Request.FormValue("timeout")
+	if value == "" {
+		qctx, cancel := context.WithCancel(ctx.Request.Context())
+		return qctx, cancel, nil
+	}
+	timeout, err := parseDuration(value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid parameter \"timeout\": %w", err)
+	}
+	qctx, cancel := context.WithTimeout(ctx.Request.Context(), timeout)
+	return qctx, cancel, nil
+}
+
+// queryErrorType classifies engine errors like prometheus does, limits of the reader are execution errors
+func queryErrorType(err error) string {
+	if se, ok := err.(promql.ErrStorage); ok {
+		err = se.Err
+		if !errors.Is(err, errQueryLimit) {
+			return errorInternal
+		}
+	}
+	switch err.(type) {
+	case promql.ErrQueryCanceled:
+		return errorCanceled
+	case promql.ErrQueryTimeout:
+		return errorTimeout
+	}
+	return errorExec
+}
+
+func apiError(ctx *gin.Context, errorType string, err error) {
+	status := http.StatusInternalServerError
+	switch errorType {
+	case errorBadData:
+		status = http.StatusBadRequest
+	case errorExec:
+		status = http.StatusUnprocessableEntity
+	case errorCanceled, errorTimeout:
+		status = http.StatusServiceUnavailable
+	}
+	ctx.JSON(status, apiResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+// parseDuration parses seconds (possibly fractional) or a prometheus duration such as 5m
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration. It overflows int64", s)
+		}
+		return time.Duration(ts), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
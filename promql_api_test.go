@@ -0,0 +1,118 @@
+package prom2click
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPromQLComponent(t *testing.T, conf *config) *Component {
+	db := openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		var rows [][]driver.Value
+		for _, job := range []string{"a", "b"} {
+			for ts := int64(0); ts <= 600; ts += 15 {
+				rows = append(rows, []driver.Value{int64(1), ts * 1000, "up", []string{"__name__=up", "job=" + job}, 1.0})
+			}
+		}
+		return rows, nil
+	})
+	r := &promReader{conf: conf, db: db, metrics: newReaderMetrics(conf)}
+	cmp := &Component{Engine: gin.New(), config: conf, reader: r, engine: newPromQLEngine(conf), queryable: &queryable{reader: r}}
+	cmp.route()
+	return cmp
+}
+
+func servePromQL(cmp *Component, method, path string, params url.Values) (int, apiResponse, map[string]interface{}) {
+	var req *http.Request
+	if method == http.MethodPost {
+		req = httptest.NewRequest(method, path, strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, path+"?"+params.Encode(), nil)
+	}
+	w := httptest.NewRecorder()
+	cmp.ServeHTTP(w, req)
+	var resp apiResponse
+	var data struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	_ = json.Unmarshal(w.Body.Bytes(), &data)
+	return w.Code, resp, data.Data
+}
+
+func TestPromQLQuery(t *testing.T) {
+	cmp := newPromQLComponent(t, DefaultConfig())
+
+	code, resp, data := servePromQL(cmp, http.MethodGet, "/api/v1/query", url.Values{"query": {"sum(up)"}, "time": {"300"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "success", resp.Status)
+	assert.Equal(t, "vector", data["resultType"])
+	result := data["result"].([]interface{})
+	assert.Len(t, result, 1)
+	assert.Equal(t, []interface{}{300.0, "2"}, result[0].(map[string]interface{})["value"])
+
+	code, _, data = servePromQL(cmp, http.MethodPost, "/api/v1/query_range", url.Values{
+		"query": {"up"}, "start": {"60"}, "end": {"120"}, "step": {"30s"},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "matrix", data["resultType"])
+	result = data["result"].([]interface{})
+	assert.Len(t, result, 2)
+	series := result[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"__name__": "up", "job": "a"}, series["metric"])
+	assert.Len(t, series["values"], 3)
+}
+
+func TestPromQLQueryErrors(t *testing.T) {
+	conf := DefaultConfig()
+	cmp := newPromQLComponent(t, conf)
+
+	for _, tc := range []struct {
+		path   string
+		params url.Values
+	}{
+		{"/api/v1/query", url.Values{"query": {"sum("}}},
+		{"/api/v1/query", url.Values{"query": {"up"}, "time": {"now"}}},
+		{"/api/v1/query", url.Values{"query": {"up"}, "timeout": {"soon"}}},
+		{"/api/v1/query_range", url.Values{"query": {"up"}, "end": {"120"}, "step": {"15"}}},
+		{"/api/v1/query_range", url.Values{"query": {"up"}, "start": {"120"}, "end": {"60"}, "step": {"15"}}},
+		{"/api/v1/query_range", url.Values{"query": {"up"}, "start": {"60"}, "end": {"120"}, "step": {"0"}}},
+		{"/api/v1/query_range", url.Values{"query": {"up"}, "start": {"0"}, "end": {"86400"}, "step": {"1"}}},
+	} {
+		code, resp, _ := servePromQL(cmp, http.MethodGet, tc.path, tc.params)
+		assert.Equal(t, http.StatusBadRequest, code, tc.params)
+		assert.Equal(t, "error", resp.Status)
+		assert.Equal(t, errorBadData, resp.ErrorType, tc.params)
+	}
+
+	// limits of the reader are execution errors as in prometheus
+	conf.ReadMaxSeries = 1
+	code, resp, _ := servePromQL(cmp, http.MethodGet, "/api/v1/query", url.Values{"query": {"up"}, "time": {"300"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Equal(t, errorExec, resp.ErrorType)
+	assert.Contains(t, resp.Error, "more than 1 series")
+}
+
+func TestParseDuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"15":    15 * time.Second,
+		"0.5":   500 * time.Millisecond,
+		"5m":    5 * time.Minute,
+		"1h30m": 90 * time.Minute,
+	} {
+		got, err := parseDuration(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+	_, err := parseDuration("soon")
+	assert.Error(t, err)
+}
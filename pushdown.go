@@ -0,0 +1,220 @@
+package prom2click
+
+import (
+	"math"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Prometheus evaluates the hinted function again on whatever the remote read returns,
+// so only functions which give the same result when applied to their own output are pushed down.
+// count, count_over_time, sum_over_time and friends depend on the number of series or samples
+// returned and are read raw instead.
+//
+// The results are only the same when the returned points line up with the evaluation times,
+// which the hints give for a plain range or instant query: the first evaluation is the range
+// or lookback after the start and the last one at the end. Anything else is read raw.
+// Subqueries are not visible in the hints, one whose step differs from the query step gets
+// points which do not line up with its evaluations.
+
+// overTimeAggregates maps range functions to the aggregate of the samples of one bucket
+var overTimeAggregates = map[string]sqlExpr{
+	"max_over_time":  "max(val)",
+	"min_over_time":  "min(val)",
+	"last_over_time": "argMax(val, ts)",
+}
+
+// groupAggregates maps aggregation operators to the aggregate across the series of one group,
+// v is the value of each series at the evaluation. min and max are not there as prometheus
+// would apply them to the result of a unary minus, max(-x) is not -max(x)
+var groupAggregates = map[string]sqlExpr{
+	"sum":   "sum(v)",
+	"avg":   "avg(v)",
+	"group": "1",
+}
+
+// tagName extracts the label name from a key=value tag
+const tagName sqlExpr = "substring(x, 1, position(x, '=') - 1)"
+
+// pushdownPlan is how the hinted function of a query is computed in clickhouse, times are in seconds
+type pushdownPlan struct {
+	agg    sqlExpr
+	group  bool  // aggregation operator across series, else range function
+	start  int64 // hinted start, the first evaluation is window later
+	end    int64 // hinted end and last evaluation
+	step   int64 // 0 for instant queries
+	window int64 // range of the range function or lookback of the operator
+	bucket int64 // range functions only, divides both the range and the step
+}
+
+// pushdownPlan returns how the hinted function of query is pushed down, false when it is not
+func (r *promReader) pushdownPlan(query *prompb.Query) (*pushdownPlan, bool) {
+	hints := query.Hints
+	if hints == nil || !boolValue(r.conf.EnableReadPushdown) {
+		return nil, false
+	}
+	p := new(pushdownPlan)
+	var window int64
+	if agg, ok := overTimeAggregates[hints.Func]; ok && hints.RangeMs > 0 {
+		p.agg, window = agg, hints.RangeMs
+	} else if agg, ok = groupAggregates[hints.Func]; ok && hints.RangeMs == 0 {
+		// the lookback of remote prometheus servers is not in the hints, it has to be the same
+		p.agg, p.group, window = agg, true, r.conf.PromQLLookbackDelta.Milliseconds()
+	} else {
+		return nil, false
+	}
+	// samples are stored with second precision, so are the evaluations
+	for _, ms := range []int64{hints.StartMs, hints.EndMs, hints.StepMs, window} {
+		if ms%1000 != 0 {
+			return nil, false
+		}
+	}
+	p.start, p.end, p.step, p.window = hints.StartMs/1000, hints.EndMs/1000, hints.StepMs/1000, window/1000
+	span := p.end - p.start - p.window
+	switch {
+	case p.window <= 0 || span < 0:
+		return nil, false
+	case p.step == 0 && span != 0:
+		// instant queries are evaluated once at the end
+		return nil, false
+	case p.step > 0 && (span%p.step != 0 || p.end%p.step != 0):
+		// range queries from start to end, aligned to the step like subqueries are
+		return nil, false
+	}
+	if !p.group {
+		p.bucket = gcd(p.window, p.step)
+	}
+	return p, true
+}
+
+// resolution returns the distance in seconds between the points of the plan
+func (p *pushdownPlan) resolution() int64 {
+	if p.group {
+		return p.evalStep()
+	}
+	return p.bucket
+}
+
+// evalStep returns the step between evaluations, the window for the single one of instant queries
+func (p *pushdownPlan) evalStep() int64 {
+	if p.step > 0 {
+		return p.step
+	}
+	return p.window
+}
+
+// getPushdownSQL returns the query computing the hinted function in clickhouse between tstart and tend,
+// false when the hints can not be pushed down
+func (r *promReader) getPushdownSQL(query *prompb.Query, tstart, tend int64) (*selectBuilder, bool) {
+	p, ok := r.pushdownPlan(query)
+	if !ok {
+		return nil, false
+	}
+	if p.group {
+		return r.groupSQL(query, p, tstart, tend), true
+	}
+	return r.overTimeSQL(query, p, tstart, tend), true
+}
+
+// overTimeSQL aggregates the samples of buckets aligned to the evaluations. Prometheus includes both ends
+// of every range, so the samples on bucket boundaries are groups of their own and the others are grouped
+// between them. Every group is stamped with its last sample and falls in a range exactly when all its
+// samples do, whichever intervals the cache splits the query in.
+func (r *promReader) overTimeSQL(query *prompb.Query, p *pushdownPlan, tstart, tend int64) *selectBuilder {
+	offset := sqlf("(toUInt32(ts) - ?)", p.end%p.bucket)
+	return newSelect(
+		"COUNT() AS CNT",
+		"toUInt32(max(ts)) * 1000 AS t",
+		"name",
+		"tags",
+		sqlf("? AS value", p.agg),
+	).
+		From(r.conf.ClickhouseDB, r.conf.ClickhouseTable).
+		Where(timeRangeConds(tstart, tend)...).
+		// prometheus skips stale markers in ranges
+		Where(sqlf("reinterpretAsUInt64(val) != ?", staleNaNBits)).
+		Where(r.seriesConds(query.Matchers, tstart, tend)...).
+		GroupBy(sqlf("intDiv(?, ?)", offset, p.bucket), sqlf("? % ? = 0", offset, p.bucket), "name", "tags").
+		OrderBy("tags", "t")
+}
+
+// groupSQL aggregates the value every series has at each evaluation. Like prometheus that is its last sample
+// within the lookback, so every sample is repeated for the evaluations k it is visible at and the
+// latest one of each evaluation is kept. Series whose last sample is a stale marker are left out.
+func (r *promReader) groupSQL(query *prompb.Query, p *pushdownPlan, tstart, tend int64) *selectBuilder {
+	step := p.evalStep()
+	last := (p.end - p.start - p.window) / step
+	age := sqlf("(toUInt32(ts) - ?)", p.start)
+	first := sqlf("if(? <= ?, 0, intDiv(? - ? + ?, ?))", age, p.window, age, p.window, step-1, step)
+	perSeries := newSelect(
+		sqlf("arrayJoin(range(toUInt32(?), toUInt32(least(intDiv(?, ?), ?) + 1))) AS k", first, age, step, last),
+		"tags",
+		"argMax(val, ts) AS v",
+	).
+		From(r.conf.ClickhouseDB, r.conf.ClickhouseTable).
+		Where(timeRangeConds(tstart, tend)...).
+		Where(r.seriesConds(query.Matchers, tstart, tend)...).
+		GroupBy("k", "tags")
+	return newSelect(
+		"COUNT() AS CNT",
+		sqlf("(? + k * ?) * 1000 AS t", p.start+p.window, step),
+		"'' AS name",
+		sqlf("? AS gtags", groupingTags(query.Hints.Grouping, query.Hints.By)),
+		sqlf("? AS value", p.agg),
+	).
+		FromQuery(perSeries).
+		Where(sqlf("reinterpretAsUInt64(v) != ?", staleNaNBits)).
+		GroupBy("k", "gtags").
+		OrderBy("gtags", "t")
+}
+
+// staleNaNBits are the bits of the stale marker
+const staleNaNBits = int64(value.StaleNaN)
+
+// markGaps adds a stale marker at the evaluation after every missing one of a pushed down group,
+// otherwise prometheus would look back across the gap to the previous value
+func (p *pushdownPlan) markGaps(samples []prompb.Sample) []prompb.Sample {
+	if !p.group || p.step == 0 {
+		return samples
+	}
+	step, end := p.step*1000, p.end*1000
+	marked := make([]prompb.Sample, 0, len(samples))
+	for i, s := range samples {
+		marked = append(marked, s)
+		next := s.Timestamp + step
+		if next > end || (i+1 < len(samples) && samples[i+1].Timestamp == next) {
+			continue
+		}
+		marked = append(marked, prompb.Sample{Value: math.Float64frombits(value.StaleNaN), Timestamp: next})
+	}
+	return marked
+}
+
+// groupingTags returns the expression keeping the tags of the by/without grouping labels,
+// like prometheus the metric name is dropped either way
+func groupingTags(grouping []string, by bool) sqlExpr {
+	if by {
+		names := make([]string, 0, len(grouping))
+		for _, name := range grouping {
+			if name != model.MetricNameLabel {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return "emptyArrayString()"
+		}
+		return sqlf("arrayFilter(x -> has(?, ?), tags)", names, tagName)
+	}
+	names := append([]string{model.MetricNameLabel}, grouping...)
+	return sqlf("arrayFilter(x -> NOT has(?, ?), tags)", names, tagName)
+}
+
+// gcd returns the greatest common divisor of a and b, a when b is 0
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
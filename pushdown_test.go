@@ -0,0 +1,409 @@
+package prom2click
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushdownOverTime(t *testing.T) {
+	r := &promReader{conf: DefaultConfig()}
+	sql, err := r.getSQL(&prompb.Query{
+		StartTimestampMs: 900000,
+		EndTimestampMs:   1320000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+		Hints:            &prompb.ReadHints{Func: "max_over_time", StartMs: 900000, EndMs: 1320000, StepMs: 60000, RangeMs: 300000},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT COUNT() AS CNT, toUInt32(max(ts)) * 1000 AS t, name, tags, max(val) AS value "+
+		"FROM `metrics`.`samples` WHERE (date >= toDate(900)) AND (ts >= toDateTime(900)) AND (ts <= toDateTime(1320)) "+
+		"AND (reinterpretAsUInt64(val) != 9218868437227405314) AND (name = 'up') "+
+		"GROUP BY intDiv((toUInt32(ts) - 0), 60), (toUInt32(ts) - 0) % 60 = 0, name, tags ORDER BY tags, t", sql)
+
+	// instant query, one bucket of the range aligned to the end
+	sql, err = r.getSQL(&prompb.Query{
+		StartTimestampMs: 1000000,
+		EndTimestampMs:   1090000,
+		Hints:            &prompb.ReadHints{Func: "last_over_time", StartMs: 1000000, EndMs: 1090000, RangeMs: 90000},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, sql, "argMax(val, ts) AS value")
+	assert.Contains(t, sql, "GROUP BY intDiv((toUInt32(ts) - 10), 90), (toUInt32(ts) - 10) % 90 = 0")
+}
+
+func TestPushdownGrouping(t *testing.T) {
+	r := &promReader{conf: DefaultConfig()}
+	query := &prompb.Query{
+		StartTimestampMs: 900000,
+		EndTimestampMs:   1320000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+		Hints:            &prompb.ReadHints{Func: "sum", StartMs: 900000, EndMs: 1320000, StepMs: 30000, Grouping: []string{"job"}, By: true},
+	}
+	sql, err := r.getSQL(query)
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT COUNT() AS CNT, (1200 + k * 30) * 1000 AS t, '' AS name, "+
+		"arrayFilter(x -> has(['job'], substring(x, 1, position(x, '=') - 1)), tags) AS gtags, sum(v) AS value "+
+		"FROM (SELECT arrayJoin(range(toUInt32(if((toUInt32(ts) - 900) <= 300, 0, intDiv((toUInt32(ts) - 900) - 300 + 29, 30))), "+
+		"toUInt32(least(intDiv((toUInt32(ts) - 900), 30), 4) + 1))) AS k, tags, argMax(val, ts) AS v FROM `metrics`.`samples` "+
+		"WHERE (date >= toDate(900)) AND (ts >= toDateTime(900)) AND (ts <= toDateTime(1320)) AND (name = 'up') "+
+		"GROUP BY k, tags) WHERE (reinterpretAsUInt64(v) != 9218868437227405314) GROUP BY k, gtags ORDER BY gtags, t", sql)
+
+	// instant query, a single evaluation at the end
+	query.Hints = &prompb.ReadHints{Func: "avg", StartMs: 1020000, EndMs: 1320000, Grouping: []string{"instance"}}
+	sql, err = r.getSQL(query)
+	assert.NoError(t, err)
+	assert.Contains(t, sql, "(1320 + k * 300) * 1000 AS t")
+	assert.Contains(t, sql, "arrayFilter(x -> NOT has(['__name__', 'instance'], substring(x, 1, position(x, '=') - 1)), tags) AS gtags")
+	assert.Contains(t, sql, "avg(v) AS value")
+
+	query.Hints = &prompb.ReadHints{Func: "group", StartMs: 900000, EndMs: 1320000, StepMs: 30000, By: true}
+	sql, err = r.getSQL(query)
+	assert.NoError(t, err)
+	assert.Contains(t, sql, "emptyArrayString() AS gtags")
+}
+
+func TestPushdownFallback(t *testing.T) {
+	r := &promReader{conf: DefaultConfig()}
+	query := &prompb.Query{StartTimestampMs: 900000, EndTimestampMs: 1320000}
+	for _, hints := range []*prompb.ReadHints{
+		nil,
+		{Func: "count", StartMs: 900000, EndMs: 1320000, StepMs: 30000, Grouping: []string{"job"}, By: true},
+		{Func: "max", StartMs: 900000, EndMs: 1320000, StepMs: 30000},
+		{Func: "count_over_time", StartMs: 900000, EndMs: 1320000, StepMs: 30000, RangeMs: 60000},
+		{Func: "rate", StartMs: 900000, EndMs: 1320000, StepMs: 30000, RangeMs: 60000},
+		{Func: "max_over_time", StartMs: 900000, EndMs: 1320000},
+		// evaluations off the step
+		{Func: "max_over_time", StartMs: 900000, EndMs: 1330000, StepMs: 60000, RangeMs: 300000},
+		{Func: "max_over_time", StartMs: 910000, EndMs: 1330000, StepMs: 60000, RangeMs: 300000},
+		// not whole seconds
+		{Func: "max_over_time", StartMs: 900500, EndMs: 1320500, StepMs: 60000, RangeMs: 300000},
+		// instant queries over more than the range or lookback, subqueries
+		{Func: "max_over_time", StartMs: 900000, EndMs: 1320000, RangeMs: 300000},
+		{Func: "sum", StartMs: 900000, EndMs: 1320000},
+	} {
+		query.Hints = hints
+		_, ok := r.pushdownPlan(query)
+		assert.False(t, ok, "%v", hints)
+	}
+	// unsupported functions are read raw
+	query.Hints = &prompb.ReadHints{Func: "count", StartMs: 900000, EndMs: 1320000, StepMs: 30000, By: true}
+	sql, err := r.getSQL(query)
+	assert.NoError(t, err)
+	assert.Contains(t, sql, "val AS value")
+
+	r.conf.EnableReadPushdown = boolPtr(false)
+	query.Hints = &prompb.ReadHints{Func: "sum", StartMs: 900000, EndMs: 1320000, StepMs: 30000, By: true}
+	_, ok := r.pushdownPlan(query)
+	assert.False(t, ok)
+}
+
+func TestPushdownMarkGaps(t *testing.T) {
+	p := &pushdownPlan{group: true, end: 300, step: 60}
+	stale := math.Float64frombits(value.StaleNaN)
+	marked := p.markGaps([]prompb.Sample{{Value: 1, Timestamp: 60000}, {Value: 2, Timestamp: 120000}, {Value: 3, Timestamp: 240000}})
+	assert.Len(t, marked, 5)
+	assert.Equal(t, int64(180000), marked[2].Timestamp)
+	assert.True(t, value.IsStaleNaN(marked[2].Value))
+	assert.Equal(t, int64(300000), marked[4].Timestamp)
+	assert.True(t, value.IsStaleNaN(marked[4].Value))
+	assert.NotEqual(t, stale, marked[3].Value)
+
+	// nothing after the last evaluation
+	marked = p.markGaps([]prompb.Sample{{Value: 1, Timestamp: 300000}})
+	assert.Len(t, marked, 1)
+}
+
+// TestPushdownMatchesRaw evaluates queries with the promql engine once over the raw samples
+// and once over the pushed down rows, the results must be the same
+func TestPushdownMatchesRaw(t *testing.T) {
+	stale := math.Float64frombits(value.StaleNaN)
+	samples := func(from, to, every int64) []prompb.Sample {
+		var samples []prompb.Sample
+		for ts := from; ts <= to; ts += every {
+			samples = append(samples, prompb.Sample{Value: float64((ts*7)%13 - 4), Timestamp: ts * 1000})
+		}
+		return samples
+	}
+	series := []fakeSeries{
+		{tags: []string{"__name__=m", "job=a"}, samples: samples(7, 4000, 15)},
+		// samples on the bucket boundaries
+		{tags: []string{"__name__=m", "job=b"}, samples: samples(0, 4000, 30)},
+		// scraped less often than the step
+		{tags: []string{"__name__=m", "job=c"}, samples: samples(11, 4000, 170)},
+		// ends with a stale marker, then a gap longer than the lookback
+		{tags: []string{"__name__=m", "job=d"}, samples: append(append(samples(3, 2000, 20),
+			prompb.Sample{Value: stale, Timestamp: 2001000}), samples(2700, 4000, 45)...)},
+	}
+
+	conf := DefaultConfig()
+	var kinds []string
+	db := openFakeDB(t, emulateClickhouse(series, &kinds))
+	pushed := &promReader{conf: conf, db: db, metrics: newReaderMetrics(conf)}
+	rawConf := DefaultConfig()
+	rawConf.EnableReadPushdown = boolPtr(false)
+	raw := &promReader{conf: rawConf, db: db, metrics: newReaderMetrics(rawConf)}
+	engine := newPromQLEngine(conf)
+
+	eval := func(r *promReader, qs string, start, end time.Time, step time.Duration) promql.Matrix {
+		var (
+			q   promql.Query
+			err error
+		)
+		if step == 0 {
+			q, err = engine.NewInstantQuery(&queryable{reader: r}, nil, qs, end)
+		} else {
+			q, err = engine.NewRangeQuery(&queryable{reader: r}, nil, qs, start, end, step)
+		}
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		res := q.Exec(context.Background())
+		if !assert.NoError(t, res.Err, qs) {
+			return nil
+		}
+		switch v := res.Value.(type) {
+		case promql.Matrix:
+			return v
+		case promql.Vector:
+			m := promql.Matrix{}
+			for _, s := range v {
+				m = append(m, promql.Series{Metric: s.Metric, Points: []promql.Point{s.Point}})
+			}
+			return m
+		}
+		t.Fatalf("unexpected result %T", res.Value)
+		return nil
+	}
+
+	for _, tc := range []struct {
+		query string
+		step  time.Duration
+		kind  string
+	}{
+		{"max_over_time(m[5m])", time.Minute, "overtime"},
+		{"min_over_time(m[2m])", 30 * time.Second, "overtime"},
+		{"last_over_time(m[90s])", time.Minute, "overtime"},
+		{"max_over_time(m[45s])", time.Minute, "overtime"},
+		{"max_over_time(m[5m])", 0, "overtime"},
+		{"last_over_time(m[1m] offset 2m)", time.Minute, "overtime"},
+		{"sum by (job) (m)", time.Minute, "group"},
+		{"avg(m)", time.Minute, "group"},
+		{"group by (job) (m)", 2 * time.Minute, "group"},
+		{"sum without (job) (m)", 15 * time.Second, "group"},
+		{"-sum by (job) (-m)", time.Minute, "group"},
+		{"sum by (job) (m)", 0, "group"},
+	} {
+		t.Run(fmt.Sprintf("%s/%s", tc.query, tc.step), func(t *testing.T) {
+			start, end := time.Unix(1200, 0), time.Unix(3600, 0)
+			kinds = nil
+			want := eval(raw, tc.query, start, end, tc.step)
+			assert.Equal(t, []string{"raw"}, kinds)
+			kinds = nil
+			got := eval(pushed, tc.query, start, end, tc.step)
+			assert.Equal(t, []string{tc.kind}, kinds)
+			assert.NotEmpty(t, want)
+			if !assert.Equal(t, len(want), len(got)) {
+				return
+			}
+			for i := range want {
+				assert.Equal(t, want[i].Metric, got[i].Metric)
+				if !assert.Equal(t, len(want[i].Points), len(got[i].Points), want[i].Metric.String()) {
+					continue
+				}
+				for j, p := range want[i].Points {
+					assert.Equal(t, p.T, got[i].Points[j].T)
+					assert.InDelta(t, p.V, got[i].Points[j].V, 1e-9, "%s at %d", want[i].Metric, p.T)
+				}
+			}
+		})
+	}
+}
+
+type fakeSeries struct {
+	tags    []string
+	samples []prompb.Sample
+}
+
+var (
+	fakeTimeRange = regexp.MustCompile(`ts >= toDateTime\((\d+)\)\) AND \(ts <= toDateTime\((\d+)\)`)
+	fakeBuckets   = regexp.MustCompile(`GROUP BY intDiv\(\(toUInt32\(ts\) - (\d+)\), (\d+)\)`)
+	fakeOverTime  = regexp.MustCompile(`(max\(val\)|min\(val\)|argMax\(val, ts\)) AS value`)
+	fakeWindow    = regexp.MustCompile(`if\(\(toUInt32\(ts\) - (\d+)\) <= (\d+), 0, intDiv\(\(toUInt32\(ts\) - \d+\) - \d+ \+ (\d+), (\d+)\)\)`)
+	fakeLast      = regexp.MustCompile(`least\(intDiv\(\(toUInt32\(ts\) - \d+\), \d+\), (\d+)\)`)
+	fakeEval      = regexp.MustCompile(`\((\d+) \+ k \* (\d+)\) \* 1000 AS t`)
+	fakeGroupBy   = regexp.MustCompile(`arrayFilter\(x -> (NOT )?has\(\[([^\]]*)\]`)
+	fakeGroupAgg  = regexp.MustCompile(`(sum\(v\)|avg\(v\)|1) AS value`)
+)
+
+// emulateClickhouse answers the raw and pushed down queries over series the way clickhouse would,
+// the kind of every query is appended to kinds
+func emulateClickhouse(series []fakeSeries, kinds *[]string) fakeHandler {
+	atoi := func(s string) int64 {
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return n
+	}
+	return func(query string) ([][]driver.Value, error) {
+		m := fakeTimeRange.FindStringSubmatch(query)
+		if m == nil {
+			return nil, fmt.Errorf("no time range in %s", query)
+		}
+		tstart, tend := atoi(m[1]), atoi(m[2])
+		var rows [][]driver.Value
+		switch {
+		case strings.Contains(query, "val AS value"):
+			*kinds = append(*kinds, "raw")
+			for _, s := range series {
+				for _, p := range s.samples {
+					if ts := p.Timestamp / 1000; ts >= tstart && ts <= tend {
+						rows = append(rows, []driver.Value{int64(1), p.Timestamp, "m", s.tags, p.Value})
+					}
+				}
+			}
+
+		case strings.Contains(query, "AS gtags"):
+			*kinds = append(*kinds, "group")
+			w, last, e, agg, by := fakeWindow.FindStringSubmatch(query), fakeLast.FindStringSubmatch(query),
+				fakeEval.FindStringSubmatch(query), fakeGroupAgg.FindStringSubmatch(query)[1], fakeGroupBy.FindStringSubmatch(query)
+			start, window, round, step := atoi(w[1]), atoi(w[2]), atoi(w[3]), atoi(w[4])
+			first, nlast := atoi(e[1]), atoi(last[1])
+			// last value of every series at each evaluation k
+			type key struct {
+				k    int64
+				tags string
+			}
+			latest := map[key]prompb.Sample{}
+			for _, s := range series {
+				for _, p := range s.samples {
+					ts := p.Timestamp / 1000
+					if ts < tstart || ts > tend {
+						continue
+					}
+					age := ts - start
+					kmin := int64(0)
+					if age > window {
+						kmin = (age - window + round) / step
+					}
+					kmax := age / step
+					if kmax > nlast {
+						kmax = nlast
+					}
+					for k := kmin; k <= kmax; k++ {
+						kk := key{k, strings.Join(s.tags, ",")}
+						if prev, ok := latest[kk]; !ok || p.Timestamp >= prev.Timestamp {
+							latest[kk] = p
+						}
+					}
+				}
+			}
+			type group struct {
+				k    int64
+				tags string
+			}
+			sums, counts := map[group]float64{}, map[group]int{}
+			for kk, p := range latest {
+				if value.IsStaleNaN(p.Value) {
+					continue
+				}
+				g := group{kk.k, strings.Join(fakeGroupTags(strings.Split(kk.tags, ","), by), ",")}
+				sums[g] += p.Value
+				counts[g]++
+			}
+			for g, sum := range sums {
+				v := sum
+				switch agg {
+				case "avg(v)":
+					v = sum / float64(counts[g])
+				case "1":
+					v = 1
+				}
+				var tags []string
+				if g.tags != "" {
+					tags = strings.Split(g.tags, ",")
+				}
+				rows = append(rows, []driver.Value{int64(counts[g]), (first + g.k*step) * 1000, "", tags, v})
+			}
+			sort.Slice(rows, func(i, j int) bool {
+				ti, tj := strings.Join(rows[i][3].([]string), ","), strings.Join(rows[j][3].([]string), ",")
+				if ti != tj {
+					return ti < tj
+				}
+				return rows[i][1].(int64) < rows[j][1].(int64)
+			})
+
+		default:
+			*kinds = append(*kinds, "overtime")
+			b := fakeBuckets.FindStringSubmatch(query)
+			offset, bucket, agg := atoi(b[1]), atoi(b[2]), fakeOverTime.FindStringSubmatch(query)[1]
+			edges := strings.Contains(query, fmt.Sprintf("%% %d = 0", bucket))
+			for _, s := range series {
+				type key struct {
+					bucket int64
+					edge   bool
+				}
+				var keys []key
+				groups := map[key][]prompb.Sample{}
+				for _, p := range s.samples {
+					ts := p.Timestamp / 1000
+					if ts < tstart || ts > tend || value.IsStaleNaN(p.Value) {
+						continue
+					}
+					k := key{(ts - offset) / bucket, edges && (ts-offset)%bucket == 0}
+					if _, ok := groups[k]; !ok {
+						keys = append(keys, k)
+					}
+					groups[k] = append(groups[k], p)
+				}
+				for _, k := range keys {
+					samples := groups[k]
+					last := samples[len(samples)-1]
+					v := last.Value
+					for _, p := range samples {
+						switch {
+						case agg == "max(val)" && p.Value > v, agg == "min(val)" && p.Value < v:
+							v = p.Value
+						}
+					}
+					rows = append(rows, []driver.Value{int64(len(samples)), last.Timestamp, "m", s.tags, v})
+				}
+			}
+		}
+		return rows, nil
+	}
+}
+
+// fakeGroupTags keeps the tags of the grouping labels in by, a match of fakeGroupBy
+func fakeGroupTags(tags []string, by []string) []string {
+	if by == nil {
+		return nil
+	}
+	var names []string
+	for _, name := range strings.Split(by[2], ", ") {
+		names = append(names, strings.Trim(name, "'"))
+	}
+	keep := by[1] == ""
+	var kept []string
+	for _, tag := range tags {
+		has := false
+		for _, name := range names {
+			if strings.HasPrefix(tag, name+"=") {
+				has = true
+			}
+		}
+		if has == keep {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
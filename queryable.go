@@ -0,0 +1,89 @@
+package prom2click
+
+import (
+	"context"
+	"errors"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// queryable is the storage.Queryable the promql engine reads clickhouse through,
+// selects go through the same path as remote reads so hints are pushed down and results cached alike
+type queryable struct {
+	reader *promReader
+}
+
+var _ storage.Queryable = (*queryable)(nil)
+
+func (q *queryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return &querier{ctx: ctx, reader: q.reader, mint: mint, maxt: maxt}, nil
+}
+
+type querier struct {
+	ctx        context.Context
+	reader     *promReader
+	mint, maxt int64
+}
+
+func (q *querier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	mint, maxt := q.mint, q.maxt
+	if hints != nil {
+		mint, maxt = hints.Start, hints.End
+	}
+	query, err := remote.ToQuery(mint, maxt, matchers, hints)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	res, err := q.reader.readQuery(q.ctx, query)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	return remote.FromQueryResult(sortSeries, res)
+}
+
+func (q *querier) LabelValues(name string, matchers ...*labels.Matcher) ([]string, storage.Warnings, error) {
+	lq, err := q.labelQuery(matchers)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, truncated, err := q.reader.labelValues(q.ctx, name, lq)
+	return values, truncatedWarnings(truncated), err
+}
+
+func (q *querier) LabelNames(matchers ...*labels.Matcher) ([]string, storage.Warnings, error) {
+	lq, err := q.labelQuery(matchers)
+	if err != nil {
+		return nil, nil, err
+	}
+	names, truncated, err := q.reader.labelNames(q.ctx, lq)
+	return names, truncatedWarnings(truncated), err
+}
+
+func (q *querier) labelQuery(matchers []*labels.Matcher) (labelQuery, error) {
+	lq := labelQuery{start: q.mint, end: q.maxt}
+	if len(matchers) > 0 {
+		query, err := remote.ToQuery(q.mint, q.maxt, matchers, nil)
+		if err != nil {
+			return lq, err
+		}
+		lq.selectors = [][]*prompb.LabelMatcher{query.Matchers}
+	}
+	return lq, nil
+}
+
+// errTruncated warns that label results were cut at LabelMaxResults
+var errTruncated = errors.New("results truncated due to limit")
+
+func truncatedWarnings(truncated bool) storage.Warnings {
+	if truncated {
+		return storage.Warnings{errTruncated}
+	}
+	return nil
+}
+
+func (q *querier) Close() error {
+	return nil
+}
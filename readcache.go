@@ -0,0 +1,398 @@
+package prom2click
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/gotomicro/cetus/l"
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// readCache keeps the series of aligned time ranges of remote read queries,
+// the most recently used ones in memory and, when a directory is configured, every one on disk.
+// Samples written later than ReadCacheRecent invalidate the whole cache, see promWriter.invalidateCache.
+type readCache struct {
+	maxBytes int
+	dir      string
+	diskTTL  time.Duration
+
+	// disk is held for writing by invalidate so that no file of an older generation is written after it
+	disk sync.RWMutex
+
+	mu    sync.Mutex
+	gen   uint64 // incremented by invalidate, results read before are not cached anymore
+	size  int
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type readCacheEntry struct {
+	key  string
+	data []byte // marshaled prompb.QueryResult, decoded on every hit so callers may modify the series
+}
+
+// newReadCache returns nil when the cache is disabled
+func newReadCache(conf *config) (*readCache, error) {
+	if conf.ReadCacheSize <= 0 {
+		return nil, nil
+	}
+	c := &readCache{
+		maxBytes: conf.ReadCacheSize << 20,
+		dir:      conf.ReadCacheDir,
+		diskTTL:  conf.ReadCacheDiskTTL,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+	if c.dir != "" {
+		if err := os.MkdirAll(c.dir, 0o755); err != nil {
+			return nil, err
+		}
+		c.sweep()
+	}
+	return c, nil
+}
+
+// readCacheKey identifies the result of sqlStr on the clickhouse of conf
+func readCacheKey(conf *config, sqlStr string) string {
+	h := sha256.New()
+	h.Write([]byte(conf.ClickhouseDSN))
+	h.Write([]byte{0})
+	h.Write([]byte(sqlStr))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *readCache) get(key string) ([]*prompb.TimeSeries, bool) {
+	c.mu.Lock()
+	var data []byte
+	el, ok := c.items[key]
+	if ok {
+		c.lru.MoveToFront(el)
+		data = el.Value.(*readCacheEntry).data
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		if data, ok = c.readDisk(key); !ok {
+			return nil, false
+		}
+		c.add(key, data)
+	}
+	var res prompb.QueryResult
+	if err := res.Unmarshal(data); err != nil {
+		elog.Error("reader", l.S("step", "cache"), l.E(err))
+		return nil, false
+	}
+	return res.Timeseries, true
+}
+
+// generation returns the current generation, pass it to set with the results read afterwards
+func (c *readCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// set caches series read in generation gen, nothing is cached when the cache was invalidated since
+func (c *readCache) set(key string, series []*prompb.TimeSeries, gen uint64) {
+	data, err := (&prompb.QueryResult{Timeseries: series}).Marshal()
+	if err != nil {
+		elog.Error("reader", l.S("step", "cache"), l.E(err))
+		return
+	}
+	c.disk.RLock()
+	defer c.disk.RUnlock()
+	if c.generation() != gen {
+		return
+	}
+	c.add(key, data)
+	c.writeDisk(key, data)
+}
+
+// invalidate drops every cached result from memory and disk
+func (c *readCache) invalidate() {
+	c.disk.Lock()
+	defer c.disk.Unlock()
+	c.mu.Lock()
+	c.gen++
+	c.size = 0
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.mu.Unlock()
+	if c.dir != "" {
+		purgeReadCacheDir(c.dir)
+	}
+}
+
+// purgeReadCacheDir removes the files of the disk tier in dir
+func purgeReadCacheDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			elog.Error("reader", l.S("step", "cache"), l.E(err))
+		}
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// add puts data in memory, evicting the least recently used entries beyond maxBytes
+func (c *readCache) add(key string, data []byte) {
+	if len(data) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*readCacheEntry)
+		c.size += len(data) - len(entry.data)
+		entry.data = data
+		c.lru.MoveToFront(el)
+	} else {
+		c.items[key] = c.lru.PushFront(&readCacheEntry{key: key, data: data})
+		c.size += len(data)
+	}
+	for c.size > c.maxBytes {
+		el := c.lru.Back()
+		entry := el.Value.(*readCacheEntry)
+		c.lru.Remove(el)
+		delete(c.items, entry.key)
+		c.size -= len(entry.data)
+	}
+}
+
+func (c *readCache) readDisk(key string) ([]byte, bool) {
+	if c.dir == "" {
+		return nil, false
+	}
+	path := filepath.Join(c.dir, key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	if c.expired(info) {
+		_ = os.Remove(path)
+		return nil, false
+	}
+	compressed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		elog.Error("reader", l.S("step", "cache"), l.S("file", path), l.E(err))
+		_ = os.Remove(path)
+		return nil, false
+	}
+	return data, true
+}
+
+// writeDisk writes data through a temporary file so readers never see a partial entry
+func (c *readCache) writeDisk(key string, data []byte) {
+	if c.dir == "" {
+		return
+	}
+	f, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		elog.Error("reader", l.S("step", "cache"), l.E(err))
+		return
+	}
+	_, err = f.Write(snappy.Encode(nil, data))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, key))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		elog.Error("reader", l.S("step", "cache"), l.E(err))
+	}
+}
+
+func (c *readCache) expired(info os.FileInfo) bool {
+	return c.diskTTL > 0 && time.Since(info.ModTime()) > c.diskTTL
+}
+
+// sweep removes the expired and unfinished files of the disk tier
+func (c *readCache) sweep() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		elog.Error("reader", l.S("step", "cache"), l.E(err))
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(e.Name(), ".tmp-") || c.expired(info) {
+			_ = os.Remove(filepath.Join(c.dir, e.Name()))
+		}
+	}
+}
+
+// readSplit is one time range a cached query is split into, in seconds
+type readSplit struct {
+	start, end int64
+	cacheable  bool // whole interval old enough not to change anymore
+}
+
+// splitRange splits [tstart, tend] at multiples of interval seconds.
+// Only the intervals covered entirely and ending before recent are cacheable.
+func splitRange(tstart, tend, interval, recent int64) []readSplit {
+	var splits []readSplit
+	for start := tstart; start <= tend; {
+		next := (start/interval + 1) * interval
+		end := next - 1
+		if end > tend {
+			end = tend
+		}
+		splits = append(splits, readSplit{
+			start:     start,
+			end:       end,
+			cacheable: start%interval == 0 && end == next-1 && end < recent,
+		})
+		start = next
+	}
+	return splits
+}
+
+// alignBucket returns the smallest bucket not below bucket that divides interval, so that no bucket
+// straddles two intervals. false when bucket is larger than interval.
+func alignBucket(bucket, interval int64) (int64, bool) {
+	if bucket <= 0 || bucket > interval {
+		return 0, false
+	}
+	for interval%bucket != 0 {
+		bucket++
+	}
+	return bucket, true
+}
+
+// cacheBucket returns the bucket query is read with in splits of interval seconds,
+// false when it can not be split without changing its result
+func (r *promReader) cacheBucket(query *prompb.Query, tstart, tend, taggr, interval int64) (int64, bool) {
+	// configs built without Validate may have no interval to split at
+	if interval <= 0 {
+		return 0, false
+	}
+	bucket := r.queryBucket(query, tstart, tend, taggr)
+	if p, ok := r.pushdownPlan(query); ok {
+		// groups look back into the previous interval, range function buckets may be split anywhere
+		return bucket, !p.group
+	}
+	if bucket == 0 {
+		return 0, true
+	}
+	// the sampling period is only a bound on the number of points and can grow a little
+	return alignBucket(bucket, interval)
+}
+
+// readCached reads query split into aligned intervals, the complete ones come from the cache when possible.
+// false when query can not be split without changing its result.
+func (r *promReader) readCached(ctx context.Context, q *prompb.Query) (*prompb.QueryResult, bool, error) {
+	if err := validateMatchers(q.Matchers); err != nil {
+		return nil, false, err
+	}
+	tstart, tend, taggr, err := r.getTimePeriod(q)
+	if err != nil {
+		return nil, false, err
+	}
+	interval := int64(r.conf.ReadCacheSplitInterval / time.Second)
+	bucket, ok := r.cacheBucket(q, tstart, tend, taggr, interval)
+	if !ok {
+		return nil, false, nil
+	}
+
+	ctx, cancel := r.readContext(ctx)
+	defer cancel()
+	tbegin := time.Now()
+	// late samples written while the query runs must not be cached as missing
+	gen := r.cache.generation()
+	recent := time.Now().Add(-r.conf.ReadCacheRecent).Unix()
+	merged := make(map[string]*prompb.TimeSeries)
+	var keys []string
+	add := func(labels []prompb.Label, samples []prompb.Sample) {
+		key := strings.Join(labelsTags(labels), "\xff")
+		ts, ok := merged[key]
+		if !ok {
+			ts = &prompb.TimeSeries{Labels: labels}
+			merged[key] = ts
+			keys = append(keys, key)
+		}
+		// splits are read in time order and do not overlap
+		ts.Samples = append(ts.Samples, samples...)
+	}
+	for _, split := range splitRange(tstart, tend, interval, recent) {
+		sqlStr := r.rangeSQL(q, split.start, split.end, bucket)
+		var key string
+		if split.cacheable {
+			key = readCacheKey(r.conf, sqlStr)
+			if series, ok := r.cache.get(key); ok {
+				r.metrics.cache.WithLabelValues("hit").Inc()
+				for _, ts := range series {
+					add(ts.Labels, ts.Samples)
+				}
+				continue
+			}
+			r.metrics.cache.WithLabelValues("miss").Inc()
+		}
+		var series []*prompb.TimeSeries
+		_, err = r.querySQL(ctx, sqlStr, func(tags []string, samples []prompb.Sample) error {
+			labels := makeLabels(tags)
+			series = append(series, &prompb.TimeSeries{Labels: labels, Samples: samples})
+			add(labels, samples)
+			return nil
+		})
+		if err != nil {
+			return nil, true, err
+		}
+		if split.cacheable {
+			r.cache.set(key, series, gen)
+		}
+	}
+
+	// every split is within the limits, their sum may not be
+	if err = r.checkSeries(len(keys)); err != nil {
+		return nil, true, err
+	}
+	nsamples := 0
+	for _, ts := range merged {
+		nsamples += len(ts.Samples)
+	}
+	if err = r.checkSamples(nsamples); err != nil {
+		return nil, true, err
+	}
+
+	sort.Strings(keys)
+	res := &prompb.QueryResult{Timeseries: make([]*prompb.TimeSeries, 0, len(keys))}
+	for _, key := range keys {
+		res.Timeseries = append(res.Timeseries, merged[key])
+	}
+	r.metrics.duration.Observe(time.Since(tbegin).Seconds())
+	r.metrics.series.Observe(float64(len(keys)))
+	return res, true, nil
+}
+
+// labelsTags returns the key=value tags of labels
+func labelsTags(labels []prompb.Label) []string {
+	tags := make([]string, 0, len(labels))
+	for _, label := range labels {
+		tags = append(tags, label.Name+"="+label.Value)
+	}
+	return tags
+}
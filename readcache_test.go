@@ -0,0 +1,178 @@
+package prom2click
+
+import (
+	"context"
+	"database/sql/driver"
+	"os"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitRange(t *testing.T) {
+	assert.Equal(t, []readSplit{
+		{start: 50, end: 99},
+		{start: 100, end: 199, cacheable: true},
+		{start: 200, end: 299},
+		{start: 300, end: 320},
+	}, splitRange(50, 320, 100, 250))
+	assert.Equal(t, []readSplit{{start: 100, end: 199, cacheable: true}}, splitRange(100, 199, 100, 1000))
+	assert.Equal(t, []readSplit{{start: 120, end: 150}}, splitRange(120, 150, 100, 1000))
+}
+
+func TestAlignBucket(t *testing.T) {
+	for _, c := range []struct{ bucket, want int64 }{{10, 10}, {73, 75}, {86400, 86400}} {
+		got, ok := alignBucket(c.bucket, 86400)
+		assert.True(t, ok)
+		assert.Equal(t, c.want, got)
+	}
+	_, ok := alignBucket(86401, 86400)
+	assert.False(t, ok)
+}
+
+func TestReadCacheLRU(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ReadCacheSize = 1
+	conf.ReadCacheDir = t.TempDir()
+	c, err := newReadCache(conf)
+	assert.NoError(t, err)
+
+	series := func(n int) []*prompb.TimeSeries {
+		samples := make([]prompb.Sample, n)
+		for i := range samples {
+			samples[i] = prompb.Sample{Value: float64(i) + 0.5, Timestamp: int64(i)}
+		}
+		return []*prompb.TimeSeries{{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: samples}}
+	}
+	// each entry takes a bit more than 0.4MB so only two fit in memory
+	c.set("a", series(25000), 0)
+	c.set("b", series(25000), 0)
+	_, ok := c.get("a")
+	assert.True(t, ok)
+	c.set("c", series(25000), 0)
+	assert.Len(t, c.items, 2)
+	assert.NotContains(t, c.items, "b")
+
+	// evicted entries are still on disk
+	got, ok := c.get("b")
+	assert.True(t, ok)
+	assert.Len(t, got[0].Samples, 25000)
+	assert.Contains(t, c.items, "b")
+
+	// a fresh cache on the same directory finds the entries again
+	c, err = newReadCache(conf)
+	assert.NoError(t, err)
+	_, ok = c.get("c")
+	assert.True(t, ok)
+	_, ok = c.get("missing")
+	assert.False(t, ok)
+
+	conf.ReadCacheSize = 0
+	c, err = newReadCache(conf)
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+}
+
+func TestReadCached(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ReadCacheSize = 16
+	conf.ReadCacheSplitInterval = time.Hour
+	conf.ReadCacheRecent = 0
+
+	var queries int32
+	rangeRe := regexp.MustCompile(`ts >= toDateTime\((\d+)\)\) AND \(ts <= toDateTime\((\d+)\)`)
+	db := openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		atomic.AddInt32(&queries, 1)
+		m := rangeRe.FindStringSubmatch(query)
+		start, _ := strconv.ParseInt(m[1], 10, 64)
+		end, _ := strconv.ParseInt(m[2], 10, 64)
+		// one raw sample per job every 10 minutes
+		var rows [][]driver.Value
+		for _, job := range []string{"a", "b"} {
+			for ts := (start + 599) / 600 * 600; ts <= end; ts += 600 {
+				rows = append(rows, []driver.Value{int64(1), ts * 1000, "up", []string{"__name__=up", "job=" + job}, float64(ts)})
+			}
+		}
+		return rows, nil
+	})
+	cache, err := newReadCache(conf)
+	assert.NoError(t, err)
+	r := &promReader{conf: conf, db: db, metrics: newReaderMetrics(conf), cache: cache}
+
+	// 3.5 hours of raw samples, split at the hours
+	query := &prompb.Query{
+		StartTimestampMs: 1800 * 1000,
+		EndTimestampMs:   14400 * 1000,
+		Hints:            &prompb.ReadHints{Func: "rate", StepMs: 60000, RangeMs: 300000},
+	}
+	resp, err := r.Read(context.Background(), &prompb.ReadRequest{Queries: []*prompb.Query{query}})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&queries))
+	series := resp.Results[0].Timeseries
+	assert.Len(t, series, 2)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}}, series[0].Labels)
+	assert.Len(t, series[0].Samples, 22)
+	for i, s := range series[0].Samples {
+		assert.Equal(t, int64(1800+600*i)*1000, s.Timestamp)
+	}
+
+	// the three whole hours come from the cache, only the partial first and last ones are read again
+	atomic.StoreInt32(&queries, 0)
+	again, err := r.Read(context.Background(), &prompb.ReadRequest{Queries: []*prompb.Query{query}})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+	assert.Equal(t, resp, again)
+
+	// late samples invalidate the cache, every hour is read again
+	w := &promWriter{config: conf, cache: cache}
+	conf.ReadCacheRecent = time.Hour
+	w.invalidateCache([]*promRequest{{ts: time.Now()}})
+	assert.Len(t, cache.items, 3)
+	w.invalidateCache([]*promRequest{{ts: time.Now()}, {ts: time.Unix(3600, 0)}})
+	assert.Empty(t, cache.items)
+	conf.ReadCacheRecent = 0
+	atomic.StoreInt32(&queries, 0)
+	_, err = r.Read(context.Background(), &prompb.ReadRequest{Queries: []*prompb.Query{query}})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&queries))
+
+	// without a split interval nothing is cached, configs built without Validate may have none
+	conf.ReadCacheSplitInterval = 0
+	_, ok := r.cacheBucket(query, 1800, 14400, 0, 0)
+	assert.False(t, ok)
+	_, err = r.Read(context.Background(), &prompb.ReadRequest{Queries: []*prompb.Query{query}})
+	assert.NoError(t, err)
+	_, err = r.planQuery(query)
+	assert.NoError(t, err)
+}
+
+func TestReadCacheInvalidate(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ReadCacheSize = 1
+	conf.ReadCacheDir = t.TempDir()
+	c, err := newReadCache(conf)
+	assert.NoError(t, err)
+	series := []*prompb.TimeSeries{{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}}}
+
+	gen := c.generation()
+	c.set("a", series, gen)
+	c.invalidate()
+	_, ok := c.get("a")
+	assert.False(t, ok, "dropped from memory and disk")
+	entries, err := os.ReadDir(conf.ReadCacheDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// results read before the invalidation are not cached
+	c.set("b", series, gen)
+	_, ok = c.get("b")
+	assert.False(t, ok)
+	c.set("b", series, c.generation())
+	_, ok = c.get("b")
+	assert.True(t, ok)
+}
@@ -0,0 +1,69 @@
+package prom2click
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// errQueryLimit is returned when a query goes beyond one of the ReadMax*/ReadTimeout limits
+var errQueryLimit = errors.New("query limit exceeded")
+
+// clickhouse error code of queries stopped by max_execution_time
+const clickhouseTimeoutExceeded = 159
+
+// withLimits bounds the rows and execution time of b
+func (r *promReader) withLimits(b *selectBuilder) *selectBuilder {
+	if r.conf.ReadMaxSamples > 0 {
+		// one row more than allowed tells a result at the limit from one beyond it
+		b.Limit(r.conf.ReadMaxSamples + 1)
+	}
+	return r.withTimeout(b)
+}
+
+// withTimeout stops b on the clickhouse side after ReadTimeout
+func (r *promReader) withTimeout(b *selectBuilder) *selectBuilder {
+	if r.conf.ReadTimeout > 0 {
+		b.Settings(sqlf("max_execution_time = ?", int64(math.Ceil(r.conf.ReadTimeout.Seconds()))))
+	}
+	return b
+}
+
+// readContext returns the context of one query, cancelled with parent or after ReadTimeout
+func (r *promReader) readContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if r.conf.ReadTimeout > 0 {
+		return context.WithTimeout(parent, r.conf.ReadTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// checkSeries returns an error when n series go beyond ReadMaxSeries
+func (r *promReader) checkSeries(n int) error {
+	if r.conf.ReadMaxSeries > 0 && n > r.conf.ReadMaxSeries {
+		return fmt.Errorf("%w: more than %d series, use a more selective matcher", errQueryLimit, r.conf.ReadMaxSeries)
+	}
+	return nil
+}
+
+// checkSamples returns an error when n samples go beyond ReadMaxSamples
+func (r *promReader) checkSamples(n int) error {
+	if r.conf.ReadMaxSamples > 0 && n > r.conf.ReadMaxSamples {
+		return fmt.Errorf("%w: more than %d samples, use a more selective matcher or a shorter range", errQueryLimit, r.conf.ReadMaxSamples)
+	}
+	return nil
+}
+
+// timeoutError turns err into a limit error when the query ran out of time on either side
+func (r *promReader) timeoutError(ctx context.Context, err error) error {
+	if r.conf.ReadTimeout <= 0 {
+		return err
+	}
+	var exc *clickhouse.Exception
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || (errors.As(err, &exc) && exc.Code == clickhouseTimeoutExceeded) {
+		return fmt.Errorf("%w: query ran longer than %s", errQueryLimit, r.conf.ReadTimeout)
+	}
+	return err
+}
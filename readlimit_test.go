@@ -0,0 +1,84 @@
+package prom2click
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadLimitsSQL(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ReadMaxSamples = 1000
+	conf.ReadTimeout = 1500 * time.Millisecond
+	r := &promReader{conf: conf}
+	query := &prompb.Query{StartTimestampMs: 1000000, EndTimestampMs: 2000000}
+	sql, err := r.getSQL(query)
+	assert.NoError(t, err)
+	assert.Contains(t, sql, " ORDER BY tags, t LIMIT 1001 SETTINGS max_execution_time = 2")
+
+	query.Hints = &prompb.ReadHints{Func: "sum", StartMs: 1020000, EndMs: 1980000, StepMs: 30000, By: true}
+	sql, err = r.getSQL(query)
+	assert.NoError(t, err)
+	assert.Contains(t, sql, " ORDER BY gtags, t LIMIT 1001 SETTINGS max_execution_time = 2")
+
+	conf.ReadMaxRange = 10 * time.Minute
+	_, err = r.getSQL(query)
+	assert.True(t, errors.Is(err, errQueryLimit), err)
+}
+
+func TestReadLimits(t *testing.T) {
+	conf := DefaultConfig()
+	var delay time.Duration
+	db := openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		time.Sleep(delay)
+		var rows [][]driver.Value
+		for _, job := range []string{"a", "b", "c"} {
+			for ts := int64(0); ts < 4; ts++ {
+				rows = append(rows, []driver.Value{int64(1), ts * 1000, "up", []string{"__name__=up", "job=" + job}, 1.0})
+			}
+		}
+		return rows, nil
+	})
+	r := &promReader{conf: conf, db: db, metrics: newReaderMetrics(conf)}
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{EndTimestampMs: 60000}}}
+
+	_, err := r.Read(context.Background(), req)
+	assert.NoError(t, err)
+
+	conf.ReadMaxSeries = 2
+	_, err = r.Read(context.Background(), req)
+	assert.EqualError(t, err, "query limit exceeded: more than 2 series, use a more selective matcher")
+
+	conf.ReadMaxSeries = 0
+	conf.ReadMaxSamples = 10
+	_, err = r.Read(context.Background(), req)
+	assert.True(t, errors.Is(err, errQueryLimit), err)
+	assert.Contains(t, err.Error(), "more than 10 samples")
+
+	conf.ReadMaxSamples = 0
+	conf.ReadTimeout = 10 * time.Millisecond
+	delay = 50 * time.Millisecond
+	_, err = r.Read(context.Background(), req)
+	assert.EqualError(t, err, "query limit exceeded: query ran longer than 10ms")
+
+	// limits are reported to prometheus as 422 with the reason
+	cmp := &Component{Engine: gin.New(), config: conf, reader: r}
+	cmp.route()
+	body, err := proto.Marshal(req)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	cmp.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/read", bytes.NewReader(snappy.Encode(nil, body))))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "query ran longer than 10ms")
+}
@@ -0,0 +1,56 @@
+package prom2click
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+)
+
+// relabelConfig 写入时的relabel规则，字段含义与prometheus的relabel_config一致
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"`
+	Regex        string   `yaml:"regex,omitempty"`
+	Modulus      uint64   `yaml:"modulus,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  *string  `yaml:"replacement,omitempty"` // 为空时使用默认值$1
+	Action       string   `yaml:"action,omitempty"`
+}
+
+// compileRelabelConfigs converts the configured rules through yaml so that defaults
+// and validation are exactly the ones of prometheus
+func compileRelabelConfigs(rules []*relabelConfig) ([]*relabel.Config, error) {
+	out := make([]*relabel.Config, 0, len(rules))
+	for i, rule := range rules {
+		b, err := yaml.Marshal(rule)
+		if err != nil {
+			return nil, err
+		}
+		cfg := &relabel.Config{}
+		if err = yaml.UnmarshalStrict(b, cfg); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		out = append(out, cfg)
+	}
+	return out, nil
+}
+
+// relabelSeries applies the rules to the labels of a series, false means the series is dropped
+func relabelSeries(pbLabels []prompb.Label, rules []*relabel.Config) ([]prompb.Label, bool) {
+	lset := make(labels.Labels, 0, len(pbLabels))
+	for _, lb := range pbLabels {
+		lset = append(lset, labels.Label{Name: lb.Name, Value: lb.Value})
+	}
+	lset = relabel.Process(labels.New(lset...), rules...)
+	if lset == nil {
+		return nil, false
+	}
+	out := make([]prompb.Label, 0, len(lset))
+	for _, lb := range lset {
+		out = append(out, prompb.Label{Name: lb.Name, Value: lb.Value})
+	}
+	return out, true
+}
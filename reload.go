@@ -0,0 +1,230 @@
+package prom2click
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gotomicro/ego/core/econf"
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+// watchers are the containers reloaded on config changes by name. econf callbacks can not be removed,
+// so a single callback is registered and a container loaded again under the same name replaces the previous one
+var (
+	watchMu   sync.Mutex
+	watchers  = make(map[string]*Container)
+	watchOnce sync.Once
+)
+
+// watch 订阅econf配置变更，热更新可以安全修改的配置项
+func (c *Container) watch() {
+	watchOnce.Do(func() {
+		econf.OnChange(func(*econf.Configuration) {
+			watchMu.Lock()
+			list := make([]*Container, 0, len(watchers))
+			for _, w := range watchers {
+				list = append(list, w)
+			}
+			watchMu.Unlock()
+			for _, w := range list {
+				w.reload()
+			}
+		})
+	})
+	watchMu.Lock()
+	watchers[c.name] = c
+	watchMu.Unlock()
+}
+
+// unwatch 停止热更新config，组件或Storage停止时调用
+func unwatch(config *config) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	for name, c := range watchers {
+		if c.config == config {
+			delete(watchers, name)
+		}
+	}
+}
+
+// reload 重新读取配置，校验通过后应用可以热更新的配置项，其余配置项需要重启才能生效
+func (c *Container) reload() {
+	next := DefaultConfig()
+	if c.index < 0 {
+		if err := econf.UnmarshalKey(c.key, &next); err != nil {
+			c.logger.Error("reload config error", elog.FieldErr(err), elog.FieldKey(c.key))
+			return
+		}
+	} else {
+		configs := make([]*config, 0)
+		if err := econf.UnmarshalKey(c.key, &configs); err != nil {
+			c.logger.Error("reload config error", elog.FieldErr(err), elog.FieldKey(c.key))
+			return
+		}
+		if c.index >= len(configs) {
+			c.logger.Error("reload config error, config removed", elog.FieldKey(c.name))
+			return
+		}
+		mergeConfig(next, configs[c.index])
+	}
+	if err := next.Validate(); err != nil {
+		c.logger.Error("reload config rejected", elog.FieldErr(err), elog.FieldKey(c.name))
+		return
+	}
+	if err := c.config.apply(next, c.logger); err != nil {
+		c.logger.Error("reload config rejected", elog.FieldErr(err), elog.FieldKey(c.name))
+	}
+}
+
+// reloadable are the settings apply changes at runtime, every other one is read once at start
+var reloadable = map[string]bool{
+	"ClickhouseBatch":            true,
+	"ClickhouseMaxSamples":       true,
+	"ClickhouseQuantile":         true,
+	"ClickhouseFlushInterval":    true,
+	"StatsdFlushInterval":        true,
+	"EnableAccessInterceptor":    true,
+	"EnableAccessInterceptorReq": true,
+	"EnableAccessInterceptorRes": true,
+	"WriteRelabelConfigs":        true,
+}
+
+// restartChanges returns the settings which differ in next but only take effect after a restart
+func (config *config) restartChanges(next *config) []string {
+	var keys []string
+	cur, nv := reflect.ValueOf(config).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		field := cur.Type().Field(i)
+		if !field.IsExported() || reloadable[field.Name] {
+			continue
+		}
+		// port 0 binds any free port, the running config holds the one bound
+		if field.Name == "Port" && next.Port == 0 {
+			continue
+		}
+		a, b := cur.Field(i).Interface(), nv.Field(i).Interface()
+		if pa, ok := a.(*bool); ok {
+			a, b = boolValue(pa), boolValue(b.(*bool))
+		}
+		if !reflect.DeepEqual(a, b) {
+			keys = append(keys, field.Name)
+		}
+	}
+	return keys
+}
+
+// apply copies the settings which are safe to change at runtime from next,
+// changes of the other settings are logged as needing a restart
+func (config *config) apply(next *config, logger *elog.Component) error {
+	rules, err := compileRelabelConfigs(next.WriteRelabelConfigs)
+	if err != nil {
+		return err
+	}
+	for _, key := range config.restartChanges(next) {
+		logger.Warn("config change needs a restart to take effect", elog.FieldKey(key))
+	}
+
+	type change struct {
+		key      string
+		from, to interface{}
+	}
+	var changes []change
+	config.mu.Lock()
+	if config.ClickhouseBatch != next.ClickhouseBatch {
+		changes = append(changes, change{"ClickhouseBatch", config.ClickhouseBatch, next.ClickhouseBatch})
+		config.ClickhouseBatch = next.ClickhouseBatch
+	}
+	if config.ClickhouseMaxSamples != next.ClickhouseMaxSamples {
+		changes = append(changes, change{"ClickhouseMaxSamples", config.ClickhouseMaxSamples, next.ClickhouseMaxSamples})
+		config.ClickhouseMaxSamples = next.ClickhouseMaxSamples
+	}
+	if config.ClickhouseQuantile != next.ClickhouseQuantile {
+		changes = append(changes, change{"ClickhouseQuantile", config.ClickhouseQuantile, next.ClickhouseQuantile})
+		config.ClickhouseQuantile = next.ClickhouseQuantile
+	}
+	if config.ClickhouseFlushInterval != next.ClickhouseFlushInterval {
+		changes = append(changes, change{"ClickhouseFlushInterval", config.ClickhouseFlushInterval.String(), next.ClickhouseFlushInterval.String()})
+		config.ClickhouseFlushInterval = next.ClickhouseFlushInterval
+	}
+	if config.StatsdFlushInterval != next.StatsdFlushInterval {
+		changes = append(changes, change{"StatsdFlushInterval", config.StatsdFlushInterval.String(), next.StatsdFlushInterval.String()})
+		config.StatsdFlushInterval = next.StatsdFlushInterval
+	}
+	if boolValue(config.EnableAccessInterceptor) != boolValue(next.EnableAccessInterceptor) {
+		changes = append(changes, change{"EnableAccessInterceptor", boolValue(config.EnableAccessInterceptor), boolValue(next.EnableAccessInterceptor)})
+		config.EnableAccessInterceptor = next.EnableAccessInterceptor
+	}
+	if boolValue(config.EnableAccessInterceptorReq) != boolValue(next.EnableAccessInterceptorReq) {
+		changes = append(changes, change{"EnableAccessInterceptorReq", boolValue(config.EnableAccessInterceptorReq), boolValue(next.EnableAccessInterceptorReq)})
+		config.EnableAccessInterceptorReq = next.EnableAccessInterceptorReq
+	}
+	if boolValue(config.EnableAccessInterceptorRes) != boolValue(next.EnableAccessInterceptorRes) {
+		changes = append(changes, change{"EnableAccessInterceptorRes", boolValue(config.EnableAccessInterceptorRes), boolValue(next.EnableAccessInterceptorRes)})
+		config.EnableAccessInterceptorRes = next.EnableAccessInterceptorRes
+	}
+	if !reflect.DeepEqual(config.WriteRelabelConfigs, next.WriteRelabelConfigs) {
+		changes = append(changes, change{"WriteRelabelConfigs", len(config.WriteRelabelConfigs), len(next.WriteRelabelConfigs)})
+		config.WriteRelabelConfigs = next.WriteRelabelConfigs
+		config.relabelConfigs = rules
+	}
+	config.mu.Unlock()
+
+	for _, c := range changes {
+		logger.Info("config reloaded", elog.FieldKey(c.key), elog.Any("from", c.from), elog.Any("to", c.to))
+	}
+	return nil
+}
+
+// setRelabelConfigs 编译WriteRelabelConfigs
+func (config *config) setRelabelConfigs() error {
+	rules, err := compileRelabelConfigs(config.WriteRelabelConfigs)
+	if err != nil {
+		return err
+	}
+	config.mu.Lock()
+	config.relabelConfigs = rules
+	config.mu.Unlock()
+	return nil
+}
+
+func (config *config) batchSize() int {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return config.ClickhouseBatch
+}
+
+func (config *config) maxSamples() int {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return config.ClickhouseMaxSamples
+}
+
+func (config *config) quantile() float64 {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return config.ClickhouseQuantile
+}
+
+func (config *config) flushInterval() time.Duration {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return config.ClickhouseFlushInterval
+}
+
+func (config *config) statsdFlushInterval() time.Duration {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return config.StatsdFlushInterval
+}
+
+func (config *config) writeRelabelConfigs() []*relabel.Config {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return config.relabelConfigs
+}
+
+func boolValue(b *bool) bool {
+	return b != nil && *b
+}
@@ -0,0 +1,135 @@
+package prom2click
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotomicro/ego/core/econf"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	load := func(s string) {
+		assert.NoError(t, econf.LoadFromReader(strings.NewReader(s), json.Unmarshal))
+	}
+	load(`{"reloadtest": {"port": 19301, "clickhouseDSN": "clickhouse://127.0.0.1:9000", "clickhouseBatch": 100}}`)
+	c := Load("reloadtest")
+	assert.Equal(t, 100, c.config.batchSize())
+	assert.NoError(t, c.config.setRelabelConfigs())
+	// the unchanged file needs no restart
+	next := DefaultConfig()
+	assert.NoError(t, econf.UnmarshalKey("reloadtest", &next))
+	assert.Empty(t, c.config.restartChanges(next))
+
+	load(`{"reloadtest": {"port": 19302, "clickhouseDSN": "clickhouse://127.0.0.1:9000", "clickhouseBatch": 200,
+		"clickhouseQuantile": 0.9, "statsdFlushInterval": "30s", "clickhouseFlushInterval": "5s", "enableAccessInterceptorReq": true,
+		"writeRelabelConfigs": [{"sourceLabels": ["__name__"], "regex": "go_.*", "action": "drop"}]}}`)
+	c.reload()
+	assert.Equal(t, 200, c.config.batchSize())
+	assert.Equal(t, 0.9, c.config.quantile())
+	assert.Equal(t, 30*time.Second, c.config.statsdFlushInterval())
+	assert.Equal(t, 5*time.Second, c.config.flushInterval())
+	assert.True(t, boolValue(c.config.EnableAccessInterceptorReq))
+	assert.Len(t, c.config.writeRelabelConfigs(), 1)
+	// the listen address needs a restart
+	assert.Equal(t, 19301, c.config.Port)
+	next = DefaultConfig()
+	assert.NoError(t, econf.UnmarshalKey("reloadtest", &next))
+	next.ClickhouseTable = "other"
+	next.EnableReadPushdown = boolPtr(true)
+	assert.Equal(t, []string{"Port", "ClickhouseTable"}, c.config.restartChanges(next))
+	// a free port is not a change from the port it bound
+	next.Port = 0
+	assert.Equal(t, []string{"ClickhouseTable"}, c.config.restartChanges(next))
+
+	// invalid configs are rejected as a whole
+	load(`{"reloadtest": {"clickhouseDSN": "clickhouse://127.0.0.1:9000", "clickhouseBatch": 300, "clickhouseQuantile": 2}}`)
+	c.reload()
+	assert.Equal(t, 200, c.config.batchSize())
+	assert.Equal(t, 0.9, c.config.quantile())
+}
+
+func TestReloadWatchers(t *testing.T) {
+	assert.NoError(t, econf.LoadFromReader(strings.NewReader(`{"watchtest": {"clickhouseDSN": "clickhouse://127.0.0.1:9000"}}`), json.Unmarshal))
+	Load("watchtest")
+	c := Load("watchtest")
+	// loading the key again replaces the container reloaded under its name
+	watchMu.Lock()
+	assert.Same(t, c, watchers["watchtest"])
+	watchMu.Unlock()
+
+	unwatch(c.config)
+	watchMu.Lock()
+	assert.NotContains(t, watchers, "watchtest")
+	watchMu.Unlock()
+}
+
+func TestWriterFlushInterval(t *testing.T) {
+	inserts := make(chan string, 10)
+	cfg := DefaultConfig()
+	cfg.ClickhouseBatch = 100
+	cfg.ClickhouseFlushInterval = 20 * time.Millisecond
+	w, err := NewWriter(cfg)
+	assert.NoError(t, err)
+	w.db = openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		inserts <- query
+		return nil, nil
+	})
+	w.Start()
+	// a partial batch is written once the flush interval has passed
+	w.process(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}},
+	}})
+	select {
+	case query := <-inserts:
+		assert.Contains(t, query, "INSERT INTO metrics.samples")
+	case <-time.After(5 * time.Second):
+		t.Fatal("partial batch was not flushed")
+	}
+	w.close()
+	w.Wait()
+}
+
+func TestRelabel(t *testing.T) {
+	keep := "$1"
+	rules, err := compileRelabelConfigs([]*relabelConfig{
+		{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: "drop"},
+		{SourceLabels: []string{"instance"}, Regex: "([^:]+):.*", TargetLabel: "host", Replacement: &keep},
+		{Regex: "instance", Action: "labeldrop"},
+	})
+	assert.NoError(t, err)
+
+	labels, ok := relabelSeries([]prompb.Label{{Name: "__name__", Value: "go_goroutines"}}, rules)
+	assert.False(t, ok)
+	assert.Nil(t, labels)
+
+	labels, ok = relabelSeries([]prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "instance", Value: "node1:9100"},
+	}, rules)
+	assert.True(t, ok)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "host", Value: "node1"}}, labels)
+
+	_, err = compileRelabelConfigs([]*relabelConfig{{Action: "replace"}})
+	assert.Error(t, err)
+	_, err = compileRelabelConfigs([]*relabelConfig{{Action: "hashmod", TargetLabel: "x"}})
+	assert.Error(t, err)
+}
+
+func TestWriterRelabel(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ClickhouseDSN = "clickhouse://127.0.0.1:9000"
+	cfg.WriteRelabelConfigs = []*relabelConfig{{SourceLabels: []string{"__name__"}, Regex: "go_.*", Action: "drop"}}
+	w, err := NewWriter(cfg)
+	assert.NoError(t, err)
+	w.process(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "go_goroutines"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}},
+	}})
+	assert.Len(t, w.requests, 1)
+	assert.Equal(t, "up", (<-w.requests).name)
+}
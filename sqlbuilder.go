@@ -0,0 +1,343 @@
+package prom2click
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// sqlExpr is a trusted fragment of SQL, user input only gets into one through
+// sqlf or the quote functions so that it is always escaped
+type sqlExpr string
+
+// quoteString returns s as a clickhouse string literal
+func quoteString(s string) sqlExpr {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '\'':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case 0:
+			b.WriteString(`\0`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return sqlExpr(b.String())
+}
+
+// quoteIdent returns name as a back quoted clickhouse identifier
+func quoteIdent(name string) sqlExpr {
+	var b strings.Builder
+	b.Grow(len(name) + 2)
+	b.WriteByte('`')
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '\\', '`':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case 0:
+			b.WriteString(`\0`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('`')
+	return sqlExpr(b.String())
+}
+
+// sqlf replaces every ? in format with the next argument rendered as a literal,
+// strings are quoted, sqlExpr values are inserted as they are.
+// A wrong number of arguments or an unsupported type is a programming error and panics.
+func sqlf(format string, args ...interface{}) sqlExpr {
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '?' {
+			b.WriteByte(format[i])
+			continue
+		}
+		if n >= len(args) {
+			panic(fmt.Sprintf("sqlf: missing argument %d in %q", n, format))
+		}
+		b.WriteString(string(sqlLiteral(args[n])))
+		n++
+	}
+	if n != len(args) {
+		panic(fmt.Sprintf("sqlf: %d arguments for %d placeholders in %q", len(args), n, format))
+	}
+	return sqlExpr(b.String())
+}
+
+func sqlLiteral(v interface{}) sqlExpr {
+	switch v := v.(type) {
+	case sqlExpr:
+		return v
+	case string:
+		return quoteString(v)
+	case []string:
+		items := make([]string, 0, len(v))
+		for _, s := range v {
+			items = append(items, string(quoteString(s)))
+		}
+		return sqlExpr("[" + strings.Join(items, ", ") + "]")
+	case int:
+		return sqlExpr(strconv.Itoa(v))
+	case int64:
+		return sqlExpr(strconv.FormatInt(v, 10))
+	case float64:
+		// nan, inf and -inf are clickhouse literals as well
+		switch {
+		case math.IsNaN(v):
+			return "nan"
+		case math.IsInf(v, 1):
+			return "inf"
+		case math.IsInf(v, -1):
+			return "-inf"
+		}
+		return sqlExpr(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	panic(fmt.Sprintf("sqlf: unsupported argument type %T", v))
+}
+
+// selectBuilder builds a clickhouse SELECT statement
+type selectBuilder struct {
+	distinct bool
+	columns  []sqlExpr
+	from     sqlExpr
+	where    []sqlExpr
+	groupBy  []sqlExpr
+	having   []sqlExpr
+	orderBy  []sqlExpr
+	limit    int
+	settings []sqlExpr
+}
+
+func newSelect(columns ...sqlExpr) *selectBuilder {
+	return &selectBuilder{columns: columns}
+}
+
+// Distinct selects unique rows only
+func (b *selectBuilder) Distinct() *selectBuilder {
+	b.distinct = true
+	return b
+}
+
+// From sets the table to db.table
+func (b *selectBuilder) From(db, table string) *selectBuilder {
+	b.from = quoteIdent(db) + "." + quoteIdent(table)
+	return b
+}
+
+// FromQuery selects from the result of a sub query
+func (b *selectBuilder) FromQuery(q *selectBuilder) *selectBuilder {
+	b.from = sqlExpr("(" + q.String() + ")")
+	return b
+}
+
+// Where adds conditions, they are put in parentheses and joined with AND
+func (b *selectBuilder) Where(conds ...sqlExpr) *selectBuilder {
+	b.where = append(b.where, conds...)
+	return b
+}
+
+func (b *selectBuilder) GroupBy(exprs ...sqlExpr) *selectBuilder {
+	b.groupBy = append(b.groupBy, exprs...)
+	return b
+}
+
+// Having adds conditions on the groups, they are joined with AND
+func (b *selectBuilder) Having(conds ...sqlExpr) *selectBuilder {
+	b.having = append(b.having, conds...)
+	return b
+}
+
+func (b *selectBuilder) OrderBy(exprs ...sqlExpr) *selectBuilder {
+	b.orderBy = append(b.orderBy, exprs...)
+	return b
+}
+
+func (b *selectBuilder) Limit(n int) *selectBuilder {
+	b.limit = n
+	return b
+}
+
+// Settings adds query level settings such as max_execution_time = 10
+func (b *selectBuilder) Settings(settings ...sqlExpr) *selectBuilder {
+	b.settings = append(b.settings, settings...)
+	return b
+}
+
+func (b *selectBuilder) String() string {
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	if b.distinct {
+		sb.WriteString("DISTINCT ")
+	}
+	sb.WriteString(string(joinExprs(b.columns, ", ")))
+	sb.WriteString(" FROM ")
+	sb.WriteString(string(b.from))
+	if len(b.where) > 0 {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(string(sqlAnd(b.where)))
+	}
+	if len(b.groupBy) > 0 {
+		sb.WriteString(" GROUP BY ")
+		sb.WriteString(string(joinExprs(b.groupBy, ", ")))
+	}
+	if len(b.having) > 0 {
+		sb.WriteString(" HAVING ")
+		sb.WriteString(string(sqlAnd(b.having)))
+	}
+	if len(b.orderBy) > 0 {
+		sb.WriteString(" ORDER BY ")
+		sb.WriteString(string(joinExprs(b.orderBy, ", ")))
+	}
+	if b.limit > 0 {
+		sb.WriteString(" LIMIT ")
+		sb.WriteString(strconv.Itoa(b.limit))
+	}
+	if len(b.settings) > 0 {
+		sb.WriteString(" SETTINGS ")
+		sb.WriteString(string(joinExprs(b.settings, ", ")))
+	}
+	return sb.String()
+}
+
+func joinExprs(exprs []sqlExpr, sep string) sqlExpr {
+	parts := make([]string, 0, len(exprs))
+	for _, e := range exprs {
+		parts = append(parts, string(e))
+	}
+	return sqlExpr(strings.Join(parts, sep))
+}
+
+// sqlAnd joins conditions with AND, each one in parentheses
+func sqlAnd(conds []sqlExpr) sqlExpr {
+	return sqlJoinConds(conds, " AND ")
+}
+
+// sqlOr joins conditions with OR, each one in parentheses
+func sqlOr(conds []sqlExpr) sqlExpr {
+	return sqlJoinConds(conds, " OR ")
+}
+
+func sqlJoinConds(conds []sqlExpr, sep string) sqlExpr {
+	parts := make([]string, 0, len(conds))
+	for _, c := range conds {
+		parts = append(parts, "("+string(c)+")")
+	}
+	return sqlExpr(strings.Join(parts, sep))
+}
+
+// timeRangeConds restricts the date and ts columns to [start, end] seconds
+func timeRangeConds(start, end int64) []sqlExpr {
+	return []sqlExpr{
+		sqlf("date >= toDate(?)", start),
+		sqlf("ts >= toDateTime(?)", start),
+		sqlf("ts <= toDateTime(?)", end),
+	}
+}
+
+// labelCond is a label matcher translated to the columns of the samples table.
+// Like prometheus an absent label has the empty value and regular expressions match whole values.
+type labelCond struct {
+	typ   prompb.LabelMatcher_Type
+	name  string
+	value string // the value, or the anchored pattern of regex matchers
+}
+
+func newLabelCond(m *prompb.LabelMatcher) labelCond {
+	c := labelCond{typ: m.Type, name: m.Name, value: m.Value}
+	if m.Type == prompb.LabelMatcher_RE || m.Type == prompb.LabelMatcher_NRE {
+		c.value = anchorRegex(m.Value)
+	}
+	return c
+}
+
+// anchorRegex anchors re like prometheus does, clickhouse lets . match line breaks unless told otherwise
+func anchorRegex(re string) string {
+	return "(?-s)^(?:" + re + ")$"
+}
+
+// tag is the tags element of a label with a non empty value
+func (c labelCond) tag() string {
+	return c.name + "=" + c.value
+}
+
+// usesHas reports whether the condition is a plain lookup of the tag in the tags array
+func (c labelCond) usesHas() bool {
+	return c.name != model.MetricNameLabel && c.value != "" &&
+		(c.typ == prompb.LabelMatcher_EQ || c.typ == prompb.LabelMatcher_NEQ)
+}
+
+func (c labelCond) sql() sqlExpr {
+	if c.usesHas() {
+		if c.typ == prompb.LabelMatcher_NEQ {
+			return sqlf("NOT has(tags, ?)", c.tag())
+		}
+		return sqlf("has(tags, ?)", c.tag())
+	}
+	column := labelColumn(c.name)
+	switch c.typ {
+	case prompb.LabelMatcher_NEQ:
+		return sqlf("? != ?", column, c.value)
+	case prompb.LabelMatcher_RE:
+		return sqlf("match(?, ?)", column, c.value)
+	case prompb.LabelMatcher_NRE:
+		return sqlf("NOT match(?, ?)", column, c.value)
+	default:
+		return sqlf("? = ?", column, c.value)
+	}
+}
+
+// labelColumn is the value of label name in a row, ” when the series does not have it
+func labelColumn(name string) sqlExpr {
+	// __name__ is handled specially - match it directly
+	// as it is stored in the name column (it's also in tags as __name__)
+	if name == model.MetricNameLabel {
+		return "name"
+	}
+	// value of the first tag of the label, '' when there is none
+	return sqlf("substring(arrayFirst(x -> startsWith(x, ?), tags), ?)", name+"=", len(name)+2)
+}
+
+// matcherCond returns the where condition of one label matcher
+func matcherCond(m *prompb.LabelMatcher) sqlExpr {
+	return newLabelCond(m).sql()
+}
+
+// validateMatchers returns an error for matchers prometheus would reject, such as invalid regular expressions
+func validateMatchers(matchers []*prompb.LabelMatcher) error {
+	for _, m := range matchers {
+		// prompb and labels number the matcher types the same way
+		if _, err := labels.NewMatcher(labels.MatchType(m.Type), m.Name, m.Value); err != nil {
+			return fmt.Errorf("invalid matcher %s: %w", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// matchersConds returns one where condition per label matcher
+func matchersConds(matchers []*prompb.LabelMatcher) []sqlExpr {
+	conds := make([]sqlExpr, 0, len(matchers))
+	for _, m := range matchers {
+		conds = append(conds, matcherCond(m))
+	}
+	return conds
+}
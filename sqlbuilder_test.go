@@ -0,0 +1,179 @@
+package prom2click
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+// hostileInputs break out of badly quoted literals in one way or another
+var hostileInputs = []string{
+	"",
+	"plain",
+	"it's",
+	`\`,
+	`\'`,
+	`'\`,
+	`a\'); DROP TABLE metrics.samples; --`,
+	"' OR 1=1 --",
+	"`backquote`",
+	"new\nline\r\ttab",
+	"nul\x00byte",
+	"?",
+	"unicode ✓ 值",
+	`(.*|\d+)$`,
+}
+
+// readLiterals returns the unescaped values of every string literal in sql
+func readLiterals(t *testing.T, sql string) []string {
+	var out []string
+	for i := 0; i < len(sql); i++ {
+		if sql[i] != '\'' {
+			continue
+		}
+		var b strings.Builder
+		i++
+		for ; i < len(sql) && sql[i] != '\''; i++ {
+			if sql[i] != '\\' {
+				b.WriteByte(sql[i])
+				continue
+			}
+			i++
+			switch sql[i] {
+			case '0':
+				b.WriteByte(0)
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(sql[i])
+			}
+		}
+		if i >= len(sql) {
+			t.Fatalf("unterminated literal in %q", sql)
+		}
+		out = append(out, b.String())
+	}
+	return out
+}
+
+func TestQuoteString(t *testing.T) {
+	assert.Equal(t, sqlExpr(`'it\'s'`), quoteString("it's"))
+	assert.Equal(t, sqlExpr(`'a\\b'`), quoteString(`a\b`))
+	assert.Equal(t, sqlExpr(`'\n\0'`), quoteString("\n\x00"))
+	for _, s := range hostileInputs {
+		assert.Equal(t, []string{s}, readLiterals(t, string(quoteString(s))), s)
+	}
+}
+
+func TestQuoteIdent(t *testing.T) {
+	assert.Equal(t, sqlExpr("`samples`"), quoteIdent("samples"))
+	assert.Equal(t, sqlExpr("`a\\`b`"), quoteIdent("a`b"))
+	assert.Equal(t, sqlExpr("`a\\\\`"), quoteIdent(`a\`))
+}
+
+func TestSqlf(t *testing.T) {
+	assert.Equal(t, sqlExpr("a = 'x' AND b = 1 AND c = -2 AND d = 0.5 AND e = nan AND f = ['a', 'b\\'c'] AND g = now()"),
+		sqlf("a = ? AND b = ? AND c = ? AND d = ? AND e = ? AND f = ? AND g = ?",
+			"x", 1, int64(-2), 0.5, math.NaN(), []string{"a", "b'c"}, sqlExpr("now()")))
+	assert.Equal(t, sqlExpr("x = '?'"), sqlf("x = ?", "?"))
+	assert.Equal(t, sqlExpr("inf"), sqlf("?", math.Inf(1)))
+	assert.Panics(t, func() { sqlf("? ?", 1) })
+	assert.Panics(t, func() { sqlf("?", 1, 2) })
+	assert.Panics(t, func() { sqlf("?", struct{}{}) })
+}
+
+func TestSelectBuilder(t *testing.T) {
+	sql := newSelect("a", "b").From("db", "t").
+		Where("x = 1", sqlOr([]sqlExpr{"y = 1", "y = 2"})).
+		GroupBy("a").OrderBy("a", "b").Limit(10).String()
+	assert.Equal(t, "SELECT a, b FROM `db`.`t` WHERE (x = 1) AND ((y = 1) OR (y = 2)) GROUP BY a ORDER BY a, b LIMIT 10", sql)
+	assert.Equal(t, "SELECT a FROM `db`.`t`", newSelect("a").From("db", "t").String())
+}
+
+func TestMatcherCond(t *testing.T) {
+	cases := []struct {
+		typ   prompb.LabelMatcher_Type
+		name  string
+		value string
+		want  string
+	}{
+		{prompb.LabelMatcher_EQ, "__name__", "up", `name = 'up'`},
+		{prompb.LabelMatcher_NEQ, "__name__", "up", `name != 'up'`},
+		{prompb.LabelMatcher_RE, "__name__", "go_.*", `match(name, '(?-s)^(?:go_.*)$')`},
+		{prompb.LabelMatcher_NRE, "__name__", "go_.*", `NOT match(name, '(?-s)^(?:go_.*)$')`},
+		{prompb.LabelMatcher_EQ, "job", "a", `has(tags, 'job=a')`},
+		{prompb.LabelMatcher_EQ, "job", "a|b", `has(tags, 'job=a|b')`},
+		{prompb.LabelMatcher_EQ, "job", "", `substring(arrayFirst(x -> startsWith(x, 'job='), tags), 5) = ''`},
+		{prompb.LabelMatcher_NEQ, "job", "a", `NOT has(tags, 'job=a')`},
+		{prompb.LabelMatcher_NEQ, "job", "", `substring(arrayFirst(x -> startsWith(x, 'job='), tags), 5) != ''`},
+		{prompb.LabelMatcher_RE, "job", "a.*", `match(substring(arrayFirst(x -> startsWith(x, 'job='), tags), 5), '(?-s)^(?:a.*)$')`},
+		{prompb.LabelMatcher_RE, "job", `\d+`, `match(substring(arrayFirst(x -> startsWith(x, 'job='), tags), 5), '(?-s)^(?:\\d+)$')`},
+		{prompb.LabelMatcher_NRE, "job", "a.*", `NOT match(substring(arrayFirst(x -> startsWith(x, 'job='), tags), 5), '(?-s)^(?:a.*)$')`},
+	}
+	for _, c := range cases {
+		got := matcherCond(&prompb.LabelMatcher{Type: c.typ, Name: c.name, Value: c.value})
+		assert.Equal(t, sqlExpr(c.want), got, c.want)
+	}
+}
+
+func TestMatcherCondHostile(t *testing.T) {
+	types := []prompb.LabelMatcher_Type{
+		prompb.LabelMatcher_EQ, prompb.LabelMatcher_NEQ, prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE,
+	}
+	for _, typ := range types {
+		for _, name := range []string{"__name__", "job", "we'ird", `back\slash`} {
+			for _, value := range hostileInputs {
+				cond := string(matcherCond(&prompb.LabelMatcher{Type: typ, Name: name, Value: value}))
+				// whatever the input, nothing but the literals may change
+				rest := cond
+				for _, lit := range readLiterals(t, cond) {
+					rest = strings.Replace(rest, string(quoteString(lit)), "''", 1)
+				}
+				assert.NotContains(t, rest, ";", cond)
+				assert.NotContains(t, rest, "--", cond)
+				assert.NotContains(t, rest, "DROP", cond)
+
+				// the literals are exactly the label name, value or pattern
+				want := value
+				if typ == prompb.LabelMatcher_RE || typ == prompb.LabelMatcher_NRE {
+					want = anchorRegex(value)
+				}
+				lits := readLiterals(t, cond)
+				switch {
+				case name == "__name__":
+					assert.Equal(t, []string{want}, lits, cond)
+				case value != "" && (typ == prompb.LabelMatcher_EQ || typ == prompb.LabelMatcher_NEQ):
+					assert.Equal(t, []string{name + "=" + value}, lits, cond)
+				default:
+					assert.Equal(t, []string{name + "=", want}, lits, cond)
+				}
+			}
+		}
+	}
+}
+
+func TestGetSQL(t *testing.T) {
+	r := &promReader{conf: DefaultConfig()}
+	sql, err := r.getSQL(&prompb.Query{
+		StartTimestampMs: 1000000,
+		EndTimestampMs:   2000000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			{Type: prompb.LabelMatcher_RE, Name: "job", Value: "it's.*"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT COUNT() AS CNT, (intDiv(toUInt32(ts), 10) * 10) * 1000 AS t, name, tags, quantile(0.75)(val) AS value "+
+		"FROM `metrics`.`samples` WHERE (date >= toDate(1000)) AND (ts >= toDateTime(1000)) AND (ts <= toDateTime(2000)) "+
+		`AND (name = 'up') AND (match(substring(arrayFirst(x -> startsWith(x, 'job='), tags), 5), '(?-s)^(?:it\'s.*)$')) GROUP BY t, name, tags ORDER BY tags, t`, sql)
+
+	_, err = r.getSQL(&prompb.Query{StartTimestampMs: 2000, EndTimestampMs: 1000})
+	assert.Error(t, err)
+}
@@ -0,0 +1,342 @@
+package prom2click
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotomicro/cetus/l"
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// statsd metric types
+const (
+	statsdCounter = "c"
+	statsdGauge   = "g"
+	statsdTimer   = "ms"
+	statsdSet     = "s"
+)
+
+// statsdMaxPacketSize is the largest UDP datagram accepted
+const statsdMaxPacketSize = 64 << 10
+
+// statsdQuantiles are the quantiles computed for timers on every flush
+var statsdQuantiles = []float64{0.5, 0.9, 0.99}
+
+// statsdSample is one parsed statsd value
+type statsdSample struct {
+	name  string
+	typ   string
+	value float64
+	// raw value, used by sets
+	raw string
+	// relative gauge update (+/- prefix)
+	relative bool
+	rate     float64
+	tags     []prompb.Label
+}
+
+// parseStatsdLine parses `name:value[:value...]|type[|@rate][|#tag:value,...]`
+func parseStatsdLine(line string) ([]statsdSample, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid statsd line %q", line)
+	}
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid statsd line %q", line)
+	}
+	typ := parts[1]
+	switch typ {
+	case "h", "d":
+		// histograms and distributions are aggregated like timers
+		typ = statsdTimer
+	case statsdCounter, statsdGauge, statsdTimer, statsdSet:
+	default:
+		return nil, fmt.Errorf("invalid statsd type %q", parts[1])
+	}
+	rate := 1.0
+	var tags []prompb.Label
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			r, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return nil, fmt.Errorf("invalid statsd sample rate %q", part)
+			}
+			rate = r
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				k, v, _ := strings.Cut(tag, ":")
+				if k == "" || v == "" {
+					continue
+				}
+				tags = append(tags, prompb.Label{Name: sanitizeLabelName(k), Value: v})
+			}
+		}
+	}
+
+	var samples []statsdSample
+	for _, raw := range strings.Split(parts[0], ":") {
+		s := statsdSample{name: sanitizeMetricName(name), typ: typ, raw: raw, rate: rate, tags: tags}
+		if typ != statsdSet {
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid statsd value %q", raw)
+			}
+			s.value = v
+			s.relative = typ == statsdGauge && (raw[0] == '+' || raw[0] == '-')
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// statsdMetric is the aggregation state of one series
+type statsdMetric struct {
+	typ    string
+	labels []prompb.Label
+	// counter total or gauge value
+	value   float64
+	updated bool
+	// idle is the number of flushes since the last update
+	idle int
+	// timer state: values seen since the last flush, cumulative count and sum
+	values []float64
+	count  float64
+	sum    float64
+	// set members seen since the last flush
+	members map[string]struct{}
+}
+
+// statsdAggregator aggregates statsd samples between flushes,
+// counters and timer count/sum are cumulative so they can be used with rate()
+type statsdAggregator struct {
+	mu      sync.Mutex
+	metrics map[string]*statsdMetric
+	// deleteIdle drops metrics not updated for that many flushes, 0 keeps them forever
+	deleteIdle int
+}
+
+func newStatsdAggregator(deleteIdle int) *statsdAggregator {
+	return &statsdAggregator{metrics: make(map[string]*statsdMetric), deleteIdle: deleteIdle}
+}
+
+func (a *statsdAggregator) add(s statsdSample) {
+	labels := make([]prompb.Label, 0, len(s.tags)+1)
+	labels = append(labels, prompb.Label{Name: model.MetricNameLabel, Value: s.name})
+	labels = append(labels, s.tags...)
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	key := s.typ + "\xff" + labelsKey(labels)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m, ok := a.metrics[key]
+	if !ok {
+		m = &statsdMetric{typ: s.typ, labels: labels}
+		a.metrics[key] = m
+	}
+	m.updated = true
+	m.idle = 0
+	switch s.typ {
+	case statsdCounter:
+		m.value += s.value / s.rate
+	case statsdGauge:
+		if s.relative {
+			m.value += s.value
+		} else {
+			m.value = s.value
+		}
+	case statsdTimer:
+		m.values = append(m.values, s.value)
+		m.count += 1 / s.rate
+		m.sum += s.value / s.rate
+	case statsdSet:
+		if m.members == nil {
+			m.members = make(map[string]struct{})
+		}
+		m.members[s.raw] = struct{}{}
+	}
+}
+
+// flush returns the series of the metrics and resets the per interval state. Like statsd_exporter
+// counters and gauges keep reporting their last value on every flush, timers and sets only when updated.
+// Metrics idle for deleteIdle flushes are dropped and counters coming back start again from zero
+func (a *statsdAggregator) flush(now time.Time) []prompb.TimeSeries {
+	ts := now.UnixMilli()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var series []prompb.TimeSeries
+	for key, m := range a.metrics {
+		updated := m.updated
+		m.updated = false
+		if !updated {
+			if m.idle++; a.deleteIdle > 0 && m.idle >= a.deleteIdle {
+				delete(a.metrics, key)
+				continue
+			}
+			if m.typ == statsdTimer || m.typ == statsdSet {
+				continue
+			}
+		}
+		switch m.typ {
+		case statsdCounter, statsdGauge:
+			series = append(series, statsdSeries(m.labels, "", nil, m.value, ts))
+		case statsdTimer:
+			sort.Float64s(m.values)
+			for _, q := range statsdQuantiles {
+				extra := &prompb.Label{Name: model.QuantileLabel, Value: formatFloat(q)}
+				series = append(series, statsdSeries(m.labels, "", extra, quantile(m.values, q), ts))
+			}
+			series = append(series,
+				statsdSeries(m.labels, "_sum", nil, m.sum, ts),
+				statsdSeries(m.labels, "_count", nil, m.count, ts),
+			)
+			m.values = m.values[:0]
+		case statsdSet:
+			series = append(series, statsdSeries(m.labels, "", nil, float64(len(m.members)), ts))
+			m.members = nil
+		}
+	}
+	return series
+}
+
+// statsdSeries copies labels, appending suffix to the metric name and adding extra if set
+func statsdSeries(labels []prompb.Label, suffix string, extra *prompb.Label, v float64, ts int64) prompb.TimeSeries {
+	out := make([]prompb.Label, 0, len(labels)+1)
+	for _, lb := range labels {
+		if lb.Name == model.MetricNameLabel {
+			lb.Value += suffix
+		}
+		out = append(out, lb)
+	}
+	if extra != nil {
+		out = append(out, *extra)
+	}
+	return prompb.TimeSeries{
+		Labels:  out,
+		Samples: []prompb.Sample{{Value: v, Timestamp: ts}},
+	}
+}
+
+// quantile returns the q-quantile of sorted values using nearest rank
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// statsdServer receives statsd packets over udp and flushes the aggregates to the writer
+type statsdServer struct {
+	config *config
+	writer *promWriter
+	logger *elog.Component
+	agg    *statsdAggregator
+	conn   net.PacketConn
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newStatsdServer(config *config, writer *promWriter, logger *elog.Component) *statsdServer {
+	return &statsdServer{
+		config: config,
+		writer: writer,
+		logger: logger,
+		agg:    newStatsdAggregator(config.StatsdDeleteIdle),
+		quit:   make(chan struct{}),
+	}
+}
+
+func (s *statsdServer) listen() error {
+	var err error
+	s.conn, err = net.ListenPacket("udp", s.config.StatsdAddress)
+	return err
+}
+
+func (s *statsdServer) start() {
+	s.logger.Info("statsd listener", elog.String("addr", s.conn.LocalAddr().String()))
+	s.wg.Add(2)
+	go s.serve()
+	go s.flushLoop()
+}
+
+// stop closes the listener and flushes the last aggregates to the writer
+func (s *statsdServer) stop() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	close(s.quit)
+	s.wg.Wait()
+	s.flush()
+}
+
+func (s *statsdServer) serve() {
+	defer s.wg.Done()
+	buf := make([]byte, statsdMaxPacketSize)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("statsd udp read", elog.FieldErr(err))
+			}
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			samples, err := parseStatsdLine(line)
+			if err != nil {
+				elog.Warn("statsd", l.S("step", "parse"), l.E(err))
+				continue
+			}
+			for _, sample := range samples {
+				s.agg.add(sample)
+			}
+		}
+	}
+}
+
+func (s *statsdServer) flushLoop() {
+	defer s.wg.Done()
+	interval := s.config.statsdFlushInterval()
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+			// pick up a reloaded interval
+			if next := s.config.statsdFlushInterval(); next > 0 && next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *statsdServer) flush() {
+	series := s.agg.flush(time.Now())
+	if len(series) > 0 {
+		s.writer.process(&prompb.WriteRequest{Timeseries: series})
+	}
+}
@@ -0,0 +1,152 @@
+package prom2click
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	samples, err := parseStatsdLine("api.requests:2|c|@0.5|#env:prod,region:eu")
+	assert.NoError(t, err)
+	assert.Equal(t, []statsdSample{{
+		name:  "api_requests",
+		typ:   statsdCounter,
+		value: 2,
+		raw:   "2",
+		rate:  0.5,
+		tags:  []prompb.Label{{Name: "env", Value: "prod"}, {Name: "region", Value: "eu"}},
+	}}, samples)
+
+	samples, err = parseStatsdLine("latency:10:20|h")
+	assert.NoError(t, err)
+	assert.Len(t, samples, 2)
+	assert.Equal(t, statsdTimer, samples[1].typ)
+	assert.Equal(t, 20.0, samples[1].value)
+
+	samples, err = parseStatsdLine("temp:-3|g")
+	assert.NoError(t, err)
+	assert.True(t, samples[0].relative)
+
+	for _, line := range []string{"foo", "foo:1", "foo:1|x", "foo:x|c", "foo:1|c|@2"} {
+		_, err = parseStatsdLine(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func flushValues(series []prompb.TimeSeries) map[string]float64 {
+	values := make(map[string]float64, len(series))
+	for _, ts := range series {
+		values[labelsKey(ts.Labels)] = ts.Samples[0].Value
+	}
+	return values
+}
+
+func TestStatsdAggregator(t *testing.T) {
+	agg := newStatsdAggregator(10)
+	for _, line := range []string{
+		"hits:1|c", "hits:1|c|@0.1",
+		"temp:20|g", "temp:+2|g",
+		"users:alice|s", "users:bob|s", "users:alice|s",
+		"rt:1|ms", "rt:2|ms", "rt:3|ms", "rt:4|ms",
+	} {
+		samples, err := parseStatsdLine(line)
+		assert.NoError(t, err)
+		for _, s := range samples {
+			agg.add(s)
+		}
+	}
+	name := func(n string, extra ...prompb.Label) string {
+		return labelsKey(append([]prompb.Label{{Name: "__name__", Value: n}}, extra...))
+	}
+	q := func(v string) prompb.Label { return prompb.Label{Name: "quantile", Value: v} }
+	assert.Equal(t, map[string]float64{
+		name("hits"):          11,
+		name("temp"):          22,
+		name("users"):         2,
+		name("rt", q("0.5")):  2,
+		name("rt", q("0.9")):  4,
+		name("rt", q("0.99")): 4,
+		name("rt_sum"):        10,
+		name("rt_count"):      4,
+	}, flushValues(agg.flush(time.Unix(1, 0))))
+
+	// counters and gauges repeat their last value, timers and sets are only sent when updated
+	assert.Equal(t, map[string]float64{
+		name("hits"): 11,
+		name("temp"): 22,
+	}, flushValues(agg.flush(time.Unix(2, 0))))
+
+	// counters stay cumulative across flushes
+	samples, _ := parseStatsdLine("hits:1|c")
+	agg.add(samples[0])
+	assert.Equal(t, map[string]float64{name("hits"): 12, name("temp"): 22}, flushValues(agg.flush(time.Unix(3, 0))))
+}
+
+func TestStatsdAggregatorDeleteIdle(t *testing.T) {
+	agg := newStatsdAggregator(2)
+	add := func(line string) {
+		samples, err := parseStatsdLine(line)
+		assert.NoError(t, err)
+		agg.add(samples[0])
+	}
+	add("hits:1|c")
+	add("temp:20|g")
+	assert.Len(t, agg.flush(time.Unix(1, 0)), 2)
+
+	add("temp:21|g")
+	assert.Len(t, agg.flush(time.Unix(2, 0)), 2)
+	assert.Len(t, agg.metrics, 2)
+	// hits was idle for two flushes, temp is still reported
+	assert.Equal(t, "temp", agg.flush(time.Unix(3, 0))[0].Labels[0].Value)
+	assert.Len(t, agg.metrics, 1)
+	assert.Empty(t, agg.flush(time.Unix(4, 0)))
+	assert.Empty(t, agg.metrics)
+
+	add("hits:1|c")
+	assert.Equal(t, 1.0, agg.flush(time.Unix(5, 0))[0].Samples[0].Value)
+}
+
+func TestStatsdServer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.StatsdAddress = "127.0.0.1:0"
+	w, err := NewWriter(cfg)
+	assert.NoError(t, err)
+	s := newStatsdServer(cfg, w, elog.DefaultLogger)
+	assert.NoError(t, s.listen())
+	s.start()
+
+	conn, err := net.Dial("udp", s.conn.LocalAddr().String())
+	assert.NoError(t, err)
+	fmt.Fprintf(conn, "a:1|c\nb:2|g")
+	conn.Close()
+	// stop flushes the pending aggregates
+	assert.Eventually(t, func() bool { return len(pendingStatsdNames(s.agg)) == 2 }, time.Second, 10*time.Millisecond)
+	s.stop()
+
+	var names []string
+	for len(w.requests) > 0 {
+		names = append(names, (<-w.requests).name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"a", "b"}, names)
+}
+
+// pendingStatsdNames returns the names of the metrics waiting for the next flush
+func pendingStatsdNames(a *statsdAggregator) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var names []string
+	for _, m := range a.metrics {
+		if m.updated {
+			names = append(names, m.labels[0].Value)
+		}
+	}
+	return names
+}
@@ -0,0 +1,184 @@
+package prom2click
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// errStorageClosed is returned by appenders committing after Storage.Close
+var errStorageClosed = errors.New("prom2click storage is closed")
+
+// Storage 以clickhouse为存储的prometheus storage.Queryable和storage.Appendable，
+// 不启动http服务，供Go程序直接读写。读与remote read使用同样的SQL，写与remote write共用分批写入。
+// 注意与prometheus TSDB不同，Appender的Commit只把样本放入写入队列，返回nil不代表样本已写入clickhouse，
+// 之后写入失败的样本只记录日志和丢弃指标，不会返回给调用方。Close会等待队列中的样本写完
+type Storage struct {
+	queryable queryable
+	writer    *promWriter
+	mu        sync.RWMutex
+	closed    bool
+}
+
+var (
+	_ storage.Queryable  = (*Storage)(nil)
+	_ storage.Appendable = (*Storage)(nil)
+)
+
+// NewStorage 根据配置创建Storage并启动写入，配置通常来自DefaultConfig或Container，用完需要Close
+func NewStorage(conf *config) (*Storage, error) {
+	reader, err := NewReader(conf)
+	if err != nil {
+		if reader != nil && reader.db != nil {
+			_ = reader.db.Close()
+		}
+		return nil, err
+	}
+	writer, err := NewWriter(conf)
+	if err != nil {
+		_ = reader.db.Close()
+		return nil, err
+	}
+	writer.cache = reader.cache
+	writer.Start()
+	return &Storage{queryable: queryable{reader: reader}, writer: writer}, nil
+}
+
+// BuildStorage 校验配置并构建Storage
+func (c *Container) BuildStorage(options ...Option) (*Storage, error) {
+	for _, option := range options {
+		option(c)
+	}
+	if err := c.config.Validate(); err != nil {
+		return nil, err
+	}
+	return NewStorage(c.config)
+}
+
+// Querier 返回[mint, maxt]毫秒范围内的Querier
+func (s *Storage) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return s.queryable.Querier(ctx, mint, maxt)
+}
+
+// Appender 返回一个Appender，Commit时样本进入写入队列，由后台按ClickhouseBatch分批写入。
+// Commit返回nil只表示样本已入队，不表示已持久化，见Storage
+func (s *Storage) Appender(ctx context.Context) storage.Appender {
+	return &appender{storage: s, refs: make(map[storage.SeriesRef]int)}
+}
+
+// Close 停止写入，等待队列中的样本写完后关闭clickhouse连接
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	unwatch(s.writer.config)
+	s.writer.close()
+	s.writer.Wait()
+	var errs []error
+	if s.queryable.reader != nil {
+		errs = append(errs, s.queryable.reader.db.Close())
+	}
+	errs = append(errs, s.writer.db.Close())
+	return errors.Join(errs...)
+}
+
+// enqueue hands req to the writer unless the storage is closed
+func (s *Storage) enqueue(req *prompb.WriteRequest) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errStorageClosed
+	}
+	s.writer.process(req)
+	return nil
+}
+
+// appender collects the samples of one transaction as a write request
+type appender struct {
+	storage *Storage
+	series  []prompb.TimeSeries
+	// refs is the index in series of every series ref handed out, refs are label hashes
+	refs map[storage.SeriesRef]int
+}
+
+func (a *appender) Append(ref storage.SeriesRef, l labels.Labels, t int64, v float64) (storage.SeriesRef, error) {
+	if len(l) == 0 {
+		return 0, errors.New("empty labelset")
+	}
+	sample := prompb.Sample{Timestamp: t, Value: v}
+	if ref == 0 || !a.sameSeries(ref, l) {
+		ref = storage.SeriesRef(l.Hash())
+	}
+	if a.sameSeries(ref, l) {
+		i := a.refs[ref]
+		a.series[i].Samples = append(a.series[i].Samples, sample)
+		return ref, nil
+	}
+	if _, ok := a.refs[ref]; ok {
+		// hash collision, the series gets no ref and its samples are sent as separate series
+		ref = 0
+	} else {
+		a.refs[ref] = len(a.series)
+	}
+	a.series = append(a.series, prompb.TimeSeries{Labels: labelsToProto(l), Samples: []prompb.Sample{sample}})
+	return ref, nil
+}
+
+// sameSeries reports whether ref was handed out for the series l
+func (a *appender) sameSeries(ref storage.SeriesRef, l labels.Labels) bool {
+	i, ok := a.refs[ref]
+	if !ok {
+		return false
+	}
+	pb := a.series[i].Labels
+	if len(pb) != len(l) {
+		return false
+	}
+	for j := range l {
+		if pb[j].Name != l[j].Name || pb[j].Value != l[j].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// AppendExemplar is not supported, the samples table has no place for exemplars
+func (a *appender) AppendExemplar(ref storage.SeriesRef, l labels.Labels, e exemplar.Exemplar) (storage.SeriesRef, error) {
+	return 0, storage.ErrExemplarsDisabled
+}
+
+// Commit queues the samples for the writer, nil does not mean they are in clickhouse yet.
+// Commit and Rollback leave the appender empty and ready for the next transaction
+func (a *appender) Commit() error {
+	series := a.series
+	a.reset()
+	if len(series) == 0 {
+		return nil
+	}
+	return a.storage.enqueue(&prompb.WriteRequest{Timeseries: series})
+}
+
+func (a *appender) Rollback() error {
+	a.reset()
+	return nil
+}
+
+func (a *appender) reset() {
+	a.series, a.refs = nil, make(map[storage.SeriesRef]int)
+}
+
+func labelsToProto(l labels.Labels) []prompb.Label {
+	out := make([]prompb.Label, 0, len(l))
+	for _, lb := range l {
+		out = append(out, prompb.Label{Name: lb.Name, Value: lb.Value})
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package prom2click
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageAppender(t *testing.T) {
+	conf := DefaultConfig()
+	// the writer is not started, queued samples stay in its channel
+	w, err := NewWriter(conf)
+	assert.NoError(t, err)
+	reader := &promReader{conf: conf, db: openFakeDB(t, func(string) ([][]driver.Value, error) { return nil, nil })}
+	s := &Storage{queryable: queryable{reader: reader}, writer: w}
+
+	app := s.Appender(context.Background())
+	up := labels.FromStrings("__name__", "up", "job", "a")
+	ref, err := app.Append(0, up, 1000, 1)
+	assert.NoError(t, err)
+	assert.NotZero(t, ref)
+	ref2, err := app.Append(ref, up, 2000, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, ref, ref2)
+	// a ref of another series is not trusted
+	_, err = app.Append(ref, labels.FromStrings("__name__", "up", "job", "b"), 1000, 1)
+	assert.NoError(t, err)
+	_, err = app.Append(0, labels.Labels{}, 1000, 1)
+	assert.Error(t, err)
+	assert.NoError(t, app.Commit())
+
+	assert.Len(t, w.requests, 3)
+	for _, want := range []struct {
+		tags []string
+		ts   int64
+		val  float64
+	}{
+		{[]string{"__name__=up", "job=a"}, 1, 1},
+		{[]string{"__name__=up", "job=a"}, 2, 0},
+		{[]string{"__name__=up", "job=b"}, 1, 1},
+	} {
+		req := <-w.requests
+		assert.Equal(t, "up", req.name)
+		assert.Equal(t, want.tags, req.tags)
+		assert.Equal(t, time.Unix(want.ts, 0), req.ts)
+		assert.Equal(t, want.val, req.val)
+	}
+
+	// the appender is used again after Commit
+	_, err = app.Append(ref, up, 3000, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, app.Commit())
+	assert.Len(t, w.requests, 1)
+	<-w.requests
+
+	app = s.Appender(context.Background())
+	_, err = app.Append(0, up, 3000, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, app.Rollback())
+	assert.Len(t, w.requests, 0)
+	_, err = app.Append(0, up, 4000, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, app.Rollback())
+
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s.Close())
+	// both connections are closed
+	assert.Error(t, reader.db.Ping())
+	assert.Error(t, w.db.Ping())
+	app = s.Appender(context.Background())
+	_, err = app.Append(0, up, 3000, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, errStorageClosed, app.Commit())
+}
+
+func TestStorageQuerier(t *testing.T) {
+	conf := DefaultConfig()
+	db := openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		return [][]driver.Value{
+			{int64(1), int64(1000), "up", []string{"__name__=up", "job=a"}, 1.0},
+			{int64(1), int64(2000), "up", []string{"__name__=up", "job=a"}, 0.0},
+		}, nil
+	})
+	s := &Storage{queryable: queryable{reader: &promReader{conf: conf, db: db, metrics: newReaderMetrics(conf)}}}
+
+	var _ storage.Queryable = s
+	q, err := s.Querier(context.Background(), 0, 60000)
+	assert.NoError(t, err)
+	defer q.Close()
+	set := q.Select(true, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+	assert.True(t, set.Next())
+	series := set.At()
+	assert.Equal(t, labels.FromStrings("__name__", "up", "job", "a"), series.Labels())
+	it := series.Iterator()
+	var got []float64
+	for it.Next() {
+		_, v := it.At()
+		got = append(got, v)
+	}
+	assert.Equal(t, []float64{1, 0}, got)
+	assert.False(t, set.Next())
+	assert.NoError(t, set.Err())
+}
@@ -0,0 +1,383 @@
+package prom2click
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// thanosStoreAPI is the thanos.Store grpc service
+type thanosStoreAPI interface {
+	Info(ctx context.Context, req *thanosInfoRequest) (*thanosInfoResponse, error)
+	Series(req *thanosSeriesRequest, stream grpc.ServerStream) error
+	LabelNames(ctx context.Context, req *thanosLabelNamesRequest) (*thanosLabelNamesResponse, error)
+	LabelValues(ctx context.Context, req *thanosLabelValuesRequest) (*thanosLabelValuesResponse, error)
+}
+
+var thanosStoreServiceDesc = grpc.ServiceDesc{
+	ServiceName: "thanos.Store",
+	HandlerType: (*thanosStoreAPI)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Info",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(thanosInfoRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(thanosStoreAPI).Info(ctx, req)
+			},
+		},
+		{
+			MethodName: "LabelNames",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(thanosLabelNamesRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(thanosStoreAPI).LabelNames(ctx, req)
+			},
+		},
+		{
+			MethodName: "LabelValues",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(thanosLabelValuesRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(thanosStoreAPI).LabelValues(ctx, req)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Series",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(thanosSeriesRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(thanosStoreAPI).Series(req, stream)
+			},
+			ServerStreams: true,
+		},
+	},
+	Metadata: "store/storepb/rpc.proto",
+}
+
+// thanosStoreServer serves the clickhouse reader to thanos queriers as a StoreAPI
+type thanosStoreServer struct {
+	config   *config
+	reader   *promReader
+	logger   *elog.Component
+	server   *grpc.Server
+	listener net.Listener
+	wg       sync.WaitGroup
+	// external are the sorted ThanosExternalLabels
+	external []thanosLabel
+}
+
+func newThanosStoreServer(config *config, reader *promReader, logger *elog.Component) *thanosStoreServer {
+	s := &thanosStoreServer{
+		config: config,
+		reader: reader,
+		logger: logger,
+		server: grpc.NewServer(grpc.ForceServerCodec(thanosCodec{})),
+	}
+	for name, value := range config.ThanosExternalLabels {
+		s.external = append(s.external, thanosLabel{Name: name, Value: value})
+	}
+	sort.Slice(s.external, func(i, j int) bool { return s.external[i].Name < s.external[j].Name })
+	s.server.RegisterService(&thanosStoreServiceDesc, s)
+	return s
+}
+
+func (s *thanosStoreServer) listen() error {
+	var err error
+	s.listener, err = net.Listen("tcp", s.config.ThanosStoreAddress)
+	return err
+}
+
+func (s *thanosStoreServer) start() {
+	s.logger.Info("thanos store listener", elog.String("addr", s.listener.Addr().String()))
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.server.Serve(s.listener); err != nil {
+			s.logger.Error("thanos store serve", elog.FieldErr(err))
+		}
+	}()
+}
+
+// stop waits for the running calls and closes the listener
+func (s *thanosStoreServer) stop() {
+	s.server.GracefulStop()
+	s.wg.Wait()
+}
+
+func (s *thanosStoreServer) Info(ctx context.Context, req *thanosInfoRequest) (*thanosInfoResponse, error) {
+	resp := &thanosInfoResponse{
+		Labels:    s.external,
+		MinTime:   math.MinInt64,
+		MaxTime:   math.MaxInt64,
+		StoreType: thanosStoreTypeStore,
+	}
+	if s.config.ThanosRetention > 0 {
+		resp.MinTime = time.Now().Add(-s.config.ThanosRetention).UnixMilli()
+	}
+	if len(s.external) > 0 {
+		resp.LabelSets = [][]thanosLabel{s.external}
+	}
+	return resp, nil
+}
+
+func (s *thanosStoreServer) Series(req *thanosSeriesRequest, stream grpc.ServerStream) error {
+	matchers, ok, err := s.matchers(req.Matchers)
+	if err != nil || !ok {
+		return err
+	}
+	ctx := stream.Context()
+	query := &prompb.Query{StartTimestampMs: req.MinTime, EndTimestampMs: req.MaxTime, Matchers: matchers}
+	if !req.SkipChunks {
+		// raw samples only, downsampled quantiles sent as raw chunks would break rate and friends
+		var sendErr error
+		err = s.readRaw(ctx, query, func(tags []string, samples []prompb.Sample) error {
+			chunks, err := encodeChunks(samples)
+			if err != nil {
+				return err
+			}
+			sr := &thanosSeries{Labels: s.labels(tags)}
+			for _, c := range chunks {
+				sr.Chunks = append(sr.Chunks, thanosAggrChunk{
+					MinTime: c.MinTimeMs,
+					MaxTime: c.MaxTimeMs,
+					Raw:     &thanosChunk{Type: thanosChunkXOR, Data: c.Data},
+				})
+			}
+			sendErr = stream.SendMsg(&thanosSeriesResponse{Series: sr})
+			return sendErr
+		})
+		if sendErr != nil || err == nil {
+			return sendErr
+		}
+		return thanosError(err)
+	}
+
+	tags, truncated, err := s.reader.series(ctx, labelQuery{
+		selectors: [][]*prompb.LabelMatcher{matchers},
+		start:     req.MinTime,
+		end:       req.MaxTime,
+	})
+	if err != nil {
+		return thanosError(err)
+	}
+	if truncated {
+		if err = stream.SendMsg(&thanosSeriesResponse{Warning: errTruncated.Error()}); err != nil {
+			return err
+		}
+	}
+	// at most LabelMaxResults series, sorted like the samples below
+	series := make([]*thanosSeries, 0, len(tags))
+	for _, t := range tags {
+		series = append(series, &thanosSeries{Labels: s.labels(t)})
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return compareThanosLabels(series[i].Labels, series[j].Labels) < 0
+	})
+	for _, sr := range series {
+		if err = stream.SendMsg(&thanosSeriesResponse{Series: sr}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRaw calls fn with the raw samples of every series of query as it is read, within the read limits.
+// Thanos merges the series of its stores and expects them sorted by their labels, external labels included,
+// which is not the order of the tags column, so clickhouse sorts them by the labels they are sent with.
+func (s *thanosStoreServer) readRaw(ctx context.Context, query *prompb.Query, fn func(tags []string, samples []prompb.Sample) error) error {
+	r := s.reader
+	if err := validateMatchers(query.Matchers); err != nil {
+		return err
+	}
+	tstart, tend, _, err := r.getTimePeriod(query)
+	if err != nil {
+		return err
+	}
+	sqlStr := r.withLimits(r.rawSelect(query, tstart, tend).OrderBy(s.labelsOrder(), "tags", "t")).String()
+	ctx, cancel := r.readContext(ctx)
+	defer cancel()
+	tbegin := time.Now()
+	nseries, err := r.querySQL(ctx, sqlStr, fn)
+	if err != nil {
+		return err
+	}
+	r.metrics.duration.Observe(time.Since(tbegin).Seconds())
+	r.metrics.series.Observe(float64(nseries))
+	return nil
+}
+
+// labelsOrder returns the expression sorting rows like compareThanosLabels sorts the labels of their series:
+// the (name, value) pairs of the tags as makeLabels and labels turn them into, external labels included
+func (s *thanosStoreServer) labelsOrder() sqlExpr {
+	// tags with an empty value are no labels
+	keep := sqlExpr("position(x, '=') < length(x)")
+	pairs := sqlf("(?, substring(x, position(x, '=') + 1))", tagName)
+	if len(s.external) == 0 {
+		return sqlf("arraySort(arrayMap(x -> ?, arrayFilter(x -> ?, tags)))", pairs, keep)
+	}
+	names := make([]string, 0, len(s.external))
+	external := make([]sqlExpr, 0, len(s.external))
+	for _, l := range s.external {
+		names = append(names, l.Name)
+		external = append(external, sqlf("(?, ?)", l.Name, l.Value))
+	}
+	return sqlf("arraySort(arrayConcat(arrayMap(x -> ?, arrayFilter(x -> ? AND NOT has(?, ?), tags)), [?]))",
+		pairs, keep, names, tagName, joinExprs(external, ", "))
+}
+
+func (s *thanosStoreServer) LabelNames(ctx context.Context, req *thanosLabelNamesRequest) (*thanosLabelNamesResponse, error) {
+	q, ok, err := s.labelQuery(req.Matchers, req.Start, req.End)
+	resp := &thanosLabelNamesResponse{}
+	if err != nil || !ok {
+		return resp, err
+	}
+	names, truncated, err := s.reader.labelNames(ctx, q)
+	if err != nil {
+		return nil, thanosError(err)
+	}
+	for _, l := range s.external {
+		names = append(names, l.Name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			resp.Names = append(resp.Names, name)
+		}
+	}
+	if truncated {
+		resp.Warnings = []string{errTruncated.Error()}
+	}
+	return resp, nil
+}
+
+func (s *thanosStoreServer) LabelValues(ctx context.Context, req *thanosLabelValuesRequest) (*thanosLabelValuesResponse, error) {
+	q, ok, err := s.labelQuery(req.Matchers, req.Start, req.End)
+	resp := &thanosLabelValuesResponse{}
+	if err != nil || !ok {
+		return resp, err
+	}
+	for _, l := range s.external {
+		if l.Name == req.Label {
+			resp.Values = []string{l.Value}
+			return resp, nil
+		}
+	}
+	values, truncated, err := s.reader.labelValues(ctx, req.Label, q)
+	if err != nil {
+		return nil, thanosError(err)
+	}
+	resp.Values = values
+	if truncated {
+		resp.Warnings = []string{errTruncated.Error()}
+	}
+	return resp, nil
+}
+
+func (s *thanosStoreServer) labelQuery(ms []thanosLabelMatcher, start, end int64) (labelQuery, bool, error) {
+	matchers, ok, err := s.matchers(ms)
+	if err != nil || !ok {
+		return labelQuery{}, ok, err
+	}
+	q := labelQuery{start: start, end: end}
+	if len(matchers) > 0 {
+		q.selectors = [][]*prompb.LabelMatcher{matchers}
+	}
+	return q, true, nil
+}
+
+// matchers converts ms to remote read matchers, matchers of external labels are checked against them
+// and left out, false when they exclude every series of this store
+func (s *thanosStoreServer) matchers(ms []thanosLabelMatcher) ([]*prompb.LabelMatcher, bool, error) {
+	out := make([]*prompb.LabelMatcher, 0, len(ms))
+next:
+	for _, m := range ms {
+		// thanos and prompb number the matcher types the same way
+		lm, err := labels.NewMatcher(labels.MatchType(m.Type), m.Name, m.Value)
+		if err != nil {
+			return nil, false, status.Error(codes.InvalidArgument, err.Error())
+		}
+		for _, l := range s.external {
+			if l.Name == m.Name {
+				if !lm.Matches(l.Value) {
+					return nil, false, nil
+				}
+				continue next
+			}
+		}
+		out = append(out, &prompb.LabelMatcher{Type: prompb.LabelMatcher_Type(m.Type), Name: m.Name, Value: m.Value})
+	}
+	return out, true, nil
+}
+
+// labels returns the labels of the series with tags, external labels replace labels of the same name
+func (s *thanosStoreServer) labels(tags []string) []thanosLabel {
+	out := make([]thanosLabel, 0, len(tags)+len(s.external))
+	for _, l := range makeLabels(tags) {
+		if !s.isExternal(l.Name) {
+			out = append(out, thanosLabel{Name: l.Name, Value: l.Value})
+		}
+	}
+	out = append(out, s.external...)
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (s *thanosStoreServer) isExternal(name string) bool {
+	for _, l := range s.external {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func compareThanosLabels(a, b []thanosLabel) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			if a[i].Name < b[i].Name {
+				return -1
+			}
+			return 1
+		}
+		if a[i].Value != b[i].Value {
+			if a[i].Value < b[i].Value {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// thanosError maps reader errors to grpc status codes
+func thanosError(err error) error {
+	switch {
+	case errors.Is(err, errQueryLimit):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
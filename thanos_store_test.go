@@ -0,0 +1,162 @@
+package prom2click
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gotomicro/ego/core/elog"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestThanosCodec(t *testing.T) {
+	// LabelMatcher and Label are laid out like their prompb counterparts
+	pb, err := (&prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: "a.*"}).Marshal()
+	assert.NoError(t, err)
+	var m thanosLabelMatcher
+	assert.NoError(t, m.unmarshal(pb))
+	assert.Equal(t, thanosLabelMatcher{Type: 3, Name: "job", Value: "a.*"}, m)
+	assert.Equal(t, pb, m.marshal(nil))
+
+	resp := &thanosSeriesResponse{Series: &thanosSeries{
+		Labels: []thanosLabel{{Name: "__name__", Value: "up"}},
+		Chunks: []thanosAggrChunk{{MinTime: -1, MaxTime: 2, Raw: &thanosChunk{Data: []byte{1, 2}}}},
+	}}
+	b, err := thanosCodec{}.Marshal(resp)
+	assert.NoError(t, err)
+	var got thanosSeriesResponse
+	assert.NoError(t, thanosCodec{}.Unmarshal(b, &got))
+	assert.Equal(t, *resp, got)
+
+	// unknown fields such as hints are skipped
+	req := (&thanosSeriesRequest{MinTime: 1, MaxTime: 2, SkipChunks: true}).marshal(nil)
+	req = appendString(req, 9, "hints")
+	var sr thanosSeriesRequest
+	assert.NoError(t, sr.unmarshal(req))
+	assert.Equal(t, thanosSeriesRequest{MinTime: 1, MaxTime: 2, SkipChunks: true}, sr)
+}
+
+func TestThanosStore(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ThanosExternalLabels = map[string]string{"cluster": "eu", "job": "override"}
+	var queries []string
+	db := openFakeDB(t, func(query string) ([][]driver.Value, error) {
+		queries = append(queries, query)
+		switch {
+		case strings.HasPrefix(query, "SELECT DISTINCT tags"):
+			return [][]driver.Value{{[]string{"__name__=up", "instance=b"}}, {[]string{"__name__=up", "instance=a"}}}, nil
+		case strings.Contains(query, " AS label "):
+			return [][]driver.Value{{"__name__"}, {"instance"}}, nil
+		}
+		return [][]driver.Value{
+			{int64(1), int64(1000), "up", []string{"__name__=up", "instance=a", "job=node"}, 1.0},
+			{int64(1), int64(2000), "up", []string{"__name__=up", "instance=a", "job=node"}, 0.0},
+		}, nil
+	})
+	r := &promReader{conf: conf, db: db, metrics: newReaderMetrics(conf)}
+	s := newThanosStoreServer(conf, r, elog.EgoLogger)
+	lis := bufconn.Listen(1 << 20)
+	go func() { _ = s.server.Serve(lis) }()
+	defer s.server.Stop()
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(thanosCodec{})),
+	)
+	assert.NoError(t, err)
+	defer conn.Close()
+	ctx := context.Background()
+
+	var info thanosInfoResponse
+	assert.NoError(t, conn.Invoke(ctx, "/thanos.Store/Info", &thanosInfoRequest{}, &info))
+	external := []thanosLabel{{Name: "cluster", Value: "eu"}, {Name: "job", Value: "override"}}
+	assert.Equal(t, thanosInfoResponse{
+		Labels:    external,
+		MinTime:   math.MinInt64,
+		MaxTime:   math.MaxInt64,
+		StoreType: thanosStoreTypeStore,
+		LabelSets: [][]thanosLabel{external},
+	}, info)
+
+	series := func(req *thanosSeriesRequest) ([]thanosSeriesResponse, error) {
+		stream, err := conn.NewStream(ctx, &thanosStoreServiceDesc.Streams[0], "/thanos.Store/Series")
+		assert.NoError(t, err)
+		assert.NoError(t, stream.SendMsg(req))
+		assert.NoError(t, stream.CloseSend())
+		var out []thanosSeriesResponse
+		for {
+			var resp thanosSeriesResponse
+			if err := stream.RecvMsg(&resp); err != nil {
+				if err == io.EOF {
+					return out, nil
+				}
+				return out, err
+			}
+			out = append(out, resp)
+		}
+	}
+
+	upMatcher := thanosLabelMatcher{Name: "__name__", Value: "up"}
+	resp, err := series(&thanosSeriesRequest{MinTime: 0, MaxTime: 60000, Matchers: []thanosLabelMatcher{upMatcher, {Name: "cluster", Value: "eu"}}})
+	assert.NoError(t, err)
+	assert.Len(t, resp, 1)
+	assert.Equal(t, []thanosLabel{{Name: "__name__", Value: "up"}, {Name: "cluster", Value: "eu"}, {Name: "instance", Value: "a"}, {Name: "job", Value: "override"}}, resp[0].Series.Labels)
+	assert.Len(t, resp[0].Series.Chunks, 1)
+	chk, err := chunkenc.FromData(chunkenc.EncXOR, resp[0].Series.Chunks[0].Raw.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, chk.NumSamples())
+	// the external label matcher is not sent to clickhouse, raw samples are read in the order of the labels
+	assert.NotContains(t, queries[len(queries)-1], "cluster=eu")
+	assert.Contains(t, queries[len(queries)-1], "val AS value")
+	assert.Contains(t, queries[len(queries)-1], "ORDER BY arraySort(arrayConcat(arrayMap(x -> (substring(x, 1, position(x, '=') - 1), "+
+		"substring(x, position(x, '=') + 1)), arrayFilter(x -> position(x, '=') < length(x) AND NOT has(['cluster', 'job'], "+
+		"substring(x, 1, position(x, '=') - 1)), tags)), [('cluster', 'eu'), ('job', 'override')])), tags, t")
+
+	// downsampled data is never sent, whatever the resolution window
+	resp, err = series(&thanosSeriesRequest{MaxTime: 30 * 86400 * 1000, MaxResolutionWindow: 3600000, Matchers: []thanosLabelMatcher{upMatcher}})
+	assert.NoError(t, err)
+	assert.Len(t, resp, 1)
+	assert.Contains(t, queries[len(queries)-1], "val AS value")
+
+	// the read limits apply while streaming
+	conf.ReadMaxSamples = 1
+	_, err = series(&thanosSeriesRequest{MaxTime: 60000, Matchers: []thanosLabelMatcher{upMatcher}})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	conf.ReadMaxSamples = 0
+
+	// external labels which do not match exclude the store without a query
+	n := len(queries)
+	resp, err = series(&thanosSeriesRequest{MaxTime: 60000, Matchers: []thanosLabelMatcher{upMatcher, {Name: "cluster", Value: "us"}}})
+	assert.NoError(t, err)
+	assert.Empty(t, resp)
+	assert.Len(t, queries, n)
+
+	resp, err = series(&thanosSeriesRequest{MaxTime: 60000, Matchers: []thanosLabelMatcher{upMatcher}, SkipChunks: true})
+	assert.NoError(t, err)
+	assert.Len(t, resp, 2)
+	assert.Equal(t, thanosLabel{Name: "instance", Value: "a"}, resp[0].Series.Labels[2])
+	assert.Empty(t, resp[0].Series.Chunks)
+
+	_, err = series(&thanosSeriesRequest{MaxTime: 60000, Matchers: []thanosLabelMatcher{{Type: 2, Name: "job", Value: "("}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	var names thanosLabelNamesResponse
+	assert.NoError(t, conn.Invoke(ctx, "/thanos.Store/LabelNames", &thanosLabelNamesRequest{End: 60000}, &names))
+	assert.Equal(t, []string{"__name__", "cluster", "instance", "job"}, names.Names)
+
+	var values thanosLabelValuesResponse
+	assert.NoError(t, conn.Invoke(ctx, "/thanos.Store/LabelValues", &thanosLabelValuesRequest{Label: "cluster", End: 60000}, &values))
+	assert.Equal(t, []string{"eu"}, values.Values)
+}
@@ -0,0 +1,540 @@
+package prom2click
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of the Thanos StoreAPI (thanos.Store in pkg/store/storepb/rpc.proto and types.proto),
+// written out by hand instead of importing the thanos module and its dependencies.
+// Only the fields prom2click uses are encoded, unknown fields are skipped when decoding
+// so newer clients keep working.
+
+// thanos storepb enums
+const (
+	thanosStoreTypeStore = 4 // StoreType STORE
+	thanosChunkXOR       = 0 // Chunk.Encoding XOR
+)
+
+type thanosLabel struct {
+	Name, Value string
+}
+
+type thanosLabelMatcher struct {
+	Type        int32 // EQ, NEQ, RE, NRE numbered like prompb.LabelMatcher_Type
+	Name, Value string
+}
+
+type thanosChunk struct {
+	Type int32
+	Data []byte
+}
+
+type thanosAggrChunk struct {
+	MinTime, MaxTime int64
+	Raw              *thanosChunk
+}
+
+type thanosSeries struct {
+	Labels []thanosLabel
+	Chunks []thanosAggrChunk
+}
+
+type thanosInfoRequest struct{}
+
+type thanosInfoResponse struct {
+	Labels    []thanosLabel // deprecated by LabelSets, still read by older queriers
+	MinTime   int64
+	MaxTime   int64
+	StoreType int32
+	LabelSets [][]thanosLabel
+}
+
+type thanosSeriesRequest struct {
+	MinTime, MaxTime    int64
+	Matchers            []thanosLabelMatcher
+	MaxResolutionWindow int64
+	SkipChunks          bool
+}
+
+// thanosSeriesResponse carries either a series or a warning
+type thanosSeriesResponse struct {
+	Series  *thanosSeries
+	Warning string
+}
+
+type thanosLabelNamesRequest struct {
+	Start, End int64
+	Matchers   []thanosLabelMatcher
+}
+
+type thanosLabelNamesResponse struct {
+	Names    []string
+	Warnings []string
+}
+
+type thanosLabelValuesRequest struct {
+	Label      string
+	Start, End int64
+	Matchers   []thanosLabelMatcher
+}
+
+type thanosLabelValuesResponse struct {
+	Values   []string
+	Warnings []string
+}
+
+// thanosMessage is implemented by every message above
+type thanosMessage interface {
+	marshal(b []byte) []byte
+	unmarshal(b []byte) error
+}
+
+// thanosCodec is the grpc codec of the thanos messages, named proto to be picked for application/grpc+proto
+type thanosCodec struct{}
+
+func (thanosCodec) Name() string { return "proto" }
+
+func (thanosCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(thanosMessage)
+	if !ok {
+		return nil, fmt.Errorf("thanos codec: unsupported message %T", v)
+	}
+	return m.marshal(nil), nil
+}
+
+func (thanosCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(thanosMessage)
+	if !ok {
+		return fmt.Errorf("thanos codec: unsupported message %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+// protobuf encoding helpers, zero values are left out like proto3 does
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, m thanosMessage) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.marshal(nil))
+}
+
+// decodeFields calls fn for every field of b, fn returns false for fields it does not know
+func decodeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, known, err := fn(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if !known {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeString(typ protowire.Type, b []byte, s *string) (int, bool, error) {
+	if typ != protowire.BytesType {
+		return 0, false, nil
+	}
+	v, n := protowire.ConsumeString(b)
+	*s = v
+	return n, true, nil
+}
+
+func consumeVarint(typ protowire.Type, b []byte, v *uint64) (int, bool, error) {
+	if typ != protowire.VarintType {
+		return 0, false, nil
+	}
+	x, n := protowire.ConsumeVarint(b)
+	*v = x
+	return n, true, nil
+}
+
+func consumeInt64(typ protowire.Type, b []byte, v *int64) (int, bool, error) {
+	var x uint64
+	n, ok, err := consumeVarint(typ, b, &x)
+	*v = int64(x)
+	return n, ok, err
+}
+
+func consumeMessage(typ protowire.Type, b []byte, m thanosMessage) (int, bool, error) {
+	if typ != protowire.BytesType {
+		return 0, false, nil
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, true, nil
+	}
+	return n, true, m.unmarshal(v)
+}
+
+func (l *thanosLabel) marshal(b []byte) []byte {
+	b = appendString(b, 1, l.Name)
+	return appendString(b, 2, l.Value)
+}
+
+func (l *thanosLabel) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &l.Name)
+		case 2:
+			return consumeString(typ, b, &l.Value)
+		}
+		return 0, false, nil
+	})
+}
+
+// thanosLabelSet is ZLabelSet
+type thanosLabelSet []thanosLabel
+
+func (s *thanosLabelSet) marshal(b []byte) []byte {
+	for i := range *s {
+		b = appendMessage(b, 1, &(*s)[i])
+	}
+	return b
+}
+
+func (s *thanosLabelSet) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		if num != 1 {
+			return 0, false, nil
+		}
+		var l thanosLabel
+		n, ok, err := consumeMessage(typ, b, &l)
+		*s = append(*s, l)
+		return n, ok, err
+	})
+}
+
+func (m *thanosLabelMatcher) marshal(b []byte) []byte {
+	b = appendVarint(b, 1, uint64(m.Type))
+	b = appendString(b, 2, m.Name)
+	return appendString(b, 3, m.Value)
+}
+
+func (m *thanosLabelMatcher) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			var v uint64
+			n, ok, err := consumeVarint(typ, b, &v)
+			m.Type = int32(v)
+			return n, ok, err
+		case 2:
+			return consumeString(typ, b, &m.Name)
+		case 3:
+			return consumeString(typ, b, &m.Value)
+		}
+		return 0, false, nil
+	})
+}
+
+func consumeMatcher(typ protowire.Type, b []byte, matchers *[]thanosLabelMatcher) (int, bool, error) {
+	var m thanosLabelMatcher
+	n, ok, err := consumeMessage(typ, b, &m)
+	*matchers = append(*matchers, m)
+	return n, ok, err
+}
+
+func (c *thanosChunk) marshal(b []byte) []byte {
+	b = appendVarint(b, 1, uint64(c.Type))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, c.Data)
+}
+
+func (c *thanosChunk) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			var v uint64
+			n, ok, err := consumeVarint(typ, b, &v)
+			c.Type = int32(v)
+			return n, ok, err
+		case 2:
+			if typ != protowire.BytesType {
+				return 0, false, nil
+			}
+			v, n := protowire.ConsumeBytes(b)
+			c.Data = append([]byte(nil), v...)
+			return n, true, nil
+		}
+		return 0, false, nil
+	})
+}
+
+func (c *thanosAggrChunk) marshal(b []byte) []byte {
+	b = appendVarint(b, 1, uint64(c.MinTime))
+	b = appendVarint(b, 2, uint64(c.MaxTime))
+	if c.Raw != nil {
+		b = appendMessage(b, 3, c.Raw)
+	}
+	return b
+}
+
+func (c *thanosAggrChunk) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			return consumeInt64(typ, b, &c.MinTime)
+		case 2:
+			return consumeInt64(typ, b, &c.MaxTime)
+		case 3:
+			c.Raw = new(thanosChunk)
+			return consumeMessage(typ, b, c.Raw)
+		}
+		return 0, false, nil
+	})
+}
+
+func (s *thanosSeries) marshal(b []byte) []byte {
+	for i := range s.Labels {
+		b = appendMessage(b, 1, &s.Labels[i])
+	}
+	for i := range s.Chunks {
+		b = appendMessage(b, 2, &s.Chunks[i])
+	}
+	return b
+}
+
+func (s *thanosSeries) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			var l thanosLabel
+			n, ok, err := consumeMessage(typ, b, &l)
+			s.Labels = append(s.Labels, l)
+			return n, ok, err
+		case 2:
+			var c thanosAggrChunk
+			n, ok, err := consumeMessage(typ, b, &c)
+			s.Chunks = append(s.Chunks, c)
+			return n, ok, err
+		}
+		return 0, false, nil
+	})
+}
+
+func (*thanosInfoRequest) marshal(b []byte) []byte { return b }
+func (*thanosInfoRequest) unmarshal([]byte) error  { return nil }
+
+func (r *thanosInfoResponse) marshal(b []byte) []byte {
+	for i := range r.Labels {
+		b = appendMessage(b, 1, &r.Labels[i])
+	}
+	b = appendVarint(b, 2, uint64(r.MinTime))
+	b = appendVarint(b, 3, uint64(r.MaxTime))
+	b = appendVarint(b, 4, uint64(r.StoreType))
+	for i := range r.LabelSets {
+		set := thanosLabelSet(r.LabelSets[i])
+		b = appendMessage(b, 5, &set)
+	}
+	return b
+}
+
+func (r *thanosInfoResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			var l thanosLabel
+			n, ok, err := consumeMessage(typ, b, &l)
+			r.Labels = append(r.Labels, l)
+			return n, ok, err
+		case 2:
+			return consumeInt64(typ, b, &r.MinTime)
+		case 3:
+			return consumeInt64(typ, b, &r.MaxTime)
+		case 4:
+			var v uint64
+			n, ok, err := consumeVarint(typ, b, &v)
+			r.StoreType = int32(v)
+			return n, ok, err
+		case 5:
+			var set thanosLabelSet
+			n, ok, err := consumeMessage(typ, b, &set)
+			r.LabelSets = append(r.LabelSets, set)
+			return n, ok, err
+		}
+		return 0, false, nil
+	})
+}
+
+func (r *thanosSeriesRequest) marshal(b []byte) []byte {
+	b = appendVarint(b, 1, uint64(r.MinTime))
+	b = appendVarint(b, 2, uint64(r.MaxTime))
+	for i := range r.Matchers {
+		b = appendMessage(b, 3, &r.Matchers[i])
+	}
+	b = appendVarint(b, 4, uint64(r.MaxResolutionWindow))
+	if r.SkipChunks {
+		b = appendVarint(b, 8, 1)
+	}
+	return b
+}
+
+func (r *thanosSeriesRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			return consumeInt64(typ, b, &r.MinTime)
+		case 2:
+			return consumeInt64(typ, b, &r.MaxTime)
+		case 3:
+			return consumeMatcher(typ, b, &r.Matchers)
+		case 4:
+			return consumeInt64(typ, b, &r.MaxResolutionWindow)
+		case 8:
+			var v uint64
+			n, ok, err := consumeVarint(typ, b, &v)
+			r.SkipChunks = v != 0
+			return n, ok, err
+		}
+		return 0, false, nil
+	})
+}
+
+func (r *thanosSeriesResponse) marshal(b []byte) []byte {
+	if r.Series != nil {
+		return appendMessage(b, 1, r.Series)
+	}
+	// a set oneof field is written even when empty
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendString(b, r.Warning)
+}
+
+func (r *thanosSeriesResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			r.Series = new(thanosSeries)
+			return consumeMessage(typ, b, r.Series)
+		case 2:
+			return consumeString(typ, b, &r.Warning)
+		}
+		return 0, false, nil
+	})
+}
+
+func (r *thanosLabelNamesRequest) marshal(b []byte) []byte {
+	b = appendVarint(b, 3, uint64(r.Start))
+	b = appendVarint(b, 4, uint64(r.End))
+	for i := range r.Matchers {
+		b = appendMessage(b, 6, &r.Matchers[i])
+	}
+	return b
+}
+
+func (r *thanosLabelNamesRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 3:
+			return consumeInt64(typ, b, &r.Start)
+		case 4:
+			return consumeInt64(typ, b, &r.End)
+		case 6:
+			return consumeMatcher(typ, b, &r.Matchers)
+		}
+		return 0, false, nil
+	})
+}
+
+func marshalStrings(b []byte, num protowire.Number, ss []string) []byte {
+	for _, s := range ss {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	return b
+}
+
+func consumeStrings(typ protowire.Type, b []byte, ss *[]string) (int, bool, error) {
+	var s string
+	n, ok, err := consumeString(typ, b, &s)
+	*ss = append(*ss, s)
+	return n, ok, err
+}
+
+func (r *thanosLabelNamesResponse) marshal(b []byte) []byte {
+	b = marshalStrings(b, 1, r.Names)
+	return marshalStrings(b, 2, r.Warnings)
+}
+
+func (r *thanosLabelNamesResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			return consumeStrings(typ, b, &r.Names)
+		case 2:
+			return consumeStrings(typ, b, &r.Warnings)
+		}
+		return 0, false, nil
+	})
+}
+
+func (r *thanosLabelValuesRequest) marshal(b []byte) []byte {
+	b = appendString(b, 1, r.Label)
+	b = appendVarint(b, 4, uint64(r.Start))
+	b = appendVarint(b, 5, uint64(r.End))
+	for i := range r.Matchers {
+		b = appendMessage(b, 7, &r.Matchers[i])
+	}
+	return b
+}
+
+func (r *thanosLabelValuesRequest) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &r.Label)
+		case 4:
+			return consumeInt64(typ, b, &r.Start)
+		case 5:
+			return consumeInt64(typ, b, &r.End)
+		case 7:
+			return consumeMatcher(typ, b, &r.Matchers)
+		}
+		return 0, false, nil
+	})
+}
+
+func (r *thanosLabelValuesResponse) marshal(b []byte) []byte {
+	b = marshalStrings(b, 1, r.Values)
+	return marshalStrings(b, 2, r.Warnings)
+}
+
+func (r *thanosLabelValuesResponse) unmarshal(b []byte) error {
+	return decodeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool, error) {
+		switch num {
+		case 1:
+			return consumeStrings(typ, b, &r.Values)
+		case 2:
+			return consumeStrings(typ, b, &r.Warnings)
+		}
+		return 0, false, nil
+	})
+}